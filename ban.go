@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"otpgo/clientagent"
+	"otpgo/core"
+	"otpgo/util"
+
+	"github.com/spf13/pflag"
+)
+
+// ban asks a running daemon to ban an address from its ClientAgents through its MD.
+func ban(args []string) {
+	flags := pflag.NewFlagSet("ban", pflag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf(
+			`Usage:    otpgo ban [options]... ADDRESS [CONFIG_FILE]
+
+      Asks a running OtpGo to ban an IP address or CIDR range from its
+      ClientAgents, by sending CONTROL_BAN_ADDRESS to its MD, whose ACL
+      has to grant it admin.  The ban is added to the ban list of every
+      ClientAgent, and saved to its client.ban_list file if it has one.
+      Only new connections are refused; clients already connected from
+      the address stay.
+
+      -r, --reason    Reason for the ban, kept in the ban list.
+      -a, --address   Connect to the MD at this address instead of
+                        messagedirector.bind.
+      -h, --help      Print this help dialog.
+`)
+		os.Exit(1)
+	}
+
+	reason := flags.StringP("reason", "r", "", "Reason for the ban.")
+	address := flags.StringP("address", "a", "", "Connect to the MD at this address.")
+	help := flags.BoolP("help", "h", false, "Show the ban usage.")
+
+	flags.Parse(args)
+	if *help || flags.NArg() < 1 {
+		flags.Usage()
+	}
+
+	banned := flags.Arg(0)
+	if _, err := clientagent.ParseBanAddress(banned); err != nil {
+		fmt.Printf("Invalid address \"%s\": %s\n", banned, err)
+		os.Exit(1)
+	}
+
+	loadConfig(flags.Args()[1:])
+	if *address == "" {
+		*address = core.Config.MessageDirector.Bind
+	}
+
+	dg := util.NewDatagram()
+	dg.AddControlHeader(util.CONTROL_BAN_ADDRESS)
+	dg.AddString(banned)
+	dg.AddString(*reason)
+	sendControlMessage(*address, dg)
+	mainLog.Infof("Asked the MD at %s to ban %s", *address, banned)
+}
+
+// unban asks a running daemon to lift a ban from its ClientAgents through its MD.
+func unban(args []string) {
+	flags := pflag.NewFlagSet("unban", pflag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf(
+			`Usage:    otpgo unban [options]... ADDRESS [CONFIG_FILE]
+
+      Asks a running OtpGo to lift the ban of an IP address or CIDR
+      range from its ClientAgents, by sending CONTROL_UNBAN_ADDRESS to
+      its MD, whose ACL has to grant it admin.  The address must be
+      given as it was banned; an address within a banned range can't be
+      unbanned on its own.
+
+      -a, --address   Connect to the MD at this address instead of
+                        messagedirector.bind.
+      -h, --help      Print this help dialog.
+`)
+		os.Exit(1)
+	}
+
+	address := flags.StringP("address", "a", "", "Connect to the MD at this address.")
+	help := flags.BoolP("help", "h", false, "Show the unban usage.")
+
+	flags.Parse(args)
+	if *help || flags.NArg() < 1 {
+		flags.Usage()
+	}
+
+	banned := flags.Arg(0)
+	if _, err := clientagent.ParseBanAddress(banned); err != nil {
+		fmt.Printf("Invalid address \"%s\": %s\n", banned, err)
+		os.Exit(1)
+	}
+
+	loadConfig(flags.Args()[1:])
+	if *address == "" {
+		*address = core.Config.MessageDirector.Bind
+	}
+
+	dg := util.NewDatagram()
+	dg.AddControlHeader(util.CONTROL_UNBAN_ADDRESS)
+	dg.AddString(banned)
+	sendControlMessage(*address, dg)
+	mainLog.Infof("Asked the MD at %s to unban %s", *address, banned)
+}
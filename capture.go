@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"otpgo/core"
+	"otpgo/util"
+	"strconv"
+
+	"github.com/spf13/pflag"
+)
+
+// capture asks a running daemon to capture the datagrams of one of its clients through its MD.
+func capture(args []string) {
+	flags := pflag.NewFlagSet("capture", pflag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf(
+			`Usage:    otpgo capture [options]... CHANNEL [CONFIG_FILE]
+
+      Asks a running OtpGo to capture every datagram read from and
+      written to the client on CHANNEL, by sending it
+      CLIENTAGENT_START_CAPTURE through its MD, whose ACL has to grant
+      it admin.  The capture is written to client.capture.directory of
+      the client's ClientAgent, and can be read with "otpgo decode".
+
+      -d, --duration  Seconds to capture for, bounded by
+                        client.capture.max_duration.  Defaults to 60.
+      -a, --address   Connect to the MD at this address instead of
+                        messagedirector.bind.
+      -h, --help      Print this help dialog.
+`)
+		os.Exit(1)
+	}
+
+	duration := flags.Uint32P("duration", "d", 60, "Seconds to capture for.")
+	address := flags.StringP("address", "a", "", "Connect to the MD at this address.")
+	help := flags.BoolP("help", "h", false, "Show the capture usage.")
+
+	flags.Parse(args)
+	if *help || flags.NArg() < 1 {
+		flags.Usage()
+	}
+
+	channel, err := strconv.ParseUint(flags.Arg(0), 10, 64)
+	if err != nil {
+		fmt.Printf("Invalid channel \"%s\"\n", flags.Arg(0))
+		os.Exit(1)
+	}
+
+	loadConfig(flags.Args()[1:])
+	if *address == "" {
+		*address = core.Config.MessageDirector.Bind
+	}
+
+	dg := util.NewDatagram()
+	dg.AddServerHeader(util.Channel_t(channel), 0, util.CLIENTAGENT_START_CAPTURE)
+	dg.AddUint32(*duration)
+	sendControlMessage(*address, dg)
+	mainLog.Infof("Asked the MD at %s to capture client %d for %d seconds", *address, channel, *duration)
+}
@@ -0,0 +1,290 @@
+package clientagent
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// BanEntry bans an IP address, or a range of them.
+type BanEntry struct {
+	Prefix netip.Prefix
+	Reason string
+	// Expires is zero for permanent bans. Temporary bans aren't saved to the file.
+	Expires time.Time
+}
+
+func (e BanEntry) expired(now time.Time) bool {
+	return !e.Expires.IsZero() && now.After(e.Expires)
+}
+
+func (e BanEntry) String() string {
+	if e.Prefix.IsSingleIP() {
+		return e.Prefix.Addr().String()
+	}
+	return e.Prefix.String()
+}
+
+// ParseBanAddress parses an IP address or a CIDR range.
+func ParseBanAddress(address string) (netip.Prefix, error) {
+	address = strings.TrimSpace(address)
+	if strings.Contains(address, "/") {
+		prefix, err := netip.ParsePrefix(address)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		if prefix.Addr().Is4In6() && prefix.Bits() >= 96 {
+			return netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96).Masked(), nil
+		}
+		return prefix.Masked(), nil
+	}
+
+	ip, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	ip = ip.Unmap()
+	return netip.PrefixFrom(ip, ip.BitLen()), nil
+}
+
+// BanList holds the addresses the CA refuses connections from. If it has a path, it is loaded from
+// that file and written back whenever it changes; each line holds an IP address or CIDR range,
+// optionally followed by "# reason".
+type BanList struct {
+	sync.RWMutex
+
+	path    string
+	entries []BanEntry
+}
+
+func NewBanList(path string) (*BanList, error) {
+	b := &BanList{path: path}
+	if path == "" {
+		return b, nil
+	}
+
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		address, reason, _ := strings.Cut(scanner.Text(), "#")
+		if strings.TrimSpace(address) == "" {
+			continue
+		}
+		prefix, err := ParseBanAddress(address)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", path, line, err)
+		}
+		b.entries = append(b.entries, BanEntry{Prefix: prefix, Reason: strings.TrimSpace(reason)})
+	}
+	return b, scanner.Err()
+}
+
+// Banned returns the entry banning an address, if any.
+func (b *BanList) Banned(ip netip.Addr) (BanEntry, bool) {
+	b.RLock()
+	defer b.RUnlock()
+
+	ip = ip.Unmap()
+	now := time.Now()
+	for _, entry := range b.entries {
+		if entry.Prefix.Contains(ip) && !entry.expired(now) {
+			return entry, true
+		}
+	}
+	return BanEntry{}, false
+}
+
+// Ban adds an address or range to the list, replacing the reason if it is already on it.
+func (b *BanList) Ban(address string, reason string) error {
+	prefix, err := ParseBanAddress(address)
+	if err != nil {
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.prune()
+	if n := b.index(prefix); n >= 0 {
+		b.entries[n].Reason = reason
+		b.entries[n].Expires = time.Time{}
+	} else {
+		b.entries = append(b.entries, BanEntry{Prefix: prefix, Reason: reason})
+	}
+	return b.save()
+}
+
+// BanFor bans an address or range for a while. A permanent ban on it is left as it is.
+func (b *BanList) BanFor(address string, reason string, duration time.Duration) error {
+	prefix, err := ParseBanAddress(address)
+	if err != nil {
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.prune()
+	entry := BanEntry{Prefix: prefix, Reason: reason, Expires: time.Now().Add(duration)}
+	if n := b.index(prefix); n < 0 {
+		b.entries = append(b.entries, entry)
+	} else if !b.entries[n].Expires.IsZero() {
+		b.entries[n] = entry
+	}
+	return nil
+}
+
+// Unban removes an address or range from the list, returning whether it was on it. Addresses
+// within a banned range can't be unbanned on their own.
+func (b *BanList) Unban(address string) (bool, error) {
+	prefix, err := ParseBanAddress(address)
+	if err != nil {
+		return false, err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.prune()
+	n := b.index(prefix)
+	if n < 0 {
+		return false, nil
+	}
+	b.entries = slices.Delete(b.entries, n, n+1)
+	return true, b.save()
+}
+
+func (b *BanList) Entries() []BanEntry {
+	b.RLock()
+	defer b.RUnlock()
+	return slices.Clone(b.entries)
+}
+
+func (b *BanList) index(prefix netip.Prefix) int {
+	return slices.IndexFunc(b.entries, func(entry BanEntry) bool { return entry.Prefix == prefix })
+}
+
+// prune must be called with the list locked.
+func (b *BanList) prune() {
+	now := time.Now()
+	b.entries = slices.DeleteFunc(b.entries, func(entry BanEntry) bool { return entry.expired(now) })
+}
+
+// save must be called with the list locked. The file is replaced at once, so that it is never
+// left half written.
+func (b *BanList) save() error {
+	if b.path == "" {
+		return nil
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(b.path), filepath.Base(b.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	w := bufio.NewWriter(file)
+	for _, entry := range b.entries {
+		if !entry.Expires.IsZero() {
+			continue
+		}
+		if entry.Reason != "" {
+			fmt.Fprintf(w, "%s # %s\n", entry, entry.Reason)
+		} else {
+			fmt.Fprintln(w, entry)
+		}
+	}
+	if err := errors.Join(w.Flush(), file.Close()); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), b.path)
+}
+
+// RegisterBanList exposes a ban list to a Lua state as the banList global.
+func RegisterBanList(L *lua.LState, b *BanList) {
+	L.SetGlobal("banList", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"ban":      b.luaBan,
+		"unban":    b.luaUnban,
+		"isBanned": b.luaIsBanned,
+		"list":     b.luaList,
+	}))
+}
+
+// banList.ban(address[, reason[, seconds]]) bans an IP address or CIDR range, for a number of
+// seconds if given.
+func (b *BanList) luaBan(L *lua.LState) int {
+	var err error
+	if seconds := L.OptNumber(3, 0); seconds > 0 {
+		err = b.BanFor(L.CheckString(1), L.OptString(2, ""), time.Duration(float64(seconds)*float64(time.Second)))
+	} else {
+		err = b.Ban(L.CheckString(1), L.OptString(2, ""))
+	}
+	if err != nil {
+		L.RaiseError("unable to ban \"%s\": %s", L.CheckString(1), err)
+	}
+	return 0
+}
+
+// banList.unban(address) lifts a ban, returning whether there was one.
+func (b *BanList) luaUnban(L *lua.LState) int {
+	unbanned, err := b.Unban(L.CheckString(1))
+	if err != nil {
+		L.RaiseError("unable to unban \"%s\": %s", L.CheckString(1), err)
+	}
+	L.Push(lua.LBool(unbanned))
+	return 1
+}
+
+// banList.isBanned(ip) returns whether an IP address is banned, and the reason if it is.
+func (b *BanList) luaIsBanned(L *lua.LState) int {
+	ip, err := netip.ParseAddr(L.CheckString(1))
+	if err != nil {
+		L.ArgError(1, err.Error())
+	}
+	if entry, ok := b.Banned(ip); ok {
+		L.Push(lua.LTrue)
+		L.Push(lua.LString(entry.Reason))
+		return 2
+	}
+	L.Push(lua.LFalse)
+	return 1
+}
+
+// banList.list() returns every ban as a table of {address = ..., reason = ..., expires = ...}, where
+// expires is a Unix time, or 0 for permanent bans.
+func (b *BanList) luaList(L *lua.LState) int {
+	table := L.NewTable()
+	now := time.Now()
+	for _, entry := range b.Entries() {
+		if entry.expired(now) {
+			continue
+		}
+		ban := L.NewTable()
+		ban.RawSetString("address", lua.LString(entry.String()))
+		ban.RawSetString("reason", lua.LString(entry.Reason))
+		if entry.Expires.IsZero() {
+			ban.RawSetString("expires", lua.LNumber(0))
+		} else {
+			ban.RawSetString("expires", lua.LNumber(entry.Expires.Unix()))
+		}
+		table.Append(ban)
+	}
+	L.Push(table)
+	return 1
+}
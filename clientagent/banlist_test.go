@@ -0,0 +1,129 @@
+package clientagent
+
+import (
+	"github.com/stretchr/testify/require"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseBanAddress(t *testing.T) {
+	for address, expected := range map[string]string{
+		"192.0.2.7":            "192.0.2.7/32",
+		" 192.0.2.7 ":          "192.0.2.7/32",
+		"::ffff:192.0.2.7":     "192.0.2.7/32",
+		"192.0.2.7/24":         "192.0.2.0/24",
+		"::ffff:192.0.2.0/120": "192.0.2.0/24",
+		"2001:db8::1":          "2001:db8::1/128",
+		"2001:db8:1234::/32":   "2001:db8::/32",
+	} {
+		prefix, err := ParseBanAddress(address)
+		require.NoError(t, err, address)
+		require.Equal(t, netip.MustParsePrefix(expected), prefix, address)
+	}
+
+	for _, address := range []string{"", "banned.example.com", "192.0.2.0/33", "192.0.2.256"} {
+		_, err := ParseBanAddress(address)
+		require.Error(t, err, address)
+	}
+}
+
+func TestBanList_Banned(t *testing.T) {
+	bans, err := NewBanList("")
+	require.NoError(t, err)
+	require.NoError(t, bans.Ban("10.1.0.0/16", "range"))
+	require.NoError(t, bans.Ban("2001:db8::/32", ""))
+
+	entry, banned := bans.Banned(netip.MustParseAddr("10.1.200.3"))
+	require.True(t, banned)
+	require.Equal(t, "10.1.0.0/16", entry.String())
+	require.Equal(t, "range", entry.Reason)
+
+	// IPv4 addresses are matched however they are written
+	_, banned = bans.Banned(netip.MustParseAddr("::ffff:10.1.0.1"))
+	require.True(t, banned)
+
+	_, banned = bans.Banned(netip.MustParseAddr("10.2.0.1"))
+	require.False(t, banned)
+	_, banned = bans.Banned(netip.MustParseAddr("2001:db8:ffff::1"))
+	require.True(t, banned)
+	_, banned = bans.Banned(netip.MustParseAddr("2001:db9::1"))
+	require.False(t, banned)
+
+	// Addresses within a range can't be unbanned on their own
+	unbanned, err := bans.Unban("10.1.200.3")
+	require.NoError(t, err)
+	require.False(t, unbanned)
+	unbanned, err = bans.Unban("10.1.0.0/16")
+	require.NoError(t, err)
+	require.True(t, unbanned)
+	_, banned = bans.Banned(netip.MustParseAddr("10.1.200.3"))
+	require.False(t, banned)
+}
+
+func TestBanList_Expiry(t *testing.T) {
+	bans, err := NewBanList("")
+	require.NoError(t, err)
+	ip := netip.MustParseAddr("192.0.2.7")
+
+	require.NoError(t, bans.BanFor("192.0.2.7", "flooding", 50*time.Millisecond))
+	entry, banned := bans.Banned(ip)
+	require.True(t, banned)
+	require.False(t, entry.Expires.IsZero())
+
+	time.Sleep(100 * time.Millisecond)
+	_, banned = bans.Banned(ip)
+	require.False(t, banned)
+
+	// Expired bans are dropped once the list changes
+	require.NoError(t, bans.Ban("192.0.2.8", ""))
+	require.Len(t, bans.Entries(), 1)
+
+	// A permanent ban outlasts a temporary one, and replaces it
+	require.NoError(t, bans.Ban("192.0.2.7", "cheating"))
+	require.NoError(t, bans.BanFor("192.0.2.7", "flooding", time.Millisecond))
+	time.Sleep(10 * time.Millisecond)
+	entry, banned = bans.Banned(ip)
+	require.True(t, banned)
+	require.Equal(t, "cheating", entry.Reason)
+
+	require.NoError(t, bans.BanFor("192.0.2.9", "flooding", time.Hour))
+	require.NoError(t, bans.Ban("192.0.2.9", "cheating"))
+	entry, banned = bans.Banned(netip.MustParseAddr("192.0.2.9"))
+	require.True(t, banned)
+	require.True(t, entry.Expires.IsZero())
+}
+
+func TestBanList_File(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bans.txt")
+	require.NoError(t, os.WriteFile(path, []byte("# Banned addresses\n192.0.2.7 # cheating\n\n10.1.0.0/16\n"), 0o644))
+
+	bans, err := NewBanList(path)
+	require.NoError(t, err)
+	entry, banned := bans.Banned(netip.MustParseAddr("192.0.2.7"))
+	require.True(t, banned)
+	require.Equal(t, "cheating", entry.Reason)
+	_, banned = bans.Banned(netip.MustParseAddr("10.1.2.3"))
+	require.True(t, banned)
+
+	// Changes are written back, apart from temporary bans
+	require.NoError(t, bans.Ban("2001:db8::1", "spam"))
+	require.NoError(t, bans.BanFor("192.0.2.8", "flooding", time.Hour))
+	_, err = bans.Unban("10.1.0.0/16")
+	require.NoError(t, err)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Equal(t, "192.0.2.7 # cheating\n2001:db8::1 # spam\n", string(data))
+
+	// A missing file is an empty list, and a bad line is an error
+	bans, err = NewBanList(filepath.Join(t.TempDir(), "missing.txt"))
+	require.NoError(t, err)
+	require.Empty(t, bans.Entries())
+
+	require.NoError(t, os.WriteFile(path, []byte("192.0.2.7\nnot an address # oops\n"), 0o644))
+	_, err = NewBanList(path)
+	require.ErrorContains(t, err, path+":2:")
+}
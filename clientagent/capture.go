@@ -0,0 +1,264 @@
+package clientagent
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"otpgo/eventlogger"
+	. "otpgo/util"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Captures start with captureMagic, the format version, the time the capture was started in
+// nanoseconds and the channel of the client. They are followed by a record for each datagram:
+//
+//	uvarint microseconds since the previous record, direction, uvarint datagram length, datagram
+//
+// Datagrams are captured as they are read from or written to the client's connection.
+const (
+	captureMagic   = "OTPGOCAP"
+	captureVersion = uint16(1)
+
+	captureInbound  = byte('I')
+	captureOutbound = byte('O')
+
+	defaultCaptureDuration    = 60
+	defaultCaptureMaxDuration = 300
+)
+
+// clientCapture writes the datagrams of a client to a file. Each record is written as soon as it is
+// captured, so that a capture is complete up to the moment the client or the daemon went away.
+type clientCapture struct {
+	sync.Mutex
+
+	path     string
+	file     *os.File
+	last     time.Time
+	captured int
+	err      error
+	timer    *time.Timer
+}
+
+func newClientCapture(path string, channel Channel_t) (*clientCapture, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &clientCapture{path: path, file: file, last: time.Now()}
+
+	var header bytes.Buffer
+	header.WriteString(captureMagic)
+	binary.Write(&header, binary.LittleEndian, captureVersion)
+	binary.Write(&header, binary.LittleEndian, c.last.UnixNano())
+	binary.Write(&header, binary.LittleEndian, channel)
+	if _, err := file.Write(header.Bytes()); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *clientCapture) record(direction byte, dg Datagram) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.err != nil || c.file == nil {
+		return
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(c.last)
+	c.last = now
+
+	data := dg.Bytes()
+	record := make([]byte, 0, 2*binary.MaxVarintLen64+1+len(data))
+	record = binary.AppendUvarint(record, uint64(max(elapsed.Microseconds(), 0)))
+	record = append(record, direction)
+	record = binary.AppendUvarint(record, uint64(len(data)))
+	record = append(record, data...)
+
+	if _, c.err = c.file.Write(record); c.err == nil {
+		c.captured++
+	}
+}
+
+// close stops the capture, returning how many datagrams it has.
+func (c *clientCapture) close() (int, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.file == nil {
+		return c.captured, nil
+	}
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+
+	err := c.file.Close()
+	c.file = nil
+	return c.captured, errors.Join(c.err, err)
+}
+
+// startCapture captures the client's datagrams to a new file in the capture directory for the
+// given number of seconds, bounded by the configured maximum, and returns the file's path. A
+// capture which is already running is stopped first.
+func (c *Client) startCapture(seconds int) (string, error) {
+	maxDuration := c.config.Client.Capture.Max_Duration
+	if maxDuration == 0 {
+		maxDuration = defaultCaptureMaxDuration
+	}
+	if seconds <= 0 {
+		seconds = defaultCaptureDuration
+	}
+	seconds = min(seconds, maxDuration)
+
+	name := fmt.Sprintf("capture-%d-%s.cap", c.allocatedChannel, time.Now().Format("20060102-150405.000"))
+	path := filepath.Join(c.config.Client.Capture.Directory, name)
+	capture, err := newClientCapture(path, c.channel)
+	if err != nil {
+		return "", err
+	}
+
+	if previous := c.capture.Swap(capture); previous != nil {
+		c.finishCapture(previous, "replaced by a new capture")
+	}
+
+	duration := time.Duration(seconds) * time.Second
+	capture.Lock()
+	capture.timer = time.AfterFunc(duration, func() { c.stopCapture(capture, "finished") })
+	capture.Unlock()
+
+	c.log.Infof("Capturing datagrams to %s for %s", path, duration)
+	eventlogger.NewLoggedEvent("client-capture-started", "Client", strconv.FormatUint(uint64(c.allocatedChannel), 10),
+		fmt.Sprintf("%s|%d", path, seconds),
+	).Send()
+	return path, nil
+}
+
+// stopCapture stops the given capture if it is still the client's current one.
+func (c *Client) stopCapture(capture *clientCapture, reason string) {
+	if c.capture.CompareAndSwap(capture, nil) {
+		c.finishCapture(capture, reason)
+	}
+}
+
+func (c *Client) finishCapture(capture *clientCapture, reason string) {
+	captured, err := capture.close()
+	if err != nil {
+		c.log.Errorf("Capture %s stopped after failing to write: %s", capture.path, err)
+		return
+	}
+	c.log.Infof("Capture %s %s (%d datagrams)", capture.path, reason, captured)
+}
+
+// captureDatagram records a datagram read from or written to the client if it is being captured.
+func (c *Client) captureDatagram(direction byte, dg Datagram) {
+	if capture := c.capture.Load(); capture != nil {
+		capture.record(direction, dg)
+	}
+}
+
+// CapturedDatagram is a datagram read back from a capture.
+type CapturedDatagram struct {
+	Time time.Time
+	// Inbound is true for datagrams from the client, and false for datagrams sent to it.
+	Inbound  bool
+	Datagram Datagram
+}
+
+// CaptureReader reads datagrams back from a capture.
+type CaptureReader struct {
+	r    *bufio.Reader
+	file *os.File
+	time time.Time
+
+	// Start is when the capture was started, and Channel the channel of the client at the time.
+	Start   time.Time
+	Channel Channel_t
+}
+
+func OpenCapture(path string) (*CaptureReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &CaptureReader{r: bufio.NewReader(file), file: file}
+
+	magic := make([]byte, len(captureMagic))
+	var version uint16
+	var start int64
+	if _, err := io.ReadFull(reader.r, magic); err != nil || !bytes.Equal(magic, []byte(captureMagic)) {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a capture", path)
+	}
+	if err := binary.Read(reader.r, binary.LittleEndian, &version); err != nil || version != captureVersion {
+		file.Close()
+		return nil, fmt.Errorf("%s has an unsupported capture version %d", path, version)
+	}
+	if err := binary.Read(reader.r, binary.LittleEndian, &start); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s is truncated", path)
+	}
+	if err := binary.Read(reader.r, binary.LittleEndian, &reader.Channel); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s is truncated", path)
+	}
+
+	reader.Start = time.Unix(0, start)
+	reader.time = reader.Start
+	return reader, nil
+}
+
+// Next returns the next datagram in the capture, or io.EOF once it has been read entirely.
+func (r *CaptureReader) Next() (CapturedDatagram, error) {
+	elapsed, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return CapturedDatagram{}, err
+	}
+	direction, err := r.r.ReadByte()
+	if err != nil {
+		return CapturedDatagram{}, r.truncated(err)
+	}
+	if direction != captureInbound && direction != captureOutbound {
+		return CapturedDatagram{}, fmt.Errorf("unknown direction %d", direction)
+	}
+	length, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return CapturedDatagram{}, r.truncated(err)
+	}
+	if length > math.MaxUint16 {
+		// No datagram is this long, so the capture is corrupt.
+		return CapturedDatagram{}, fmt.Errorf("datagram length %d is over the maximum of %d", length, math.MaxUint16)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r.r, data); err != nil {
+		return CapturedDatagram{}, r.truncated(err)
+	}
+
+	r.time = r.time.Add(time.Duration(elapsed) * time.Microsecond)
+	dg := NewDatagram()
+	dg.Write(data)
+	return CapturedDatagram{r.time, direction == captureInbound, dg}, nil
+}
+
+func (r *CaptureReader) truncated(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (r *CaptureReader) Close() error {
+	return r.file.Close()
+}
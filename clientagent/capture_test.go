@@ -0,0 +1,74 @@
+package clientagent
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math"
+	"os"
+	. "otpgo/util"
+	"path/filepath"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.cap")
+	capture, err := newClientCapture(path, 1000)
+	require.NoError(t, err)
+
+	// Captures hold whatever the client sent, so only the daemon's user may read them
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	inbound, outbound := NewDatagram(), NewDatagram()
+	inbound.AddUint16(CLIENT_HEARTBEAT)
+	outbound.AddUint16(CLIENT_SYSTEM_MESSAGE)
+	outbound.AddString("hello")
+	capture.record(captureInbound, inbound)
+	capture.record(captureOutbound, outbound)
+	captured, err := capture.close()
+	require.NoError(t, err)
+	require.Equal(t, 2, captured)
+
+	reader, err := OpenCapture(path)
+	require.NoError(t, err)
+	defer reader.Close()
+	require.Equal(t, Channel_t(1000), reader.Channel)
+
+	first, err := reader.Next()
+	require.NoError(t, err)
+	require.True(t, first.Inbound)
+	require.Equal(t, inbound.Bytes(), first.Datagram.Bytes())
+	second, err := reader.Next()
+	require.NoError(t, err)
+	require.False(t, second.Inbound)
+	require.Equal(t, outbound.Bytes(), second.Datagram.Bytes())
+	require.False(t, second.Time.Before(first.Time))
+
+	_, err = reader.Next()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func TestCapture_Corrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.cap")
+	capture, err := newClientCapture(path, 1000)
+	require.NoError(t, err)
+	capture.close()
+
+	// A record claiming a datagram longer than any can be is refused before anything is allocated
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	require.NoError(t, err)
+	record := binary.AppendUvarint(nil, 0)
+	record = append(record, captureInbound)
+	record = binary.AppendUvarint(record, math.MaxUint64)
+	_, err = file.Write(record)
+	require.NoError(t, err)
+	file.Close()
+
+	reader, err := OpenCapture(path)
+	require.NoError(t, err)
+	defer reader.Close()
+	_, err = reader.Next()
+	require.ErrorContains(t, err, "over the maximum")
+}
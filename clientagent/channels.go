@@ -0,0 +1,81 @@
+package clientagent
+
+import (
+	"errors"
+	. "otpgo/util"
+	"sync"
+	"time"
+)
+
+const defaultChannelReuseDelay = 10
+
+var (
+	errChannelsExhausted = errors.New("no channels left in the CA's range")
+	errMaxClients        = errors.New("max_clients reached")
+)
+
+type freedChannel struct {
+	channel Channel_t
+	freed   time.Time
+}
+
+// ChannelTracker hands out the channels of the CA's range to clients. Freed channels are only
+// handed out again once reuseDelay has passed, so that datagrams still on their way to a client
+// which has left don't reach the next one.
+type ChannelTracker struct {
+	sync.Mutex
+
+	next Channel_t
+	max  Channel_t
+	// exhausted is set once next has been handed out up to max, as it can't go past the top of
+	// the channel space to say so.
+	exhausted bool
+	// unused channels are in the order they were freed.
+	unused     []freedChannel
+	reuseDelay time.Duration
+
+	// maxClients caps the channels allocated at once; 0 is only limited by the range.
+	maxClients int
+	allocated  int
+}
+
+func NewChannelTracker(min Channel_t, max Channel_t, maxClients int, reuseDelay time.Duration) *ChannelTracker {
+	return &ChannelTracker{next: min, max: max, exhausted: min > max, maxClients: maxClients, reuseDelay: reuseDelay}
+}
+
+// alloc returns an unused channel, or an error saying why there is none.
+func (c *ChannelTracker) alloc() (Channel_t, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.maxClients > 0 && c.allocated >= c.maxClients {
+		return 0, errMaxClients
+	}
+
+	var ch Channel_t
+	if !c.exhausted {
+		ch = c.next
+		if c.next == c.max {
+			c.exhausted = true
+		} else {
+			c.next++
+		}
+	} else if len(c.unused) != 0 && time.Since(c.unused[0].freed) >= c.reuseDelay {
+		ch = c.unused[0].channel
+		c.unused[0] = freedChannel{}
+		c.unused = c.unused[1:]
+	} else {
+		return 0, errChannelsExhausted
+	}
+
+	c.allocated++
+	return ch, nil
+}
+
+func (c *ChannelTracker) free(ch Channel_t) {
+	c.Lock()
+	defer c.Unlock()
+
+	c.unused = append(c.unused, freedChannel{channel: ch, freed: time.Now()})
+	c.allocated--
+}
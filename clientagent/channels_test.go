@@ -0,0 +1,87 @@
+package clientagent
+
+import (
+	"github.com/stretchr/testify/require"
+	. "otpgo/util"
+	"testing"
+	"time"
+)
+
+// allocChannels allocates count channels, which must all be handed out.
+func allocChannels(t *testing.T, tracker *ChannelTracker, count int) []Channel_t {
+	var channels []Channel_t
+	for range count {
+		ch, err := tracker.alloc()
+		require.NoError(t, err)
+		channels = append(channels, ch)
+	}
+	return channels
+}
+
+func TestChannelTracker_Range(t *testing.T) {
+	tracker := NewChannelTracker(1000, 1002, 0, 0)
+	require.Equal(t, []Channel_t{1000, 1001, 1002}, allocChannels(t, tracker, 3))
+	_, err := tracker.alloc()
+	require.ErrorIs(t, err, errChannelsExhausted)
+
+	// Freed channels are handed out again in the order they were freed
+	tracker.free(1001)
+	tracker.free(1000)
+	require.Equal(t, []Channel_t{1001, 1000}, allocChannels(t, tracker, 2))
+	_, err = tracker.alloc()
+	require.ErrorIs(t, err, errChannelsExhausted)
+
+	// An empty range has nothing to hand out
+	_, err = NewChannelTracker(1000, 999, 0, 0).alloc()
+	require.ErrorIs(t, err, errChannelsExhausted)
+}
+
+func TestChannelTracker_Wraparound(t *testing.T) {
+	// The range stops at its end, even at the top of the channel space
+	top := ^Channel_t(0)
+	tracker := NewChannelTracker(top-1, top, 0, 0)
+	require.Equal(t, []Channel_t{top - 1, top}, allocChannels(t, tracker, 2))
+	_, err := tracker.alloc()
+	require.ErrorIs(t, err, errChannelsExhausted)
+
+	tracker.free(top)
+	require.Equal(t, []Channel_t{top}, allocChannels(t, tracker, 1))
+
+	// and may start at its bottom
+	tracker = NewChannelTracker(0, 1, 0, 0)
+	require.Equal(t, []Channel_t{0, 1}, allocChannels(t, tracker, 2))
+	_, err = tracker.alloc()
+	require.ErrorIs(t, err, errChannelsExhausted)
+}
+
+func TestChannelTracker_MaxClients(t *testing.T) {
+	tracker := NewChannelTracker(1000, 1999, 2, 0)
+	allocChannels(t, tracker, 2)
+	_, err := tracker.alloc()
+	require.ErrorIs(t, err, errMaxClients)
+
+	// A client leaving makes room for another, on a channel it may take
+	tracker.free(1000)
+	require.Equal(t, []Channel_t{1002}, allocChannels(t, tracker, 1))
+	_, err = tracker.alloc()
+	require.ErrorIs(t, err, errMaxClients)
+}
+
+func TestChannelTracker_ReuseDelay(t *testing.T) {
+	tracker := NewChannelTracker(1000, 1000, 0, 100*time.Millisecond)
+	allocChannels(t, tracker, 1)
+	tracker.free(1000)
+
+	// The channel isn't handed out again until the delay has passed
+	_, err := tracker.alloc()
+	require.ErrorIs(t, err, errChannelsExhausted)
+
+	time.Sleep(150 * time.Millisecond)
+	require.Equal(t, []Channel_t{1000}, allocChannels(t, tracker, 1))
+
+	// Channels never handed out are used before freed ones
+	tracker = NewChannelTracker(1000, 1001, 0, 0)
+	allocChannels(t, tracker, 1)
+	tracker.free(1000)
+	require.Equal(t, []Channel_t{1001, 1000}, allocChannels(t, tracker, 2))
+}
@@ -5,6 +5,7 @@ import (
 	"slices"
 	"sort"
 	"strconv"
+	"strings"
 	"sync/atomic"
 
 	"fmt"
@@ -70,6 +71,7 @@ type Client struct {
 	// Client properties
 	config core.Role
 	ca     *ClientAgent
+	worker *LuaWorker
 	log    *log.Entry
 
 	userTable *lua.LTable
@@ -87,6 +89,15 @@ type Client struct {
 	queue     []Datagram
 	queueLock sync.Mutex
 
+	limiter     *rateLimiter
+	rateLimited atomic.Bool
+
+	// handling is the datagram from the client whose Lua handler is running, for security events.
+	handling atomic.Pointer[Datagram]
+
+	// capture records the client's datagrams while it is being captured.
+	capture atomic.Pointer[clientCapture]
+
 	shouldProcess chan bool
 	stopChan      chan bool
 
@@ -106,6 +117,15 @@ type Client struct {
 	client *net.Client
 	lock   sync.Mutex
 
+	// connLock guards the connection, which changes when the session is resumed, and the
+	// resumption state.
+	connLock    sync.Mutex
+	connection  *clientConnection
+	suspended   bool
+	held        []Datagram
+	resumeToken string
+	resumeTimer *time.Timer
+
 	cleanDisconnect  bool
 	allowedInterests InterestPermission
 	heartbeat        *time.Timer
@@ -114,12 +134,17 @@ type Client struct {
 	terminationLock  sync.Mutex
 }
 
-func NewClient(config core.Role, ca *ClientAgent, conn gonet.Conn) *Client {
+// NewClient makes a client for a connection, on a channel allocated from the CA's tracker.
+func NewClient(config core.Role, ca *ClientAgent, conn gonet.Conn, channel Channel_t) *Client {
 	c := &Client{
 		config:                config,
 		ca:                    ca,
+		allocatedChannel:      channel,
+		channel:               channel,
+		worker:                ca.assignWorker(),
 		conn:                  conn,
 		queue:                 []Datagram{},
+		limiter:               newRateLimiter(config.Client.Rate_Limit, config.Tuning.Max_Datagram_Size),
 		shouldProcess:         make(chan bool),
 		stopChan:              make(chan bool),
 		createContextMap:      NewMutexMap[uint32, func(doId Doid_t)](),
@@ -140,13 +165,7 @@ func NewClient(config core.Role, ca *ClientAgent, conn gonet.Conn) *Client {
 	c.init(config, conn)
 	c.Init(c)
 
-	c.allocatedChannel = ca.Allocate()
-	if c.allocatedChannel == 0 {
-		c.terminationLock.Unlock()
-		c.sendDisconnect(CLIENT_DISCONNECT_GENERIC, "Client capacity reached", false)
-		return nil
-	}
-	c.channel = c.allocatedChannel
+	c.worker.addClient(c)
 	c.SetName(fmt.Sprintf("Client (%d)", c.channel))
 
 	c.log = log.WithFields(log.Fields{
@@ -164,41 +183,78 @@ func NewClient(config core.Role, ca *ClientAgent, conn gonet.Conn) *Client {
 	return c
 }
 
+// sendDisconnect ejects the client. Security violations are reported along with the datagram whose
+// Lua handler is running, if any.
 func (c *Client) sendDisconnect(reason uint16, message string, security bool) {
-	// TODO: Implement security loglevel
-	var eventType string
 	if security {
-		c.log.Errorf("[SECURITY] Ejecting client (%s): %s", reason, message)
-		eventType = "client-ejected-security"
-	} else {
-		c.log.Errorf("Ejecting client (%s): %s", reason, message)
-		eventType = "client-ejected"
+		c.ejectForViolation(reason, message, c.handling.Load())
+		return
 	}
 
-	event := eventlogger.NewLoggedEvent(eventType, "Client", strconv.FormatUint(uint64(c.allocatedChannel), 10), fmt.Sprintf("%d|%s", reason, message))
+	c.log.Errorf("Ejecting client (%d): %s", reason, message)
+	event := eventlogger.NewLoggedEvent("client-ejected", "Client", strconv.FormatUint(uint64(c.allocatedChannel), 10), fmt.Sprintf("%d|%s", reason, message))
 	event.Send()
+	c.eject(reason, message)
+}
 
-	if c.client.ConnectedAndIsNotDisconnecting() {
+// ejectForViolation ejects the client for a security violation committed by sending dg.
+func (c *Client) ejectForViolation(reason uint16, message string, dg *Datagram) {
+	c.log.Errorf("[SECURITY] Ejecting client (%d): %s", reason, message)
+	c.securityViolation(reason, message, dg)
+	c.eject(reason, message)
+}
+
+// eject tells the client why it is being disconnected, if it is connected, and ends its session.
+func (c *Client) eject(reason uint16, message string) {
+	c.connLock.Lock()
+	suspended, client := c.suspended, c.client
+	c.connLock.Unlock()
+
+	if suspended {
+		// There is nobody to tell; the session just ends.
+		c.cleanDisconnect = true
+		c.Terminate(nil)
+	} else if client.ConnectedAndIsNotDisconnecting() {
 		resp := NewDatagram()
 		resp.AddUint16(CLIENT_GO_GET_LOST)
 		resp.AddUint16(reason)
 		resp.AddString(message)
-		c.client.SendDatagram(resp)
+		c.send(resp)
 
 		c.cleanDisconnect = true
 		c.Terminate(nil)
 	}
 }
 
+func (c *Client) sendSystemMessage(message string) {
+	resp := NewDatagram()
+	resp.AddUint16(CLIENT_SYSTEM_MESSAGE)
+	resp.AddString(message)
+	c.send(resp)
+}
+
 func (c *Client) annihilate() {
 	c.Lock()
 	defer c.Unlock()
+	// The client only counts as gone once its post-removes have been routed.
+	defer c.worker.removeClient(c)
 
 	if c.IsTerminated() {
 		return
 	}
 
 	c.ca.Tracker.free(c.allocatedChannel)
+	conn, _ := c.connected()
+	if ip, ok := connectionIP(conn); ok {
+		c.ca.connections.release(ip)
+	}
+	c.ca.sessions.claim(c.resumeToken, c)
+	if c.resumeTimer != nil {
+		c.resumeTimer.Stop()
+	}
+	if capture := c.capture.Load(); capture != nil {
+		c.stopCapture(capture, "stopped as the client left")
+	}
 
 	// Delete all session object
 	for len(c.sessionObjects) > 0 {
@@ -245,8 +301,25 @@ func (c *Client) buildInterest(id uint16, parent Doid_t, zones []Zone_t, server
 	return int
 }
 
+// interestAllowed checks whether the client may open an interest in parent itself, and ejects it
+// if it may not.
+func (c *Client) interestAllowed(parent Doid_t) bool {
+	switch c.allowedInterests {
+	case INTERESTS_DISABLED:
+		c.sendDisconnect(CLIENT_DISCONNECT_FORBIDDEN_INTEREST, "Client is not allowed to add interests.", true)
+		return false
+	case INTERESTS_VISIBLE:
+		if c.lookupObject(parent) == nil {
+			c.sendDisconnect(CLIENT_DISCONNECT_FORBIDDEN_INTEREST,
+				fmt.Sprintf("Client requested interest in object %d, which it can't see.", parent), true)
+			return false
+		}
+	}
+	return true
+}
+
 func (c *Client) addInterest(i Interest, context uint32, caller Channel_t) {
-	c.log.Debugf("addInterest(%t)", i)
+	c.log.Debugf("addInterest(%v)", i)
 	var zones []Zone_t
 
 	for _, zone := range i.zones {
@@ -327,7 +400,7 @@ func (c *Client) removeInterest(i Interest, context uint32) {
 }
 
 func (c *Client) closeZones(parent Doid_t, zones []Zone_t) {
-	c.log.Debugf("Closing zones: %t", zones)
+	c.log.Debugf("Closing zones: %v", zones)
 	var toRemove []Doid_t
 
 	iterator := c.visibleObjects.Iterator()
@@ -523,7 +596,7 @@ func (c *Client) HandleDatagram(dg Datagram, dgi *DatagramIterator) {
 		c.SetChannel(dgi.ReadChannel())
 	case CLIENTAGENT_SEND_DATAGRAM:
 		datagram := dgi.ReadDatagram()
-		c.client.SendDatagram(*datagram)
+		c.send(*datagram)
 	case CLIENTAGENT_OPEN_CHANNEL:
 		c.SubscribeChannel(dgi.ReadChannel())
 	case CLIENTAGENT_CLOSE_CHANNEL:
@@ -593,16 +666,22 @@ func (c *Client) HandleDatagram(dg Datagram, dgi *DatagramIterator) {
 		resp := NewDatagram()
 		resp.AddServerHeader(sender, c.channel, CLIENTAGENT_GET_TLVS_RESP)
 		resp.AddUint32(dgi.ReadUint32())
-		resp.AddDataBlob(c.client.Tlvs())
+		_, client := c.connected()
+		resp.AddDataBlob(client.Tlvs())
 		c.RouteDatagram(resp)
+	case CLIENTAGENT_START_CAPTURE:
+		if _, err := c.startCapture(int(dgi.ReadUint32())); err != nil {
+			c.log.Errorf("Unable to start a capture requested by %d: %s", sender, err)
+		}
 	case CLIENTAGENT_GET_NETWORK_ADDRESS:
 		resp := NewDatagram()
 		resp.AddServerHeader(sender, c.channel, CLIENTAGENT_GET_NETWORK_ADDRESS_RESP)
 		resp.AddUint32(dgi.ReadUint32())
-		resp.AddString(c.client.RemoteIP())
-		resp.AddUint16(c.client.RemotePort())
-		resp.AddString(c.client.LocalIP())
-		resp.AddUint16(c.client.LocalPort())
+		_, client := c.connected()
+		resp.AddString(client.RemoteIP())
+		resp.AddUint16(client.RemotePort())
+		resp.AddString(client.LocalIP())
+		resp.AddUint16(client.LocalPort())
 		c.RouteDatagram(resp)
 	case STATESERVER_OBJECT_UPDATE_FIELD:
 		do := dgi.ReadDoid()
@@ -624,19 +703,21 @@ func (c *Client) HandleDatagram(dg Datagram, dgi *DatagramIterator) {
 			}
 			c.handleUpdateField(do, dclass, dcField, dgi)
 		}
-	// case STATESERVER_OBJECT_UPDATE_FIELD_MULTIPLE:
-	// 	do := dgi.ReadDoid()
-	// 	if c.lookupObject(do) == nil {
-	// 		if c.tryQueuePending(do, dg) {
-	// 			return
-	// 		}
-	// 		c.log.Warnf("Received server-side multi-field update for unknown object %d", do)
-	// 	}
-
-	// 	if sender != c.channel {
-	// 		fields := dgi.ReadUint16()
-	// 		c.handleUpdateField(do, fields, dgi)
-	// 	}
+	case STATESERVER_OBJECT_UPDATE_FIELD_MULTIPLE:
+		do := dgi.ReadDoid()
+		dclass := c.lookupObject(do)
+		if dclass == nil {
+			if c.tryQueuePending(do, dg) {
+				return
+			}
+			c.log.Warnf("Received server-side multi-field update for unknown object %d", do)
+			return
+		}
+
+		if sender != c.channel {
+			count := dgi.ReadUint16()
+			c.handleUpdateFieldMultiple(do, dclass, count, dgi)
+		}
 	case STATESERVER_OBJECT_DELETE_RAM:
 		do := dgi.ReadDoid()
 		if c.lookupObject(do) == nil {
@@ -799,7 +880,9 @@ func (c *Client) HandleDatagram(dg Datagram, dgi *DatagramIterator) {
 			}
 		}
 	case STATESERVER_OBJECT_CHANGE_OWNER_RECV:
-		c.log.Warn("TODO: STATESERVER_OBJECT_CHANGE_OWNER_RECV")
+		do, newOwner := dgi.ReadDoid(), dgi.ReadChannel()
+		// The old owner is skipped; the new owner is sent an ENTER_OWNER by the object itself.
+		c.handleChangeOwner(do, newOwner)
 	case DBSERVER_CREATE_STORED_OBJECT_RESP:
 		context, code, doId := dgi.ReadUint32(), dgi.ReadUint8(), dgi.ReadDoid()
 		c.handleCreateDatabaseResp(context, code, doId)
@@ -808,12 +891,12 @@ func (c *Client) HandleDatagram(dg Datagram, dgi *DatagramIterator) {
 	case STATESERVER_OBJECT_QUERY_FIELDS_RESP:
 		c.handleQueryFieldsResp(dgi)
 	default:
-		if luaFunc, ok := c.ca.L.GetGlobal("handleDatagram").(*lua.LFunction); ok {
+		if luaFunc, ok := c.worker.L().GetGlobal("handleDatagram").(*lua.LFunction); ok {
 			c.ca.CallLuaFunction(luaFunc, c,
 				// Arguments:
-				NewLuaClient(c.ca.L, c),
+				NewLuaClient(c.worker.L(), c),
 				lua.LNumber(msgType),
-				NewLuaDatagramIteratorFromExisting(c.ca.L, dgi))
+				NewLuaDatagramIteratorFromExisting(c.worker.L(), dgi))
 		} else {
 			c.log.Errorf("Received unknown server msgtype %d", msgType)
 		}
@@ -966,6 +1049,29 @@ const (
 	INTERESTS_DISABLED
 )
 
+var interestPermissionNames = map[InterestPermission]string{
+	INTERESTS_ENABLED:  "enabled",
+	INTERESTS_VISIBLE:  "visible",
+	INTERESTS_DISABLED: "disabled",
+}
+
+// ParseInterestPermission parses an add_interest setting; clients may add interests if it is empty.
+func ParseInterestPermission(name string) (InterestPermission, bool) {
+	if name == "" {
+		return INTERESTS_ENABLED, true
+	}
+	for permission, permissionName := range interestPermissionNames {
+		if strings.EqualFold(name, permissionName) {
+			return permission, true
+		}
+	}
+	return INTERESTS_ENABLED, false
+}
+
+func (p InterestPermission) String() string {
+	return interestPermissionNames[p]
+}
+
 // N.B. The purpose of this file is to separate implementations of ReceiveDatagram
 //  and HandleDatagram and their associated functions-- normally, this would be done
 //  by having two separate classes Client and AstronClient, but Go has zero support
@@ -973,16 +1079,17 @@ const (
 //  distinct files still exist, but implement functions to the same class.
 
 func (c *Client) init(config core.Role, conn gonet.Conn) {
-	c.allowedInterests = INTERESTS_ENABLED
+	c.allowedInterests = c.ca.interestPermitted
 	if config.Client.Heartbeat_Timeout != 0 {
 		c.heartbeat = time.NewTimer(time.Duration(config.Client.Heartbeat_Timeout) * time.Second)
 		c.stopHeartbeat = make(chan bool, 1)
 		go c.startHeartbeat()
 	}
 
-	socket := net.NewSocketTransport(conn,
+	transport := net.NewTransport(conn,
 		time.Duration(config.Client.Keepalive)*time.Second, config.Client.Write_Buffer_Size)
-	c.client = net.NewClient(socket, c, time.Duration(5)*time.Second)
+	c.connection = &clientConnection{client: c}
+	c.client = net.NewClient(transport, c.connection, time.Duration(5)*time.Second)
 
 	event := eventlogger.NewLoggedEvent("client-connected", "Client", strconv.FormatUint(uint64(c.allocatedChannel), 10),
 		fmt.Sprintf("%s|%s", conn.RemoteAddr().String(), conn.LocalAddr().String()),
@@ -1014,9 +1121,11 @@ func (c *Client) Terminate(err error) {
 	// Lock if the client has not been fully initialized first.
 	c.terminationLock.Lock()
 
+	// A resume can't change the connection once termination has begun.
+	conn, client := c.connected()
 	if !c.cleanDisconnect && err != nil {
 		event := eventlogger.NewLoggedEvent("client-lost", "Client", strconv.FormatUint(uint64(c.allocatedChannel), 10),
-			fmt.Sprintf("%s|%s|%s", c.conn.RemoteAddr().String(), c.conn.LocalAddr().String(), err.Error()),
+			fmt.Sprintf("%s|%s|%s", conn.RemoteAddr().String(), conn.LocalAddr().String(), err.Error()),
 		)
 		event.Send()
 	}
@@ -1035,10 +1144,34 @@ func (c *Client) Terminate(err error) {
 	go c.annihilate()
 
 	c.terminationLock.Unlock()
-	c.client.Close(true)
+	client.Close(true)
+}
+
+// connected returns the connection the session is on and the client reading it, which are replaced
+// when the session is resumed.
+func (c *Client) connected() (gonet.Conn, *net.Client) {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	return c.conn, c.client
+}
+
+func (c *Client) RemoteAddr() string {
+	conn, _ := c.connected()
+	return conn.RemoteAddr().String()
 }
 
 func (c *Client) ReceiveDatagram(dg Datagram) {
+	c.captureDatagram(captureInbound, dg)
+	if c.rateLimited.Load() {
+		return
+	}
+	if limit := c.limiter.allowDatagram(dg.Len()); limit != "" {
+		if c.rateLimited.CompareAndSwap(false, true) {
+			go c.rateLimitExceeded(limit, dg)
+		}
+		return
+	}
+
 	c.queueLock.Lock()
 	c.queue = append(c.queue, dg)
 	c.queueLock.Unlock()
@@ -1049,6 +1182,44 @@ func (c *Client) ReceiveDatagram(dg Datagram) {
 	}
 }
 
+// awaitInit waits for NewClient to finish, as datagrams may be received before the client has been
+// fully initialized. It returns false if the client has been terminated since.
+func (c *Client) awaitInit() bool {
+	c.terminationLock.Lock()
+	c.terminationLock.Unlock()
+	return !c.IsTerminated()
+}
+
+// rateLimitExceeded ejects a client which went over one of its rate limits by sending dg.
+func (c *Client) rateLimitExceeded(limit string, dg Datagram) {
+	if !c.awaitInit() {
+		return
+	}
+
+	event := eventlogger.NewLoggedEvent("client-rate-limited", "Client", strconv.FormatUint(uint64(c.allocatedChannel), 10),
+		fmt.Sprintf("%s|%s", c.RemoteAddr(), limit),
+	)
+	event.Send()
+	c.ejectForViolation(CLIENT_DISCONNECT_RATE_LIMITED, fmt.Sprintf("Exceeded the rate limit for %s.", limit), &dg)
+}
+
+func (c *Client) MaxDatagramSize() int {
+	return c.config.Tuning.Max_Datagram_Size
+}
+
+// OversizedDatagram is called from the read loop as soon as the client sends a datagram over the
+// configured maximum size. The violation is reported with the part of it which had been read.
+func (c *Client) OversizedDatagram(size int, header []byte) {
+	dg := NewDatagram()
+	dg.Write(header)
+	go func() {
+		if c.awaitInit() {
+			c.ejectForViolation(CLIENT_DISCONNECT_OVERSIZED_DATAGRAM,
+				fmt.Sprintf("Sent a datagram of %d bytes, over the maximum of %d.", size, c.MaxDatagramSize()), &dg)
+		}
+	}()
+}
+
 func (c *Client) getDatagramFromQueue() Datagram {
 	c.queueLock.Lock()
 	defer c.queueLock.Unlock()
@@ -1084,10 +1255,15 @@ func (c *Client) queueLoop() {
 					}()
 
 					// Pass the datagram over to Lua to handle:
-					c.ca.CallLuaFunction(c.ca.receiveDatagramFunc, c,
+					c.worker.call(LuaQueueEntry{
+						fn:       c.worker.receiveDatagramFunc(),
+						client:   c,
+						datagram: &dg,
 						// Arguments:
-						NewLuaClient(c.ca.L, c),
-						NewLuaDatagramIteratorFromExisting(c.ca.L, dgi))
+						args: []lua.LValue{
+							NewLuaClient(c.worker.L(), c),
+							NewLuaDatagramIteratorFromExisting(c.worker.L(), dgi)},
+					})
 					finish <- true
 				}()
 
@@ -1209,11 +1385,11 @@ func (c *Client) setDatabaseValues(doId Doid_t, packedValues map[string]dc.Vecto
 }
 
 func (c *Client) handleAddOwnership(do Doid_t, parent Doid_t, zone Zone_t, dc uint16, dgi *DatagramIterator) {
-	lFunc := c.ca.L.GetGlobal("handleAddOwnership")
+	lFunc := c.worker.L().GetGlobal("handleAddOwnership")
 	if lFunc.Type() == lua.LTFunction {
 		// Call the Lua function instead of sending the
 		// built-in response.
-		c.ca.CallLuaFunction(lFunc, c, NewLuaClient(c.ca.L, c), lua.LNumber(do), lua.LNumber(parent), lua.LNumber(zone), lua.LNumber(dc), NewLuaDatagramIteratorFromExisting(c.ca.L, dgi))
+		c.ca.CallLuaFunction(lFunc, c, NewLuaClient(c.worker.L(), c), lua.LNumber(do), lua.LNumber(parent), lua.LNumber(zone), lua.LNumber(dc), NewLuaDatagramIteratorFromExisting(c.worker.L(), dgi))
 		return
 	}
 
@@ -1223,14 +1399,31 @@ func (c *Client) handleAddOwnership(do Doid_t, parent Doid_t, zone Zone_t, dc ui
 	resp.AddUint16(dc)
 	resp.AddDoid(do)
 	resp.AddData(dgi.ReadRemainder())
-	c.client.SendDatagram(resp)
+	c.send(resp)
 }
 
 func (c *Client) handleRemoveOwnership(do Doid_t) {
 	resp := NewDatagram()
 	resp.AddUint16(CLIENT_OBJECT_DISABLE_OWNER)
 	resp.AddDoid(do)
-	c.client.SendDatagram(resp)
+	c.send(resp)
+}
+
+// handleChangeOwner takes ownership of an object away from the client once it has a new owner.
+func (c *Client) handleChangeOwner(do Doid_t, newOwner Channel_t) {
+	if newOwner == c.channel || newOwner == c.allocatedChannel {
+		// The object is still ours.
+		return
+	}
+
+	if _, ok := c.ownedObjects.Get(do); !ok {
+		c.log.Warnf("Got owner change for an object we don't own: %d", do)
+		return
+	}
+
+	c.log.Debugf("Ownership of object %d moved to %d", do, newOwner)
+	c.ownedObjects.Delete(do, false)
+	c.handleRemoveOwnership(do)
 }
 
 func (c *Client) isFieldSendable(do Doid_t, field dc.DCField) bool {
@@ -1277,6 +1470,13 @@ func (c *Client) handleClientUpdateField(do Doid_t, field uint16, dgi *DatagramI
 		return
 	}
 
+	if !c.limiter.allowFieldUpdate(field) {
+		c.rateLimitExceeded(fmt.Sprintf("%s updates", dcField.GetName()), *dgi.Dg)
+		// Skip the data to prevent the excess data ejection.
+		dgi.Skip(dgi.RemainingSize())
+		return
+	}
+
 	DCLock.Lock()
 	defer DCLock.Unlock()
 
@@ -1290,7 +1490,7 @@ func (c *Client) handleClientUpdateField(do Doid_t, field uint16, dgi *DatagramI
 
 	c.log.Debugf("Got client \"%s\" update for object %s(%d): %s", dcField.GetName(), dclass.GetName(), do, dcField.FormatData(packedData))
 
-	lFunc := c.ca.L.GetGlobal(fmt.Sprintf("handleClient%s_%s", dclass.GetName(), dcField.GetName()))
+	lFunc := c.worker.L().GetGlobal(fmt.Sprintf("handleClient%s_%s", dclass.GetName(), dcField.GetName()))
 	if lFunc.Type() == lua.LTFunction {
 		// Call the Lua function instead of sending the
 		// built-in response.
@@ -1299,13 +1499,13 @@ func (c *Client) handleClientUpdateField(do Doid_t, field uint16, dgi *DatagramI
 
 		unpacker.SetUnpackData(packedData)
 		unpacker.BeginUnpack(dcField)
-		lValue := core.UnpackDataToLuaValue(unpacker, c.ca.L)
+		lValue := core.UnpackDataToLuaValue(unpacker, c.worker.L())
 		if !unpacker.EndUnpack() {
 			c.log.Warnf("EndUnpack returned false on handleClientUpdateField somehow...\n%s", DumpUnpacker(unpacker))
 			return
 		}
 
-		c.ca.CallLuaFunction(lFunc, c, NewLuaClient(c.ca.L, c), lua.LNumber(do), lua.LNumber(field), lValue)
+		c.ca.CallLuaFunction(lFunc, c, NewLuaClient(c.worker.L(), c), lua.LNumber(do), lua.LNumber(field), lValue)
 		return
 	}
 
@@ -1320,7 +1520,7 @@ func (c *Client) handleClientUpdateField(do Doid_t, field uint16, dgi *DatagramI
 }
 
 func (c *Client) handleUpdateField(do Doid_t, dclass dc.DCClass, dcField dc.DCField, dgi *DatagramIterator) {
-	lFunc := c.ca.L.GetGlobal(fmt.Sprintf("handle%s_%s", dclass.GetName(), dcField.GetName()))
+	lFunc := c.worker.L().GetGlobal(fmt.Sprintf("handle%s_%s", dclass.GetName(), dcField.GetName()))
 	if lFunc.Type() == lua.LTFunction {
 		// Call the Lua function instead of sending the
 		// built-in response.
@@ -1336,13 +1536,13 @@ func (c *Client) handleUpdateField(do Doid_t, dclass dc.DCClass, dcField dc.DCFi
 
 		unpacker.SetUnpackData(packedData)
 		unpacker.BeginUnpack(dcField)
-		lValue := core.UnpackDataToLuaValue(unpacker, c.ca.L)
+		lValue := core.UnpackDataToLuaValue(unpacker, c.worker.L())
 		if !unpacker.EndUnpack() {
 			c.log.Warnf("EndUnpack returned false on handleUpdateField somehow...\n%s", DumpUnpacker(unpacker))
 			return
 		}
 
-		c.ca.CallLuaFunction(lFunc, c, NewLuaClient(c.ca.L, c), lua.LNumber(do), lua.LNumber(dcField.GetNumber()), lValue)
+		c.ca.CallLuaFunction(lFunc, c, NewLuaClient(c.worker.L(), c), lua.LNumber(do), lua.LNumber(dcField.GetNumber()), lValue)
 		return
 	}
 
@@ -1351,7 +1551,35 @@ func (c *Client) handleUpdateField(do Doid_t, dclass dc.DCClass, dcField dc.DCFi
 	resp.AddDoid(do)
 	resp.AddUint16(uint16(dcField.GetNumber()))
 	resp.AddData(dgi.ReadRemainder())
-	c.client.SendDatagram(resp)
+	c.send(resp)
+}
+
+// handleUpdateFieldMultiple passes on each field of a multi-field update the client may see as
+// a separate update, as clients can only be sent one field at a time.
+func (c *Client) handleUpdateFieldMultiple(do Doid_t, dclass dc.DCClass, count uint16, dgi *DatagramIterator) {
+	_, owned := c.ownedObjects.Get(do)
+	for i := 0; i < int(count); i++ {
+		field := dgi.ReadUint16()
+		dcField := dclass.GetFieldByIndex(int(field))
+		if dcField == dc.SwigcptrDCField(0) {
+			c.log.Warnf("Received server-side multi-field update for object %s(%d) with unknown field %d", dclass.GetName(), do, field)
+			return
+		}
+
+		data, ok := dgi.ReadDCField(dcField, false, true)
+		if !ok {
+			c.log.Warnf("Received server-side multi-field update for object %s(%d) with invalid data for field %s", dclass.GetName(), do, dcField.GetName())
+			return
+		}
+
+		if !dcField.IsBroadcast() && !(owned && dcField.IsOwnrecv()) {
+			continue
+		}
+
+		fieldDg := NewDatagram()
+		fieldDg.AddData(data)
+		c.handleUpdateField(do, dclass, dcField, NewDatagramIterator(&fieldDg))
+	}
 }
 
 func (c *Client) handleRemoveInterest(id uint16, context uint32) {
@@ -1359,7 +1587,7 @@ func (c *Client) handleRemoveInterest(id uint16, context uint32) {
 	resp.AddUint16(CLIENT_REMOVE_INTEREST)
 	resp.AddUint16(id)
 	resp.AddUint32(context)
-	c.client.SendDatagram(resp)
+	c.send(resp)
 }
 
 func (c *Client) handleAddInterest(i Interest, context uint32) {
@@ -1371,15 +1599,15 @@ func (c *Client) handleAddInterest(i Interest, context uint32) {
 	for _, zone := range i.zones {
 		resp.AddZone(zone)
 	}
-	c.client.SendDatagram(resp)
+	c.send(resp)
 }
 
 func (c *Client) handleRemoveObject(do Doid_t, deleted bool) {
-	lFunc := c.ca.L.GetGlobal("handleRemoveObject")
+	lFunc := c.worker.L().GetGlobal("handleRemoveObject")
 	if lFunc.Type() == lua.LTFunction {
 		// Call the Lua function instead of sending the
 		// built-in response.
-		c.ca.CallLuaFunction(lFunc, c, NewLuaClient(c.ca.L, c), lua.LNumber(do))
+		c.ca.CallLuaFunction(lFunc, c, NewLuaClient(c.worker.L(), c), lua.LNumber(do))
 		return
 	}
 	resp := NewDatagram()
@@ -1392,15 +1620,15 @@ func (c *Client) handleRemoveObject(do Doid_t, deleted bool) {
 
 	resp.AddUint16(uint16(msgType))
 	resp.AddDoid(do)
-	c.client.SendDatagram(resp)
+	c.send(resp)
 }
 
 func (c *Client) handleObjectLocation(do Doid_t, parent Doid_t, zone Zone_t) {
-	lFunc := c.ca.L.GetGlobal("handleObjectLocation")
+	lFunc := c.worker.L().GetGlobal("handleObjectLocation")
 	if lFunc.Type() == lua.LTFunction {
 		// Call the Lua function instead of sending the
 		// built-in response.
-		c.ca.CallLuaFunction(lFunc, c, NewLuaClient(c.ca.L, c), lua.LNumber(do), lua.LNumber(parent), lua.LNumber(zone))
+		c.ca.CallLuaFunction(lFunc, c, NewLuaClient(c.worker.L(), c), lua.LNumber(do), lua.LNumber(parent), lua.LNumber(zone))
 		return
 	}
 	dg := NewDatagram()
@@ -1408,7 +1636,7 @@ func (c *Client) handleObjectLocation(do Doid_t, parent Doid_t, zone Zone_t) {
 	dg.AddDoid(do)
 	dg.AddDoid(parent)
 	dg.AddZone(zone)
-	c.client.SendDatagram(dg)
+	c.send(dg)
 }
 
 func (c *Client) handleAddObject(do Doid_t, parent Doid_t, zone Zone_t, dc uint16, dgi *DatagramIterator, other bool) {
@@ -1429,15 +1657,15 @@ func (c *Client) handleAddObject(do Doid_t, parent Doid_t, zone Zone_t, dc uint1
 	resp.AddUint16(dc)
 	resp.AddDoid(do)
 	resp.AddData(dgi.ReadRemainder())
-	c.client.SendDatagram(resp)
+	c.send(resp)
 }
 
 func (c *Client) handleInterestDone(interestId uint16, context uint32) {
-	lFunc := c.ca.L.GetGlobal("handleInterestDone")
+	lFunc := c.worker.L().GetGlobal("handleInterestDone")
 	if lFunc.Type() == lua.LTFunction {
 		// Call the Lua function instead of sending the
 		// built-in response.
-		c.ca.CallLuaFunction(lFunc, c, NewLuaClient(c.ca.L, c), lua.LNumber(interestId), lua.LNumber(context))
+		c.ca.CallLuaFunction(lFunc, c, NewLuaClient(c.worker.L(), c), lua.LNumber(interestId), lua.LNumber(context))
 		return
 	}
 	if context > 0 {
@@ -1445,7 +1673,7 @@ func (c *Client) handleInterestDone(interestId uint16, context uint32) {
 		resp.AddUint16(CLIENT_DONE_INTEREST_RESP)
 		resp.AddUint16(interestId)
 		resp.AddUint32(context)
-		c.client.SendDatagram(resp)
+		c.send(resp)
 	}
 }
 
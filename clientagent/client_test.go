@@ -0,0 +1,317 @@
+package clientagent
+
+import (
+	"github.com/apex/log"
+	"github.com/stretchr/testify/require"
+	gonet "net"
+	"otpgo/core"
+	. "otpgo/util"
+	"sync"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+var loadDC sync.Once
+
+// loadTestDC loads the DC file of the tests, in which the classes of objects are looked up.
+func loadTestDC(t *testing.T) {
+	loadDC.Do(func() {
+		if core.Config == nil {
+			core.Config = &core.ServerConfig{}
+		}
+		core.Config.General.DC_Files = []string{"../test/test.dc"}
+		require.NoError(t, core.LoadDC())
+	})
+}
+
+// newTestWorkers gives a CA workers which only run the Go functions queued on them, as their Lua
+// state needs the DC file.
+func newTestWorkers(ca *ClientAgent, count int) {
+	for id := range count {
+		w := &LuaWorker{
+			ca:           ca,
+			id:           id,
+			queue:        []LuaQueueEntry{},
+			processQueue: make(chan bool, 1),
+			clients:      make(map[*Client]bool),
+		}
+		go w.queueLoop()
+		ca.workers = append(ca.workers, w)
+	}
+}
+
+// newHeldClient makes a client without a connection, as if it were suspended, so that whatever is
+// sent to it is held in c.held.
+func newHeldClient(channel Channel_t) *Client {
+	c := &Client{
+		channel:          channel,
+		allocatedChannel: channel,
+		suspended:        true,
+		visibleObjects:   NewMutexMap[Doid_t, VisibleObject](),
+		declaredObjects:  NewMutexMap[Doid_t, DeclaredObject](),
+		ownedObjects:     NewMutexMap[Doid_t, OwnedObject](),
+		sendableFields:   NewMutexMap[Doid_t, []uint16](),
+		pendingObjects:   NewMutexMap[Doid_t, uint32](),
+		pendingInterests: NewMutexMap[uint32, *InterestOperation](),
+	}
+	c.log = log.WithFields(log.Fields{"name": "Test client", "modName": "Client"})
+	return c
+}
+
+// handleServerDatagram hands the client a datagram from the MD, as addressed to its channel.
+func handleServerDatagram(c *Client, dg Datagram) {
+	dgi := NewDatagramIterator(&dg)
+	for n := dgi.ReadUint8(); n > 0; n-- {
+		dgi.ReadChannel()
+	}
+	c.HandleDatagram(dg, dgi)
+}
+
+func changeOwner(c *Client, do Doid_t, newOwner Channel_t, oldOwner Channel_t) {
+	dg := NewDatagram()
+	dg.AddServerHeader(c.channel, Channel_t(do), STATESERVER_OBJECT_CHANGE_OWNER_RECV)
+	dg.AddDoid(do)
+	dg.AddChannel(newOwner)
+	dg.AddChannel(oldOwner)
+	handleServerDatagram(c, dg)
+}
+
+func TestClient_ChangeOwner(t *testing.T) {
+	c := newHeldClient(1000)
+	c.ownedObjects.Set(500, OwnedObject{}, false)
+	c.ownedObjects.Set(501, OwnedObject{}, false)
+
+	// Objects which are still ours, or which we never owned, are left alone
+	changeOwner(c, 500, 1000, 2000)
+	changeOwner(c, 502, 2000, 1000)
+	require.Empty(t, c.held)
+	_, owned := c.ownedObjects.Get(500)
+	require.True(t, owned)
+
+	// Once an object has another owner, the client loses it
+	changeOwner(c, 500, 2000, 1000)
+	_, owned = c.ownedObjects.Get(500)
+	require.False(t, owned)
+	_, owned = c.ownedObjects.Get(501)
+	require.True(t, owned)
+
+	require.Len(t, c.held, 1)
+	dgi := NewDatagramIterator(&c.held[0])
+	require.Equal(t, uint16(CLIENT_OBJECT_DISABLE_OWNER), dgi.ReadUint16())
+	require.Equal(t, Doid_t(500), dgi.ReadDoid())
+	require.Zero(t, dgi.RemainingSize())
+
+	// It only loses it once
+	changeOwner(c, 500, 3000, 2000)
+	require.Len(t, c.held, 1)
+}
+
+func TestClient_ChangeOwner_SessionChannel(t *testing.T) {
+	// A client keeps its objects when they move to the channel it was given by the Lua script
+	c := newHeldClient(1000)
+	c.channel = 1<<32 | 1000
+	c.ownedObjects.Set(500, OwnedObject{}, false)
+
+	changeOwner(c, 500, 1000, 2000)
+	changeOwner(c, 500, 1<<32|1000, 1000)
+	require.Empty(t, c.held)
+	_, owned := c.ownedObjects.Get(500)
+	require.True(t, owned)
+}
+
+// newScriptedClient makes a held client whose worker has run script.
+func newScriptedClient(t *testing.T, script string) *Client {
+	ca := &ClientAgent{}
+	newTestWorkers(ca, 1)
+	L := lua.NewState()
+	t.Cleanup(L.Close)
+	require.NoError(t, L.DoString(script))
+	ca.workers[0].current.Store(&luaState{L: L})
+
+	c := newHeldClient(1000)
+	c.ca, c.worker = ca, ca.workers[0]
+	return c
+}
+
+// seeObject makes an object of the DistributedClientTestObject class visible to the client.
+func seeObject(c *Client, do Doid_t) {
+	dclass := core.DC.GetClassByName("DistributedClientTestObject")
+	c.visibleObjects.Set(do, VisibleObject{DeclaredObject: DeclaredObject{do: do, dc: dclass}}, false)
+	c.seenObjects = append(c.seenObjects, do)
+}
+
+// updateFields sends the client a multi-field update of setName, setColor and sendMessage.
+func updateFields(c *Client, do Doid_t) {
+	dclass := core.DC.GetClassByName("DistributedClientTestObject")
+	dg := NewDatagram()
+	dg.AddServerHeader(c.channel, Channel_t(do), STATESERVER_OBJECT_UPDATE_FIELD_MULTIPLE)
+	dg.AddDoid(do)
+	dg.AddUint16(3)
+	dg.AddUint16(uint16(dclass.GetFieldByName("setName").GetNumber()))
+	dg.AddString("name")
+	dg.AddUint16(uint16(dclass.GetFieldByName("setColor").GetNumber()))
+	dg.AddUint8(1)
+	dg.AddUint8(2)
+	dg.AddUint8(3)
+	dg.AddUint16(uint16(dclass.GetFieldByName("sendMessage").GetNumber()))
+	dg.AddString("message")
+	handleServerDatagram(c, dg)
+}
+
+// heldFields returns the fields of the field updates held for a client, and forgets them.
+func heldFields(t *testing.T, c *Client, do Doid_t) []string {
+	dclass := core.DC.GetClassByName("DistributedClientTestObject")
+	var fields []string
+	for _, dg := range c.held {
+		dgi := NewDatagramIterator(&dg)
+		require.Equal(t, uint16(CLIENT_OBJECT_UPDATE_FIELD), dgi.ReadUint16())
+		require.Equal(t, do, dgi.ReadDoid())
+		fields = append(fields, dclass.GetFieldByIndex(int(dgi.ReadUint16())).GetName())
+	}
+	c.held = nil
+	return fields
+}
+
+func TestClient_UpdateFieldMultiple(t *testing.T) {
+	loadTestDC(t)
+	c := newScriptedClient(t, "")
+	seeObject(c, 600)
+
+	// Updates of objects the client doesn't know of aren't passed on
+	updateFields(c, 601)
+	require.Empty(t, c.held)
+
+	// Each field the client may see is sent on its own; setName isn't broadcast, and sendMessage
+	// only goes to the owner
+	updateFields(c, 600)
+	require.Equal(t, []string{"setColor"}, heldFields(t, c, 600))
+
+	dclass := core.DC.GetClassByName("DistributedClientTestObject")
+	c.ownedObjects.Set(600, OwnedObject{DeclaredObject: DeclaredObject{do: 600, dc: dclass}}, false)
+	updateFields(c, 600)
+	require.Equal(t, []string{"setColor", "sendMessage"}, heldFields(t, c, 600))
+
+	// The rest of an update is dropped from the first field the class doesn't have
+	dg := NewDatagram()
+	dg.AddServerHeader(c.channel, 600, STATESERVER_OBJECT_UPDATE_FIELD_MULTIPLE)
+	dg.AddDoid(600)
+	dg.AddUint16(2)
+	dg.AddUint16(0x1337)
+	dg.AddUint16(uint16(dclass.GetFieldByName("setColor").GetNumber()))
+	dg.AddUint8(1)
+	dg.AddUint8(2)
+	dg.AddUint8(3)
+	handleServerDatagram(c, dg)
+	require.Empty(t, c.held)
+
+	// Updates the client sent itself aren't echoed back
+	dg = NewDatagram()
+	dg.AddServerHeader(c.channel, c.channel, STATESERVER_OBJECT_UPDATE_FIELD_MULTIPLE)
+	dg.AddDoid(600)
+	dg.AddUint16(1)
+	dg.AddUint16(uint16(dclass.GetFieldByName("setColor").GetNumber()))
+	dg.AddUint8(1)
+	dg.AddUint8(2)
+	dg.AddUint8(3)
+	handleServerDatagram(c, dg)
+	require.Empty(t, c.held)
+}
+
+func TestClient_UpdateFieldMultiple_Lua(t *testing.T) {
+	loadTestDC(t)
+	c := newScriptedClient(t, `
+		handled = {}
+		function handleDistributedClientTestObject_setColor(client, doId, fieldId, value)
+			table.insert(handled, doId)
+		end
+	`)
+	seeObject(c, 600)
+
+	// A field with a handler in the script is handed to it instead of being sent
+	updateFields(c, 600)
+	require.Empty(t, heldFields(t, c, 600))
+
+	handled := make(chan int)
+	c.worker.call(LuaQueueEntry{run: func() {
+		handled <- c.worker.L().GetGlobal("handled").(*lua.LTable).Len()
+	}})
+	select {
+	case n := <-handled:
+		require.Equal(t, 1, n)
+	case <-time.After(time.Second):
+		t.Fatal("Field handler was not called")
+	}
+}
+
+func TestClient_ParseInterestPermission(t *testing.T) {
+	for name, expected := range map[string]InterestPermission{
+		"":         INTERESTS_ENABLED,
+		"enabled":  INTERESTS_ENABLED,
+		"Visible":  INTERESTS_VISIBLE,
+		"DISABLED": INTERESTS_DISABLED,
+	} {
+		permission, ok := ParseInterestPermission(name)
+		require.True(t, ok, name)
+		require.Equal(t, expected, permission, name)
+	}
+
+	_, ok := ParseInterestPermission("sometimes")
+	require.False(t, ok)
+	require.Equal(t, "visible", INTERESTS_VISIBLE.String())
+}
+
+// newEjectableClient makes a held client which can be ejected without a CA behind it.
+func newEjectableClient(t *testing.T) *Client {
+	c := newHeldClient(1000)
+	conn, other := gonet.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		other.Close()
+	})
+	c.conn = conn
+	c.ca = &ClientAgent{}
+	// Nothing is left to terminate
+	c.terminationBegun.Store(true)
+	return c
+}
+
+func TestClient_InterestAllowed(t *testing.T) {
+	loadTestDC(t)
+
+	c := newEjectableClient(t)
+	require.True(t, c.interestAllowed(600))
+
+	// Only objects the client can see may be the parents of its interests
+	c.allowedInterests = INTERESTS_VISIBLE
+	seeObject(c, 600)
+	require.True(t, c.interestAllowed(600))
+	require.False(t, c.interestAllowed(601))
+	require.True(t, c.cleanDisconnect)
+
+	c = newEjectableClient(t)
+	c.allowedInterests = INTERESTS_DISABLED
+	seeObject(c, 600)
+	require.False(t, c.interestAllowed(600))
+	require.True(t, c.cleanDisconnect)
+}
+
+func TestClient_LuaInterestPermission(t *testing.T) {
+	L := lua.NewState()
+	defer L.Close()
+	RegisterClientType(L)
+
+	c := newHeldClient(1000)
+	L.SetGlobal("client", NewLuaClient(L, c))
+
+	require.NoError(t, L.DoString(`assert(client:interestPermission() == "enabled")`))
+	require.NoError(t, L.DoString(`client:interestPermission("visible")`))
+	require.Equal(t, INTERESTS_VISIBLE, c.allowedInterests)
+	require.NoError(t, L.DoString(`assert(client:interestPermission() == "visible")`))
+
+	// An unknown permission is an error, and changes nothing
+	err := L.DoString(`client:interestPermission("sometimes")`)
+	require.ErrorContains(t, err, "Expected \"enabled\", \"visible\" or \"disabled\".")
+	require.Equal(t, INTERESTS_VISIBLE, c.allowedInterests)
+}
@@ -3,38 +3,19 @@ package clientagent
 import (
 	"fmt"
 	gonet "net"
-	"os"
-	"os/signal"
 	"otpgo/core"
 	"otpgo/eventlogger"
 	"otpgo/messagedirector"
 	"otpgo/net"
 	. "otpgo/util"
-	"strconv"
 	"sync"
-
-	"net/http"
+	"sync/atomic"
+	"time"
 
 	"github.com/apex/log"
-	gluahttp "github.com/cjoudrey/gluahttp"
-	gluacrypto "github.com/tengattack/gluacrypto"
-	libs "github.com/vadv/gopher-lua-libs"
 	lua "github.com/yuin/gopher-lua"
 )
 
-type ChannelTracker struct {
-	next   Channel_t
-	max    Channel_t
-	unused []Channel_t
-	log    *log.Entry
-}
-
-type LuaQueueEntry struct {
-	fn     lua.LValue
-	client *Client
-	args   []lua.LValue
-}
-
 type ClientAgent struct {
 	net.NetworkServer
 	sync.Mutex
@@ -43,37 +24,24 @@ type ClientAgent struct {
 	config  core.Role
 	log     *log.Entry
 
-	rng             messagedirector.Range
-	interestTimeout int
-	database        Channel_t
-
-	L            *lua.LState
-	LQueue       []LuaQueueEntry
-	processQueue chan bool
-
-	receiveDatagramFunc *lua.LFunction
-}
+	rng               messagedirector.Range
+	interestTimeout   int
+	interestPermitted InterestPermission
+	database          Channel_t
 
-func NewChannelTracker(min Channel_t, max Channel_t, log *log.Entry) *ChannelTracker {
-	return &ChannelTracker{next: min, max: max}
-}
+	workers    []*LuaWorker
+	nextWorker atomic.Uint32
+	shared     *SharedState
 
-func (c *ChannelTracker) alloc() Channel_t {
-	var ch Channel_t
-	if c.next <= c.max {
-		c.next++
-		return c.next
-	} else if len(c.unused) != 0 {
-		ch, c.unused = c.unused[0], c.unused[1:]
-		return ch
-	} else {
-		c.log.Fatalf("CA has no more available channels.")
-	}
-	return 0
-}
+	drain *drainState
+	// refused counts the connections turned away, whether for being banned, over the connection
+	// limits or for lack of room.
+	refused atomic.Uint64
 
-func (c *ChannelTracker) free(ch Channel_t) {
-	c.unused = append(c.unused, ch)
+	connections *connectionLimiter
+	bans        *BanList
+	sessions    *resumeSessions
+	violations  *violationTracker
 }
 
 func NewClientAgent(config core.Role) *ClientAgent {
@@ -84,10 +52,19 @@ func NewClientAgent(config core.Role) *ClientAgent {
 			"name":    fmt.Sprintf("ClientAgent (%s)", config.Bind),
 			"modName": "ClientAgent",
 		}),
-		LQueue:       []LuaQueueEntry{},
-		processQueue: make(chan bool),
+		shared: NewSharedState(),
+		drain:  newDrainState(),
+
+		connections: newConnectionLimiter(config.Client.Connection_Limit),
+		sessions:    newResumeSessions(),
+		violations:  newViolationTracker(config.Client.Security),
+	}
+	reuseDelay := config.Channels.Reuse_Delay
+	if reuseDelay == 0 {
+		reuseDelay = defaultChannelReuseDelay
 	}
-	ca.Tracker = NewChannelTracker(Channel_t(config.Channels.Min), Channel_t(config.Channels.Max), ca.log)
+	ca.Tracker = NewChannelTracker(Channel_t(config.Channels.Min), Channel_t(config.Channels.Max),
+		config.Client.Max_Clients, time.Duration(reuseDelay)*time.Second)
 
 	ca.rng = messagedirector.Range{Min: Channel_t(config.Channels.Min), Max: Channel_t(config.Channels.Max)}
 	if ca.rng.Size() <= 0 {
@@ -95,52 +72,58 @@ func NewClientAgent(config core.Role) *ClientAgent {
 		return nil
 	}
 
+	if permission, ok := ParseInterestPermission(config.Client.Add_Interest); ok {
+		ca.interestPermitted = permission
+	} else {
+		ca.log.Fatalf("Failed to instantiate CA: unknown add_interest setting \"%s\"", config.Client.Add_Interest)
+		return nil
+	}
+
 	if ca.config.Tuning.Interest_Timeout == 0 {
 		ca.config.Tuning.Interest_Timeout = 5
 	}
 
 	ca.interestTimeout = config.Tuning.Interest_Timeout
 
-	// Init Lua state
-	ca.L = lua.NewState()
-
-	// Preload libaries
-	libs.Preload(ca.L)
-	// Replace gopher-lua-libs's crypto module with
-	// gluacrypto since it has more methods.
-	gluacrypto.Preload(ca.L)
-	// Used for web requests within Lua
-	ca.L.PreloadModule("http", gluahttp.NewHttpModule(&http.Client{}).Loader)
-
-	RegisterLuaUtilTypes(ca.L)
-	core.RegisterLuaDCTypes(ca.L)
-	RegisterClientType(ca.L)
-
-	// Set globals
-	ca.L.SetGlobal("SERVER_VERSION", lua.LString(ca.config.Version))
-	if ca.config.DC_Hash != 0 {
-		ca.L.SetGlobal("DC_HASH", lua.LNumber(ca.config.DC_Hash))
-	} else {
-		ca.L.SetGlobal("DC_HASH", lua.LNumber(core.DC.GetHash()))
-	}
-
-	ca.L.SetGlobal("dcFile", core.NewLuaDCFile(ca.L, core.DC))
-
-	ca.log.Infof("Running Lua script: %s", ca.config.Lua_File)
-	if err := ca.L.DoFile(ca.config.Lua_File); err != nil {
-		ca.log.Fatal(err.Error())
+	bans, err := NewBanList(config.Client.Ban_List)
+	if err != nil {
+		ca.log.Fatalf("Failed to load the ban list: %s", err)
 		return nil
 	}
-
-	// Santity check to make sure certian global functions exists:
-	if function, ok := ca.L.GetGlobal("receiveDatagram").(*lua.LFunction); ok {
-		ca.receiveDatagramFunc = function
-	} else {
-		ca.log.Fatal("Missing \"receiveDatagram\" function in Lua script.")
-		return nil
+	ca.bans = bans
+	core.AddBanList(bans)
+
+	workers := max(config.Lua_Workers, 1)
+	ca.log.Infof("Running Lua script on %d worker(s): %s", workers, ca.config.Lua_File)
+	for id := range workers {
+		worker, err := newLuaWorker(ca, id)
+		if err != nil {
+			ca.log.Fatal(err.Error())
+			return nil
+		}
+		ca.workers = append(ca.workers, worker)
 	}
+	core.OnReload(ca.Reload)
+	core.OnDrain(ca.Drain)
 
 	ca.Handler = ca
+	if config.TLS != nil {
+		tlsConfig, err := net.NewClientAgentTLSConfig(*config.TLS)
+		if err != nil {
+			ca.log.Fatalf("Unable to set up TLS: %s", err)
+			return nil
+		}
+		ca.TLSConfig = tlsConfig
+	}
+	ca.WebSocket = config.WebSocket
+	if config.WebSocket != nil {
+		proxies, err := net.ParseTrustedProxies(config.WebSocket.Trusted_Proxies)
+		if err != nil {
+			ca.log.Fatalf("Unable to set up WebSocket: %s", err)
+			return nil
+		}
+		ca.TrustedProxies = proxies
+	}
 	errChan := make(chan error)
 	go func() {
 		err := <-errChan
@@ -151,78 +134,101 @@ func NewClientAgent(config core.Role) *ClientAgent {
 			ca.log.Fatal(err.Error())
 		}
 	}()
-	go ca.queueLoop()
 	go ca.Start(config.Bind, errChan, config.Proxy)
 	return ca
 }
 
-func (c *ClientAgent) getEntryFromQueue() LuaQueueEntry {
-	c.Lock()
-	defer c.Unlock()
+// CallLuaFunction queues a call on the worker of the client, or on the first worker if there is no client.
+func (c *ClientAgent) CallLuaFunction(fn lua.LValue, client *Client, args ...lua.LValue) {
+	worker := c.workers[0]
+	if client != nil {
+		worker = client.worker
+	}
+	worker.call(LuaQueueEntry{fn: fn, client: client, args: args})
+}
 
-	op := c.LQueue[0]
-	c.LQueue[0] = LuaQueueEntry{}
-	c.LQueue = c.LQueue[1:]
-	if len(c.LQueue) == 0 {
-		// Recreate the queue slice. This prevents the capacity from growing indefinitely and allows old entries to drop off as soon as possible from the backing array.
-		c.LQueue = make([]LuaQueueEntry, 0)
+// Reload loads the Lua script again on every worker, for the calls made from then on.
+func (c *ClientAgent) Reload() {
+	c.log.Infof("Reloading Lua script: %s", c.config.Lua_File)
+	for _, worker := range c.workers {
+		worker.reload()
 	}
-	return op
 }
 
-func (c *ClientAgent) queueLoop() {
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, os.Interrupt)
-
-	for {
-		select {
-		case <-c.processQueue:
-			for len(c.LQueue) > 0 {
-				entry := c.getEntryFromQueue()
-				err := c.L.CallByParam(lua.P{
-					Fn:      entry.fn,
-					NRet:    0,
-					Protect: true,
-				}, entry.args...)
-				if err != nil {
-					var event eventlogger.LoggedEvent
-					if entry.client != nil {
-						entry.client.log.Errorf("Lua error:\n%s", err.Error())
-						event = eventlogger.NewLoggedEvent("lua-error", "Client", strconv.FormatUint(uint64(entry.client.allocatedChannel), 10), err.Error())
-						entry.client.sendDisconnect(CLIENT_DISCONNECT_GENERIC, "Lua error has occured.", true)
-					} else {
-						c.log.Errorf("Lua error:\n%s", err.Error())
-						event = eventlogger.NewLoggedEvent("lua-error", "ClientAgent", "", err.Error())
-					}
-					event.Send()
-				}
-			}
-		case <-signalCh:
-			return
-		case <-core.StopChan:
-			return
+// assignWorker picks the Lua worker for a new client.
+func (c *ClientAgent) assignWorker() *LuaWorker {
+	return c.workers[int(c.nextWorker.Add(1)-1)%len(c.workers)]
+}
+
+func (c *ClientAgent) HandleConnect(conn gonet.Conn) {
+	if c.drain.started.Load() {
+		conn.Close()
+		return
+	}
+
+	c.log.Debugf("Incoming connection from %s", conn.RemoteAddr())
+	if reason := c.admit(conn); reason != "" {
+		c.refuse(conn, reason, false)
+		return
+	}
+
+	channel, err := c.Allocate()
+	if err != nil {
+		if ip, ok := connectionIP(conn); ok {
+			c.connections.release(ip)
 		}
+		c.refuse(conn, err.Error(), true)
+		return
 	}
+	NewClient(c.config, c, conn, channel)
 }
 
-func (c *ClientAgent) CallLuaFunction(fn lua.LValue, client *Client, args ...lua.LValue) {
-	// Queue the call
-	c.Lock()
-	entry := LuaQueueEntry{fn, client, args}
-	c.LQueue = append(c.LQueue, entry)
-	c.Unlock()
+// refuse turns a connection away before a client is made for it. If tell is set, the client is
+// sent the reason with CLIENT_GO_GET_LOST before the connection is closed.
+func (c *ClientAgent) refuse(conn gonet.Conn, reason string, tell bool) {
+	refused := c.refused.Add(1)
+	c.log.Warnf("Refused connection from %s (%d refused so far): %s", conn.RemoteAddr(), refused, reason)
+	eventlogger.NewLoggedEvent("client-refused", "ClientAgent", conn.RemoteAddr().String(), reason).Send()
 
-	select {
-	case c.processQueue <- true:
-	default:
+	if !tell {
+		conn.Close()
+		return
 	}
+
+	transport := net.NewTransport(conn, 0, c.config.Client.Write_Buffer_Size)
+	dg := NewDatagram()
+	dg.AddUint16(CLIENT_GO_GET_LOST)
+	dg.AddUint16(CLIENT_DISCONNECT_SERVER_FULL)
+	dg.AddString("The server is full, please try again later.")
+	transport.WriteDatagram(dg)
+	go func() {
+		<-transport.Flush()
+		transport.Close()
+	}()
 }
 
-func (c *ClientAgent) HandleConnect(conn gonet.Conn) {
-	c.log.Debugf("Incoming connection from %s", conn.RemoteAddr())
-	NewClient(c.config, c, conn)
+// Refused returns how many connections the CA has turned away.
+func (c *ClientAgent) Refused() uint64 {
+	return c.refused.Load()
+}
+
+// admit checks a new connection against the ban list and the connection limits, returning an empty
+// string if it may go ahead or the reason it was refused.
+func (c *ClientAgent) admit(conn gonet.Conn) string {
+	ip, ok := connectionIP(conn)
+	if !ok {
+		return ""
+	}
+
+	if entry, banned := c.bans.Banned(ip); banned {
+		if entry.Reason != "" {
+			return fmt.Sprintf("banned by %s: %s", entry, entry.Reason)
+		}
+		return fmt.Sprintf("banned by %s", entry)
+	}
+	return c.connections.admit(ip)
 }
 
-func (c *ClientAgent) Allocate() Channel_t {
+func (c *ClientAgent) Allocate() (Channel_t, error) {
 	return c.Tracker.alloc()
 }
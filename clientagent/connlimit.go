@@ -0,0 +1,109 @@
+package clientagent
+
+import (
+	gonet "net"
+	"net/netip"
+	"otpgo/core"
+	"sync"
+	"time"
+)
+
+// connectionSweepInterval is how often addresses without connections are forgotten.
+const connectionSweepInterval = time.Minute
+
+// connectionIP returns the IP address a connection comes from, which is the one given by the
+// proxy if the PROXY protocol is used. Connections over unix sockets don't have one unless a proxy
+// gave it, and so are neither checked against the ban list nor counted against the connection
+// limits; whoever may open the socket is trusted not to need them.
+func connectionIP(conn gonet.Conn) (netip.Addr, bool) {
+	addr, ok := conn.RemoteAddr().(*gonet.TCPAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	ip, ok := netip.AddrFromSlice(addr.IP)
+	return ip.Unmap(), ok
+}
+
+type addressConnections struct {
+	open    int
+	arrival *tokenBucket
+}
+
+// connectionLimiter enforces the connection limits of each IP address; a limit of 0 is disabled.
+type connectionLimiter struct {
+	sync.Mutex
+
+	perIP int
+	rate  float64
+	burst float64
+
+	addresses map[netip.Addr]*addressConnections
+	lastSweep time.Time
+}
+
+func newConnectionLimiter(config core.ClientConnectionLimit) *connectionLimiter {
+	burst := config.Burst
+	if burst == 0 {
+		burst = defaultRateLimitBurst
+	}
+
+	return &connectionLimiter{
+		perIP:     config.Per_IP,
+		rate:      config.Rate,
+		burst:     max(config.Rate*burst, 1),
+		addresses: make(map[netip.Addr]*addressConnections),
+		lastSweep: time.Now(),
+	}
+}
+
+// admit counts a new connection from an address, returning an empty string if it is within the
+// limits or the reason it was refused. Admitted connections must be released once they close.
+func (l *connectionLimiter) admit(ip netip.Addr) string {
+	l.Lock()
+	defer l.Unlock()
+
+	now := time.Now()
+	if now.Sub(l.lastSweep) > connectionSweepInterval {
+		l.sweep(now)
+	}
+
+	conns, ok := l.addresses[ip]
+	if !ok {
+		conns = &addressConnections{}
+		if l.rate > 0 {
+			conns.arrival = newTokenBucket(l.rate, l.burst)
+		}
+		l.addresses[ip] = conns
+	}
+
+	if conns.arrival != nil && !conns.arrival.take(1, now) {
+		return "connection rate exceeded"
+	}
+	if l.perIP > 0 && conns.open >= l.perIP {
+		return "too many connections"
+	}
+	conns.open++
+	return ""
+}
+
+func (l *connectionLimiter) release(ip netip.Addr) {
+	l.Lock()
+	defer l.Unlock()
+
+	if conns, ok := l.addresses[ip]; ok && conns.open > 0 {
+		conns.open--
+	}
+}
+
+// sweep forgets addresses without connections whose connection rate has fully recovered.
+func (l *connectionLimiter) sweep(now time.Time) {
+	for ip, conns := range l.addresses {
+		if conns.open > 0 {
+			continue
+		}
+		if conns.arrival == nil || conns.arrival.tokens+now.Sub(conns.arrival.last).Seconds()*l.rate >= l.burst {
+			delete(l.addresses, ip)
+		}
+	}
+	l.lastSweep = now
+}
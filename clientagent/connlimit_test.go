@@ -0,0 +1,128 @@
+package clientagent
+
+import (
+	"github.com/apex/log"
+	"github.com/stretchr/testify/require"
+	gonet "net"
+	"net/netip"
+	"otpgo/core"
+	"testing"
+	"time"
+)
+
+// tcpConn is one end of a pipe which claims to come from a TCP address.
+type tcpConn struct {
+	gonet.Conn
+	remote gonet.Addr
+}
+
+func (c *tcpConn) RemoteAddr() gonet.Addr {
+	return c.remote
+}
+
+func newTCPConn(t *testing.T, ip string) gonet.Conn {
+	conn, other := gonet.Pipe()
+	t.Cleanup(func() {
+		conn.Close()
+		other.Close()
+	})
+	return &tcpConn{Conn: conn, remote: &gonet.TCPAddr{IP: gonet.ParseIP(ip), Port: 4000}}
+}
+
+func TestConnectionIP(t *testing.T) {
+	ip, ok := connectionIP(newTCPConn(t, "::ffff:192.0.2.7"))
+	require.True(t, ok)
+	require.Equal(t, netip.MustParseAddr("192.0.2.7"), ip)
+
+	// Connections on a unix socket have no address to limit
+	conn, other := gonet.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	_, ok = connectionIP(conn)
+	require.False(t, ok)
+}
+
+func TestConnectionLimiter_PerIP(t *testing.T) {
+	limiter := newConnectionLimiter(core.ClientConnectionLimit{Per_IP: 2})
+	ip, other := netip.MustParseAddr("192.0.2.7"), netip.MustParseAddr("192.0.2.8")
+
+	require.Empty(t, limiter.admit(ip))
+	require.Empty(t, limiter.admit(ip))
+	require.Equal(t, "too many connections", limiter.admit(ip))
+	require.Empty(t, limiter.admit(other))
+
+	// A connection closing frees its slot
+	limiter.release(ip)
+	require.Empty(t, limiter.admit(ip))
+	require.Equal(t, "too many connections", limiter.admit(ip))
+
+	// Releasing more than was admitted doesn't make room for more
+	for range 5 {
+		limiter.release(other)
+	}
+	require.Empty(t, limiter.admit(other))
+	require.Empty(t, limiter.admit(other))
+	require.Equal(t, "too many connections", limiter.admit(other))
+}
+
+func TestConnectionLimiter_Rate(t *testing.T) {
+	limiter := newConnectionLimiter(core.ClientConnectionLimit{Rate: 20, Burst: 0.1})
+	ip := netip.MustParseAddr("192.0.2.7")
+
+	require.Empty(t, limiter.admit(ip))
+	require.Empty(t, limiter.admit(ip))
+	require.Equal(t, "connection rate exceeded", limiter.admit(ip))
+	require.Empty(t, limiter.admit(netip.MustParseAddr("192.0.2.8")))
+
+	time.Sleep(100 * time.Millisecond)
+	require.Empty(t, limiter.admit(ip))
+}
+
+func TestConnectionLimiter_Sweep(t *testing.T) {
+	limiter := newConnectionLimiter(core.ClientConnectionLimit{Per_IP: 1, Rate: 1})
+	ip, other := netip.MustParseAddr("192.0.2.7"), netip.MustParseAddr("192.0.2.8")
+	require.Empty(t, limiter.admit(ip))
+	require.Empty(t, limiter.admit(other))
+	limiter.release(other)
+
+	// Addresses are only forgotten once they have no connections and their rate has recovered
+	now := time.Now()
+	limiter.sweep(now)
+	require.Len(t, limiter.addresses, 2)
+	limiter.sweep(now.Add(time.Minute))
+	require.Len(t, limiter.addresses, 1)
+	require.Contains(t, limiter.addresses, ip)
+}
+
+func TestClientAgent_Admit(t *testing.T) {
+	bans, err := NewBanList("")
+	require.NoError(t, err)
+	require.NoError(t, bans.Ban("192.0.2.0/24", "cheating"))
+
+	ca := &ClientAgent{
+		Tracker:     NewChannelTracker(1000, 1000, 0, time.Hour),
+		drain:       newDrainState(),
+		connections: newConnectionLimiter(core.ClientConnectionLimit{Per_IP: 1}),
+		bans:        bans,
+	}
+	ca.log = log.WithFields(log.Fields{"name": "Test CA", "modName": "ClientAgent"})
+
+	require.Equal(t, "banned by 192.0.2.0/24: cheating", ca.admit(newTCPConn(t, "192.0.2.7")))
+	require.Empty(t, ca.admit(newTCPConn(t, "198.51.100.7")))
+	require.Equal(t, "too many connections", ca.admit(newTCPConn(t, "198.51.100.7")))
+	ca.connections.release(netip.MustParseAddr("198.51.100.7"))
+
+	// The only channel is taken, so the connection is turned away and gives its slot back
+	_, err = ca.Allocate()
+	require.NoError(t, err)
+	ca.HandleConnect(newTCPConn(t, "198.51.100.7"))
+	require.Equal(t, uint64(1), ca.Refused())
+	require.Empty(t, ca.admit(newTCPConn(t, "198.51.100.7")))
+
+	// Connections without an address are neither banned nor limited
+	conn, other := gonet.Pipe()
+	defer conn.Close()
+	defer other.Close()
+	require.Empty(t, ca.admit(conn))
+	require.Empty(t, ca.admit(conn))
+}
@@ -0,0 +1,120 @@
+package clientagent
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultDrainMessage          = "The server is shutting down."
+	defaultDrainCountdownMessage = "The server will shut down in %d seconds."
+	defaultDrainTimeout          = 10
+)
+
+// drainAnnouncements are the times left at which a drain countdown is announced to clients,
+// besides when it starts.
+var drainAnnouncements = []time.Duration{5 * time.Minute, time.Minute, 30 * time.Second, 10 * time.Second, 5 * time.Second}
+
+// drainState tracks a drain of the CA; a drain only ever happens once.
+type drainState struct {
+	started atomic.Bool
+	// skip is closed to cut the countdown short.
+	skip     chan struct{}
+	skipOnce sync.Once
+	done     chan struct{}
+}
+
+func newDrainState() *drainState {
+	return &drainState{skip: make(chan struct{}), done: make(chan struct{})}
+}
+
+// Drain stops accepting clients, then disconnects every client with CLIENT_GO_GET_LOST once the
+// countdown has passed, announcing it beforehand through CLIENT_SYSTEM_MESSAGE. It returns once
+// the clients have been cleaned up or the drain has timed out. If the CA is already draining,
+// it waits for that drain instead, cutting its countdown short if countdown is 0.
+func (c *ClientAgent) Drain(countdown time.Duration) {
+	if !c.drain.started.CompareAndSwap(false, true) {
+		if countdown == 0 {
+			c.drain.skipOnce.Do(func() { close(c.drain.skip) })
+		}
+		<-c.drain.done
+		return
+	}
+	defer close(c.drain.done)
+
+	config := c.config.Client.Drain
+	if config.Message == "" {
+		config.Message = defaultDrainMessage
+	}
+	if config.Countdown_Message == "" {
+		config.Countdown_Message = defaultDrainCountdownMessage
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultDrainTimeout
+	}
+
+	c.Shutdown()
+	c.log.Infof("Draining clients in %s", countdown)
+	c.countdown(countdown, config.Countdown_Message)
+
+	clients := c.clients()
+	c.log.Infof("Disconnecting %d clients", len(clients))
+	for _, client := range clients {
+		go client.sendDisconnect(CLIENT_DISCONNECT_SHUTDOWN, config.Message, false)
+	}
+
+	deadline := time.Now().Add(time.Duration(config.Timeout) * time.Second)
+	for len(c.clients()) > 0 {
+		if time.Now().After(deadline) {
+			c.log.Warnf("Gave up waiting for %d clients to be cleaned up", len(c.clients()))
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	c.log.Info("Drained all clients")
+}
+
+// countdown announces the drain to every client until the countdown has passed or is cut short.
+func (c *ClientAgent) countdown(countdown time.Duration, message string) {
+	deadline := time.Now().Add(countdown)
+	for {
+		left := time.Until(deadline).Round(time.Second)
+		if left <= 0 {
+			return
+		}
+
+		announcement := fmt.Sprintf(message, int(left/time.Second))
+		for _, client := range c.clients() {
+			go client.sendSystemMessage(announcement)
+		}
+
+		var next time.Duration
+		for _, at := range drainAnnouncements {
+			if at < left {
+				next = at
+				break
+			}
+		}
+
+		select {
+		case <-time.After(time.Until(deadline.Add(-next))):
+		case <-c.drain.skip:
+			return
+		}
+	}
+}
+
+// clients returns every client of the CA.
+func (c *ClientAgent) clients() []*Client {
+	var clients []*Client
+	for _, worker := range c.workers {
+		worker.Lock()
+		for client := range worker.clients {
+			clients = append(clients, client)
+		}
+		worker.Unlock()
+	}
+	return clients
+}
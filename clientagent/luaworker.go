@@ -0,0 +1,271 @@
+package clientagent
+
+import (
+	"fmt"
+	"otpgo/core"
+	"otpgo/eventlogger"
+	. "otpgo/util"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"net/http"
+
+	gluahttp "github.com/cjoudrey/gluahttp"
+	gluacrypto "github.com/tengattack/gluacrypto"
+	libs "github.com/vadv/gopher-lua-libs"
+	lua "github.com/yuin/gopher-lua"
+)
+
+type LuaQueueEntry struct {
+	fn     lua.LValue
+	client *Client
+	args   []lua.LValue
+
+	// datagram is the datagram from the client the call handles, if any.
+	datagram *Datagram
+
+	// run is called instead of a Lua function if set.
+	run func()
+
+	// state is the Lua state current when the call was queued, which fn and args come from. Calls
+	// are made on it even if the script has been reloaded since.
+	state *luaState
+}
+
+// luaState is a Lua state with the CA script loaded into it.
+type luaState struct {
+	L                   *lua.LState
+	receiveDatagramFunc *lua.LFunction
+}
+
+// LuaWorker is a Lua state of the CA with its own copy of the Lua script. Every client is pinned
+// to one worker, so that its calls are made in order; state shared between workers has to go
+// through the shared global.
+type LuaWorker struct {
+	sync.Mutex
+
+	ca *ClientAgent
+	id int
+
+	// current is replaced when the script is reloaded.
+	current atomic.Pointer[luaState]
+	queue   []LuaQueueEntry
+	// processQueue wakes up the queue loop. It holds one wake-up, so that a call queued while the
+	// loop is between emptying the queue and waiting again isn't left behind.
+	processQueue chan bool
+
+	// clients are the clients pinned to this worker, whose userTable is carried over on reload.
+	clients map[*Client]bool
+}
+
+func newLuaWorker(ca *ClientAgent, id int) (*LuaWorker, error) {
+	w := &LuaWorker{
+		ca:           ca,
+		id:           id,
+		queue:        []LuaQueueEntry{},
+		processQueue: make(chan bool, 1),
+		clients:      make(map[*Client]bool),
+	}
+
+	state, err := w.load()
+	if err != nil {
+		return nil, err
+	}
+	w.current.Store(state)
+
+	go w.queueLoop()
+	return w, nil
+}
+
+// load runs the CA script in a new Lua state.
+func (w *LuaWorker) load() (*luaState, error) {
+	L := lua.NewState()
+
+	// Preload libaries
+	libs.Preload(L)
+	// Replace gopher-lua-libs's crypto module with
+	// gluacrypto since it has more methods.
+	gluacrypto.Preload(L)
+	// Used for web requests within Lua
+	L.PreloadModule("http", gluahttp.NewHttpModule(&http.Client{}).Loader)
+
+	RegisterLuaUtilTypes(L)
+	core.RegisterLuaDCTypes(L)
+	RegisterClientType(L)
+	RegisterSharedState(L, w.ca.shared)
+	RegisterBanList(L, w.ca.bans)
+
+	// Set globals
+	L.SetGlobal("SERVER_VERSION", lua.LString(w.ca.config.Version))
+	if w.ca.config.DC_Hash != 0 {
+		L.SetGlobal("DC_HASH", lua.LNumber(w.ca.config.DC_Hash))
+	} else {
+		L.SetGlobal("DC_HASH", lua.LNumber(core.DC.GetHash()))
+	}
+	L.SetGlobal("LUA_WORKER", lua.LNumber(w.id))
+
+	L.SetGlobal("dcFile", core.NewLuaDCFile(L, core.DC))
+
+	if err := L.DoFile(w.ca.config.Lua_File); err != nil {
+		L.Close()
+		return nil, err
+	}
+
+	// Santity check to make sure certian global functions exists:
+	function, ok := L.GetGlobal("receiveDatagram").(*lua.LFunction)
+	if !ok {
+		L.Close()
+		return nil, fmt.Errorf("missing \"receiveDatagram\" function in Lua script")
+	}
+	return &luaState{L: L, receiveDatagramFunc: function}, nil
+}
+
+// L returns the current Lua state of the worker.
+func (w *LuaWorker) L() *lua.LState {
+	return w.current.Load().L
+}
+
+func (w *LuaWorker) receiveDatagramFunc() *lua.LFunction {
+	return w.current.Load().receiveDatagramFunc
+}
+
+func (w *LuaWorker) addClient(c *Client) {
+	w.Lock()
+	defer w.Unlock()
+	w.clients[c] = true
+}
+
+func (w *LuaWorker) removeClient(c *Client) {
+	w.Lock()
+	defer w.Unlock()
+	delete(w.clients, c)
+}
+
+// reload loads the script into a new Lua state, which is used for every call queued once it is in
+// place. The userTable of each client is copied into the new state; if anything fails, the worker
+// keeps its current state.
+func (w *LuaWorker) reload() {
+	w.call(LuaQueueEntry{run: func() {
+		if err := w.swapState(); err != nil {
+			w.ca.log.Errorf("Failed to reload Lua script on worker %d, keeping the old one: %s", w.id, err)
+			eventlogger.NewLoggedEvent("lua-reload-failed", "ClientAgent", strconv.Itoa(w.id), err.Error()).Send()
+			return
+		}
+		w.ca.log.Infof("Reloaded Lua script on worker %d", w.id)
+	}})
+}
+
+// swapState must only be called from the queue loop, as nothing else may use the Lua state then.
+func (w *LuaWorker) swapState() error {
+	state, err := w.load()
+	if err != nil {
+		return err
+	}
+
+	w.Lock()
+	clients := make([]*Client, 0, len(w.clients))
+	for c := range w.clients {
+		clients = append(clients, c)
+	}
+	w.Unlock()
+
+	userTables := make(map[*Client]*lua.LTable, len(clients))
+	for _, c := range clients {
+		if c.userTable == nil {
+			continue
+		}
+		value, err := fromLuaValue(c.userTable, 0)
+		if err != nil {
+			state.L.Close()
+			return fmt.Errorf("unable to carry over the userTable of client %d: %s", c.allocatedChannel, err)
+		}
+		userTables[c] = toLuaValue(state.L, value).(*lua.LTable)
+	}
+
+	for c, table := range userTables {
+		c.userTable = table
+	}
+	// The old state isn't closed, as calls queued before the reload are still made on it.
+	w.current.Store(state)
+	return nil
+}
+
+func (w *LuaWorker) getEntryFromQueue() LuaQueueEntry {
+	w.Lock()
+	defer w.Unlock()
+
+	op := w.queue[0]
+	w.queue[0] = LuaQueueEntry{}
+	w.queue = w.queue[1:]
+	if len(w.queue) == 0 {
+		// Recreate the queue slice. This prevents the capacity from growing indefinitely and allows old entries to drop off as soon as possible from the backing array.
+		w.queue = make([]LuaQueueEntry, 0)
+	}
+	return op
+}
+
+func (w *LuaWorker) queueLength() int {
+	w.Lock()
+	defer w.Unlock()
+	return len(w.queue)
+}
+
+// queueLoop carries on after an interrupt, as clients are still disconnected while draining.
+func (w *LuaWorker) queueLoop() {
+	for {
+		select {
+		case <-w.processQueue:
+			for w.queueLength() > 0 {
+				entry := w.getEntryFromQueue()
+				if entry.run != nil {
+					entry.run()
+					continue
+				}
+
+				if entry.datagram != nil {
+					entry.client.handling.Store(entry.datagram)
+				}
+				err := entry.state.L.CallByParam(lua.P{
+					Fn:      entry.fn,
+					NRet:    0,
+					Protect: true,
+				}, entry.args...)
+				if entry.datagram != nil {
+					entry.client.handling.Store(nil)
+				}
+				if err != nil {
+					var event eventlogger.LoggedEvent
+					if entry.client != nil {
+						entry.client.log.Errorf("Lua error:\n%s", err.Error())
+						event = eventlogger.NewLoggedEvent("lua-error", "Client", strconv.FormatUint(uint64(entry.client.allocatedChannel), 10), err.Error())
+						// A broken script isn't the client's doing, so this doesn't count as a violation.
+						entry.client.sendDisconnect(CLIENT_DISCONNECT_GENERIC, "Lua error has occured.", false)
+					} else {
+						w.ca.log.Errorf("Lua error on worker %d:\n%s", w.id, err.Error())
+						event = eventlogger.NewLoggedEvent("lua-error", "ClientAgent", "", err.Error())
+					}
+					event.Send()
+				}
+			}
+		case <-core.StopChan:
+			return
+		}
+	}
+}
+
+// call queues a call to be made on the worker's Lua state.
+func (w *LuaWorker) call(entry LuaQueueEntry) {
+	if entry.state == nil {
+		entry.state = w.current.Load()
+	}
+
+	w.Lock()
+	w.queue = append(w.queue, entry)
+	w.Unlock()
+
+	select {
+	case w.processQueue <- true:
+	default:
+	}
+}
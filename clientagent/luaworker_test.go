@@ -0,0 +1,140 @@
+package clientagent
+
+import (
+	"github.com/stretchr/testify/require"
+	. "otpgo/util"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestLuaWorker_Assign(t *testing.T) {
+	ca := &ClientAgent{}
+	newTestWorkers(ca, 3)
+
+	// Clients are spread over the workers in turn
+	for n := 0; n < 9; n++ {
+		require.Same(t, ca.workers[n%3], ca.assignWorker())
+	}
+
+	w := ca.workers[0]
+	c := &Client{worker: w}
+	w.addClient(c)
+	require.True(t, w.clients[c])
+	w.removeClient(c)
+	require.Empty(t, w.clients)
+}
+
+func TestLuaWorker_Order(t *testing.T) {
+	ca := &ClientAgent{}
+	newTestWorkers(ca, 2)
+
+	// Calls on a worker are made one at a time, in the order they were queued
+	var order []int
+	done := make(chan bool)
+	for n := 0; n < 100; n++ {
+		ca.workers[0].call(LuaQueueEntry{run: func() { order = append(order, n) }})
+	}
+	ca.workers[0].call(LuaQueueEntry{run: func() { done <- true }})
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Queued calls were not made")
+	}
+	require.Len(t, order, 100)
+	for n, called := range order {
+		require.Equal(t, n, called)
+	}
+}
+
+func TestLuaWorker_Independent(t *testing.T) {
+	ca := &ClientAgent{}
+	newTestWorkers(ca, 2)
+
+	// A worker busy with a call doesn't hold up the clients pinned to the others
+	release := make(chan bool)
+	blocked, other := make(chan bool), make(chan bool)
+	ca.workers[0].call(LuaQueueEntry{run: func() { <-release }})
+	ca.workers[0].call(LuaQueueEntry{run: func() { blocked <- true }})
+	ca.workers[1].call(LuaQueueEntry{run: func() { other <- true }})
+
+	select {
+	case <-other:
+	case <-time.After(time.Second):
+		t.Fatal("Call on an idle worker was held up by another worker")
+	}
+	select {
+	case <-blocked:
+		t.Fatal("Call was made before the one queued ahead of it finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-blocked:
+	case <-time.After(time.Second):
+		t.Fatal("Queued call was not made")
+	}
+}
+
+func TestLuaWorker_ReloadedState(t *testing.T) {
+	ca := &ClientAgent{}
+	newTestWorkers(ca, 1)
+	w := ca.workers[0]
+
+	old := lua.NewState()
+	defer old.Close()
+	require.NoError(t, old.DoString(`function mark() marked = true end`))
+	w.current.Store(&luaState{L: old})
+
+	// A call queued before a reload is made on the state its function came from
+	release, done := make(chan bool), make(chan bool)
+	w.call(LuaQueueEntry{run: func() { <-release }})
+	w.call(LuaQueueEntry{fn: old.GetGlobal("mark")})
+
+	reloaded := lua.NewState()
+	defer reloaded.Close()
+	w.current.Store(&luaState{L: reloaded})
+	w.call(LuaQueueEntry{run: func() { done <- true }})
+	close(release)
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Queued calls were not made")
+	}
+	require.Equal(t, lua.LTrue, old.GetGlobal("marked"))
+	require.Equal(t, lua.LNil, reloaded.GetGlobal("marked"))
+}
+
+func TestLuaWorker_Handling(t *testing.T) {
+	ca := &ClientAgent{}
+	newTestWorkers(ca, 1)
+	w := ca.workers[0]
+	L := lua.NewState()
+	defer L.Close()
+	w.current.Store(&luaState{L: L})
+
+	// The datagram a client's handler is called for is only kept while the handler runs
+	c := newHeldClient(1000)
+	dg := NewDatagram()
+	dg.AddUint16(CLIENT_HEARTBEAT)
+	var during *Datagram
+	w.call(LuaQueueEntry{
+		fn:       L.NewFunction(func(*lua.LState) int { during = c.handling.Load(); return 0 }),
+		client:   c,
+		datagram: &dg,
+	})
+
+	after := make(chan *Datagram)
+	w.call(LuaQueueEntry{run: func() { after <- c.handling.Load() }})
+	select {
+	case handling := <-after:
+		require.Same(t, &dg, during)
+		require.Nil(t, handling)
+	case <-time.After(time.Second):
+		t.Fatal("Queued calls were not made")
+	}
+}
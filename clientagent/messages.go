@@ -106,4 +106,8 @@ const (
 	CLIENT_DISCONNECT_BAD_VERSION            = 125
 	CLIENT_DISCONNECT_FIELD_CONSTRAINT       = 127
 	CLIENT_DISCONNECT_SESSION_OBJECT_DELETED = 153
+	CLIENT_DISCONNECT_SHUTDOWN               = 154
+	CLIENT_DISCONNECT_SERVER_FULL            = 155
+	// Not part of the original protocol; sent to clients which exceed their rate limits.
+	CLIENT_DISCONNECT_RATE_LIMITED = 160
 )
@@ -0,0 +1,112 @@
+package clientagent
+
+import (
+	"math"
+	"otpgo/core"
+	"sync"
+	"time"
+)
+
+const defaultRateLimitBurst = 2
+
+// tokenBucket allows rate events per second on average, and up to burst events at once.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+}
+
+func (b *tokenBucket) take(n float64, now time.Time) bool {
+	b.refill(now)
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// rateLimiter enforces the rate limits of a client. A limit of 0 is disabled; each limit may be
+// exceeded for up to Burst seconds worth of its rate. Buckets always hold at least one datagram, or
+// the largest datagram a client may send, so that a small burst can't turn a limit into a ban.
+type rateLimiter struct {
+	sync.Mutex
+
+	datagrams    *tokenBucket
+	bytes        *tokenBucket
+	fieldUpdates map[uint16]*tokenBucket
+
+	fieldRate  float64
+	fieldBurst float64
+}
+
+func newRateLimiter(config core.ClientRateLimit, maxDatagramSize int) *rateLimiter {
+	burst := config.Burst
+	if burst == 0 {
+		burst = defaultRateLimitBurst
+	}
+	if maxDatagramSize <= 0 {
+		maxDatagramSize = math.MaxUint16
+	}
+
+	r := &rateLimiter{
+		fieldUpdates: make(map[uint16]*tokenBucket),
+		fieldRate:    config.Field_Updates,
+		fieldBurst:   max(config.Field_Updates*burst, 1),
+	}
+	if config.Datagrams > 0 {
+		r.datagrams = newTokenBucket(config.Datagrams, max(config.Datagrams*burst, 1))
+	}
+	if config.Bytes > 0 {
+		r.bytes = newTokenBucket(config.Bytes, max(config.Bytes*burst, float64(maxDatagramSize)))
+	}
+	return r
+}
+
+// allowDatagram returns an empty string if a datagram of the given size is within the limits,
+// or the name of the limit it exceeds.
+func (r *rateLimiter) allowDatagram(size int) string {
+	r.Lock()
+	defer r.Unlock()
+
+	// Nothing is taken from either bucket unless the datagram is within both limits.
+	now := time.Now()
+	if r.datagrams != nil {
+		if r.datagrams.refill(now); r.datagrams.tokens < 1 {
+			return "datagrams"
+		}
+	}
+	if r.bytes != nil && !r.bytes.take(float64(size), now) {
+		return "bytes"
+	}
+	if r.datagrams != nil {
+		r.datagrams.tokens--
+	}
+	return ""
+}
+
+// allowFieldUpdate returns whether the client may send another update to a DC field.
+func (r *rateLimiter) allowFieldUpdate(field uint16) bool {
+	if r.fieldRate <= 0 {
+		return true
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	bucket, ok := r.fieldUpdates[field]
+	if !ok {
+		bucket = newTokenBucket(r.fieldRate, r.fieldBurst)
+		r.fieldUpdates[field] = bucket
+	}
+	return bucket.take(1, time.Now())
+}
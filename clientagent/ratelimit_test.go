@@ -0,0 +1,96 @@
+package clientagent
+
+import (
+	"github.com/stretchr/testify/require"
+	"math"
+	"otpgo/core"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(10, 20)
+	now := bucket.last
+
+	// The whole burst may be used up at once
+	require.True(t, bucket.take(15, now))
+	require.True(t, bucket.take(5, now))
+	require.False(t, bucket.take(1, now))
+
+	// Tokens come back at the rate, but never beyond the burst
+	now = now.Add(250 * time.Millisecond)
+	require.True(t, bucket.take(2, now))
+	require.False(t, bucket.take(1, now))
+
+	now = now.Add(time.Minute)
+	require.True(t, bucket.take(20, now))
+	require.False(t, bucket.take(1, now))
+
+	// A refused take costs nothing
+	now = now.Add(time.Second)
+	require.False(t, bucket.take(11, now))
+	require.True(t, bucket.take(10, now))
+}
+
+func TestRateLimiter_Datagrams(t *testing.T) {
+	limiter := newRateLimiter(core.ClientRateLimit{Datagrams: 5, Burst: 2}, 0)
+	for n := 0; n < 10; n++ {
+		require.Empty(t, limiter.allowDatagram(100))
+	}
+	require.Equal(t, "datagrams", limiter.allowDatagram(100))
+
+	// Disabled limits don't apply
+	limiter = newRateLimiter(core.ClientRateLimit{}, 0)
+	for n := 0; n < 1000; n++ {
+		require.Empty(t, limiter.allowDatagram(math.MaxUint16))
+		require.True(t, limiter.allowFieldUpdate(1))
+	}
+}
+
+func TestRateLimiter_Bytes(t *testing.T) {
+	limiter := newRateLimiter(core.ClientRateLimit{Datagrams: 1, Bytes: 100, Burst: 10}, 500)
+	require.Empty(t, limiter.allowDatagram(600))
+	require.Equal(t, "bytes", limiter.allowDatagram(600))
+
+	// A datagram over the byte limit doesn't use up the datagram limit
+	for n := 0; n < 200; n++ {
+		require.Equal(t, "bytes", limiter.allowDatagram(600))
+	}
+	require.InDelta(t, 9, limiter.datagrams.tokens, 0.5)
+	require.Empty(t, limiter.allowDatagram(400))
+}
+
+func TestRateLimiter_SmallBurst(t *testing.T) {
+	// However small the burst, a client may still send one datagram of the largest size
+	limiter := newRateLimiter(core.ClientRateLimit{Datagrams: 1, Bytes: 100, Field_Updates: 1, Burst: 0.1}, 1000)
+	require.Empty(t, limiter.allowDatagram(1000))
+	require.Equal(t, "datagrams", limiter.allowDatagram(1))
+	require.True(t, limiter.allowFieldUpdate(1))
+	require.False(t, limiter.allowFieldUpdate(1))
+
+	// Without a maximum, the largest datagram is the largest a length prefix allows
+	limiter = newRateLimiter(core.ClientRateLimit{Bytes: 100}, 0)
+	require.Empty(t, limiter.allowDatagram(math.MaxUint16))
+}
+
+func TestRateLimiter_FieldUpdates(t *testing.T) {
+	limiter := newRateLimiter(core.ClientRateLimit{Field_Updates: 2}, 0)
+
+	// Every field has a bucket of its own
+	for n := 0; n < 4; n++ {
+		require.True(t, limiter.allowFieldUpdate(1))
+	}
+	require.False(t, limiter.allowFieldUpdate(1))
+	for n := 0; n < 4; n++ {
+		require.True(t, limiter.allowFieldUpdate(2))
+	}
+	require.False(t, limiter.allowFieldUpdate(2))
+	require.Len(t, limiter.fieldUpdates, 2)
+
+	// They refill on their own as well
+	limiter.fieldUpdates[1].last = limiter.fieldUpdates[1].last.Add(-time.Second)
+	require.True(t, limiter.allowFieldUpdate(1))
+	require.True(t, limiter.allowFieldUpdate(1))
+	require.False(t, limiter.allowFieldUpdate(1))
+	require.False(t, limiter.allowFieldUpdate(2))
+}
@@ -0,0 +1,287 @@
+package clientagent
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"otpgo/eventlogger"
+	. "otpgo/util"
+	"strconv"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+const defaultResumeBuffer = 1024
+
+// clientConnection is the handler of a client's connection. Once a session is resumed on a new
+// connection, the connection it was suspended from no longer affects it.
+type clientConnection struct {
+	sync.Mutex
+	client *Client
+}
+
+func (h *clientConnection) owner() *Client {
+	h.Lock()
+	defer h.Unlock()
+	return h.client
+}
+
+func (h *clientConnection) ReceiveDatagram(dg Datagram) {
+	h.Lock()
+	defer h.Unlock()
+	h.client.ReceiveDatagram(dg)
+}
+
+func (h *clientConnection) HandleDatagram(dg Datagram, dgi *DatagramIterator) {
+	h.owner().HandleDatagram(dg, dgi)
+}
+
+func (h *clientConnection) Terminate(err error) {
+	h.owner().connectionLost(h, err)
+}
+
+func (h *clientConnection) MaxDatagramSize() int {
+	return h.owner().MaxDatagramSize()
+}
+
+func (h *clientConnection) OversizedDatagram(size int, header []byte) {
+	h.owner().OversizedDatagram(size, header)
+}
+
+// moveTo hands the connection over to another client, along with the datagrams it has received
+// which haven't been handled yet.
+func (h *clientConnection) moveTo(c *Client) {
+	h.Lock()
+	defer h.Unlock()
+
+	from := h.client
+	from.queueLock.Lock()
+	left := from.queue
+	from.queue = nil
+	from.queueLock.Unlock()
+
+	c.queueLock.Lock()
+	c.queue = append(left, c.queue...)
+	c.queueLock.Unlock()
+	h.client = c
+
+	select {
+	case c.shouldProcess <- true:
+	default:
+	}
+}
+
+// resumeSessions holds the sessions which may be resumed, by their resume token.
+type resumeSessions struct {
+	sync.Mutex
+	clients map[string]*Client
+}
+
+func newResumeSessions() *resumeSessions {
+	return &resumeSessions{clients: make(map[string]*Client)}
+}
+
+func (s *resumeSessions) add(token string, c *Client) {
+	s.Lock()
+	defer s.Unlock()
+	s.clients[token] = c
+}
+
+// claim takes a session off the list, so that only one caller may resume or expire it. If c is
+// given, the session is only claimed if it is that client's.
+func (s *resumeSessions) claim(token string, c *Client) *Client {
+	s.Lock()
+	defer s.Unlock()
+
+	found, ok := s.clients[token]
+	if !ok || (c != nil && found != c) {
+		return nil
+	}
+	delete(s.clients, token)
+	return found
+}
+
+// issueResumeToken returns the token the client may resume its session with, issuing it first if
+// needed. The token stays the same for the whole session.
+func (c *Client) issueResumeToken() (string, error) {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+
+	if c.resumeToken != "" {
+		return c.resumeToken, nil
+	}
+
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	c.resumeToken = hex.EncodeToString(token)
+	c.ca.sessions.add(c.resumeToken, c)
+	return c.resumeToken, nil
+}
+
+// connectionLost is called once a connection of the client is lost. A session with a resume token
+// is suspended for the resume window instead of being ended.
+func (c *Client) connectionLost(conn *clientConnection, err error) {
+	c.connLock.Lock()
+	if conn != c.connection {
+		// The session has been resumed on another connection since.
+		c.connLock.Unlock()
+		return
+	}
+	if c.suspended {
+		c.connLock.Unlock()
+		return
+	}
+
+	window := time.Duration(c.config.Client.Resume.Window) * time.Second
+	if window == 0 || c.resumeToken == "" || c.cleanDisconnect || err == nil ||
+		c.ca.drain.started.Load() || c.terminationBegun.Load() {
+		c.connLock.Unlock()
+		c.Terminate(err)
+		return
+	}
+
+	c.suspended = true
+	if c.config.Client.Heartbeat_Timeout != 0 {
+		c.heartbeat.Stop()
+	}
+	c.resumeTimer = time.AfterFunc(window, func() { c.expire("resume window expired") })
+	c.connLock.Unlock()
+
+	c.log.Infof("Lost connection, holding the session for %s: %s", window, err)
+	eventlogger.NewLoggedEvent("client-suspended", "Client", strconv.FormatUint(uint64(c.allocatedChannel), 10),
+		fmt.Sprintf("%s|%s", c.RemoteAddr(), err.Error()),
+	).Send()
+}
+
+// expire ends a suspended session which hasn't been resumed.
+func (c *Client) expire(reason string) {
+	if c.ca.sessions.claim(c.resumeToken, c) == nil {
+		// The session is being resumed, or has already ended.
+		return
+	}
+	c.Terminate(errors.New(reason))
+}
+
+// resume hands the connection of a new client over to the session with the given token, replaying
+// whatever was held back for it, and gets rid of the new client. If the session still has a
+// connection, that one is dropped in favour of the new one.
+func (c *Client) resume(token string) bool {
+	session := c.ca.sessions.claim(token, nil)
+	if session == nil {
+		return false
+	}
+	if session == c {
+		c.ca.sessions.add(token, c)
+		return false
+	}
+
+	session.Lock()
+	session.connLock.Lock()
+	if session.terminationBegun.Load() {
+		session.connLock.Unlock()
+		session.Unlock()
+		return false
+	}
+	if session.resumeTimer != nil {
+		session.resumeTimer.Stop()
+	}
+	previousConn := session.conn
+	if !session.suspended {
+		session.client.Close(true)
+	}
+
+	c.connLock.Lock()
+	session.connection, session.client, session.conn = c.connection, c.client, c.conn
+	c.connLock.Unlock()
+
+	held := session.held
+	session.held, session.suspended = nil, false
+	for _, dg := range held {
+		session.captureDatagram(captureOutbound, dg)
+		session.client.SendDatagram(dg)
+	}
+	if session.config.Client.Heartbeat_Timeout != 0 {
+		session.heartbeat.Reset(time.Duration(session.config.Client.Heartbeat_Timeout) * time.Second)
+	}
+	session.connection.moveTo(session)
+	session.connLock.Unlock()
+	session.Unlock()
+	c.ca.sessions.add(token, session)
+
+	if ip, ok := connectionIP(previousConn); ok {
+		c.ca.connections.release(ip)
+	}
+	c.retire()
+
+	session.log.Infof("Resumed session from %s, replaying %d datagrams", session.RemoteAddr(), len(held))
+	eventlogger.NewLoggedEvent("client-resumed", "Client", strconv.FormatUint(uint64(session.allocatedChannel), 10),
+		fmt.Sprintf("%s|%d", session.RemoteAddr(), len(held)),
+	).Send()
+
+	if fn, ok := session.worker.L().GetGlobal("handleClientResumed").(*lua.LFunction); ok {
+		session.ca.CallLuaFunction(fn, session, NewLuaClient(session.worker.L(), session))
+	}
+	return true
+}
+
+// retire gets rid of a client whose connection has been handed over to a resumed session, without
+// closing the connection.
+func (c *Client) retire() {
+	if !c.terminationBegun.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		c.stopChan <- true
+		if c.config.Client.Heartbeat_Timeout != 0 {
+			c.heartbeat.Stop()
+			c.stopHeartbeat <- true
+		}
+	}()
+	go func() {
+		c.Lock()
+		defer c.Unlock()
+		defer c.worker.removeClient(c)
+
+		c.ca.Tracker.free(c.allocatedChannel)
+		if capture := c.capture.Load(); capture != nil {
+			c.stopCapture(capture, "stopped as the session was resumed")
+		}
+		c.Cleanup()
+	}()
+}
+
+// send writes a datagram to the client, or holds it back while the session is suspended. A session
+// which has more held back than its buffer allows is ended.
+func (c *Client) send(dg Datagram) {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+
+	if !c.suspended {
+		c.captureDatagram(captureOutbound, dg)
+		c.client.SendDatagram(dg)
+		return
+	}
+
+	limit := c.config.Client.Resume.Buffer
+	if limit == 0 {
+		limit = defaultResumeBuffer
+	}
+	if len(c.held) >= limit {
+		go c.expire("resume buffer full")
+		return
+	}
+	c.held = append(c.held, dg)
+}
+
+// isSuspended returns whether the session is waiting to be resumed.
+func (c *Client) isSuspended() bool {
+	c.connLock.Lock()
+	defer c.connLock.Unlock()
+	return c.suspended
+}
@@ -0,0 +1,181 @@
+package clientagent
+
+import (
+	"encoding/binary"
+	"github.com/apex/log"
+	"github.com/stretchr/testify/require"
+	"io"
+	gonet "net"
+	"os"
+	"otpgo/core"
+	"otpgo/messagedirector"
+	. "otpgo/util"
+	"testing"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestMain(m *testing.M) {
+	// Clients are MD participants, so the tests making them need an MD to join.
+	core.Config = &core.ServerConfig{}
+	core.Config.MessageDirector.Bind = "127.0.0.1:57141"
+	messagedirector.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	os.Exit(m.Run())
+}
+
+// newResumeCA makes a CA whose clients may resume their sessions, with a worker that has an empty
+// script.
+func newResumeCA(t *testing.T, resume core.ClientResume) *ClientAgent {
+	config := core.Role{}
+	config.Client.Resume = resume
+	ca := &ClientAgent{
+		config:      config,
+		log:         log.WithFields(log.Fields{"name": "Test CA", "modName": "ClientAgent"}),
+		Tracker:     NewChannelTracker(1000, 1999, 0, 0),
+		drain:       newDrainState(),
+		connections: newConnectionLimiter(config.Client.Connection_Limit),
+		sessions:    newResumeSessions(),
+		violations:  newViolationTracker(config.Client.Security),
+	}
+	newTestWorkers(ca, 1)
+
+	L := lua.NewState()
+	t.Cleanup(L.Close)
+	ca.workers[0].current.Store(&luaState{L: L})
+	return ca
+}
+
+// connectClient makes a client on a new connection, returning it along with the other end.
+func connectClient(t *testing.T, ca *ClientAgent) (*Client, gonet.Conn) {
+	ln, err := gonet.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	peer, err := gonet.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { peer.Close() })
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+
+	channel, err := ca.Allocate()
+	require.NoError(t, err)
+	return NewClient(ca.config, ca, conn, channel), peer
+}
+
+// expectSystemMessage reads the next datagram sent to a client and checks it is a system message.
+func expectSystemMessage(t *testing.T, peer gonet.Conn, message string) {
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	var size [2]byte
+	_, err := io.ReadFull(peer, size[:])
+	require.NoError(t, err)
+	data := make([]byte, binary.LittleEndian.Uint16(size[:]))
+	_, err = io.ReadFull(peer, data)
+	require.NoError(t, err)
+
+	dg := NewDatagram()
+	dg.Write(data)
+	dgi := NewDatagramIterator(&dg)
+	require.Equal(t, uint16(CLIENT_SYSTEM_MESSAGE), dgi.ReadUint16())
+	require.Equal(t, message, dgi.ReadString())
+}
+
+// suspendClient makes a client with a resume token and drops its connection.
+func suspendClient(t *testing.T, ca *ClientAgent) (*Client, string) {
+	c, peer := connectClient(t, ca)
+	token, err := c.issueResumeToken()
+	require.NoError(t, err)
+
+	peer.Close()
+	require.Eventually(t, c.isSuspended, time.Second, 10*time.Millisecond)
+	return c, token
+}
+
+func TestClient_Suspend(t *testing.T) {
+	ca := newResumeCA(t, core.ClientResume{Window: 60})
+	c, token := suspendClient(t, ca)
+
+	// The token stays the same for the whole session
+	again, err := c.issueResumeToken()
+	require.NoError(t, err)
+	require.Equal(t, token, again)
+
+	// What is sent meanwhile is held back for the session
+	c.sendSystemMessage("held")
+	require.Len(t, c.held, 1)
+	require.False(t, c.terminationBegun.Load())
+
+	// Clients without a token end their session with their connection
+	other, peer := connectClient(t, ca)
+	peer.Close()
+	require.Eventually(t, other.terminationBegun.Load, time.Second, 10*time.Millisecond)
+	require.False(t, other.isSuspended())
+}
+
+func TestClient_Resume(t *testing.T) {
+	ca := newResumeCA(t, core.ClientResume{Window: 60})
+	c, token := suspendClient(t, ca)
+	c.sendSystemMessage("first")
+	c.sendSystemMessage("second")
+
+	// Unknown tokens resume nothing
+	resumed, peer := connectClient(t, ca)
+	require.False(t, resumed.resume("unknown"))
+
+	// The session takes over the new connection, and is sent what was held back for it first
+	require.True(t, resumed.resume(token))
+	expectSystemMessage(t, peer, "first")
+	expectSystemMessage(t, peer, "second")
+	require.False(t, c.isSuspended())
+	require.Empty(t, c.held)
+
+	c.sendSystemMessage("third")
+	expectSystemMessage(t, peer, "third")
+
+	// The client made for the connection is got rid of, and the session may be resumed again
+	require.True(t, resumed.terminationBegun.Load())
+	require.False(t, c.terminationBegun.Load())
+	require.Same(t, c, ca.sessions.claim(token, nil))
+}
+
+func TestClient_ResumeBufferFull(t *testing.T) {
+	ca := newResumeCA(t, core.ClientResume{Window: 60, Buffer: 2})
+	c, token := suspendClient(t, ca)
+
+	// A session held back more than its buffer allows ends, and can't be resumed
+	c.sendSystemMessage("first")
+	c.sendSystemMessage("second")
+	require.False(t, c.terminationBegun.Load())
+	c.sendSystemMessage("third")
+	require.Len(t, c.held, 2)
+	require.Eventually(t, c.terminationBegun.Load, time.Second, 10*time.Millisecond)
+
+	resumed, _ := connectClient(t, ca)
+	require.False(t, resumed.resume(token))
+	require.False(t, resumed.terminationBegun.Load())
+}
+
+func TestClient_ResumeWhileConnected(t *testing.T) {
+	ca := newResumeCA(t, core.ClientResume{Window: 60})
+	c, previous := connectClient(t, ca)
+	token, err := c.issueResumeToken()
+	require.NoError(t, err)
+
+	// The session is moved to the new connection, and the one it was on is closed
+	resumed, peer := connectClient(t, ca)
+	require.True(t, resumed.resume(token))
+
+	previous.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = previous.Read(make([]byte, 1))
+	require.ErrorIs(t, err, io.EOF)
+
+	c.sendSystemMessage("moved")
+	expectSystemMessage(t, peer, "moved")
+
+	// Losing the connection it was on doesn't affect the session
+	time.Sleep(50 * time.Millisecond)
+	require.False(t, c.terminationBegun.Load())
+	require.False(t, c.isSuspended())
+}
@@ -0,0 +1,143 @@
+package clientagent
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"otpgo/core"
+	"otpgo/eventlogger"
+	. "otpgo/util"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// maxSecurityDump is how many bytes of the offending datagram a security event carries.
+	maxSecurityDump = 256
+
+	defaultViolationWindow      = 60
+	defaultViolationBanDuration = 600
+)
+
+type addressViolations struct {
+	count int
+	since time.Time
+}
+
+// violationTracker counts the security violations of each IP address, and tells when an address
+// has had enough of them to be banned.
+type violationTracker struct {
+	sync.Mutex
+
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+
+	addresses map[netip.Addr]*addressViolations
+	lastSweep time.Time
+}
+
+func newViolationTracker(config core.ClientSecurity) *violationTracker {
+	window, duration := config.Ban_Window, config.Ban_Duration
+	if window == 0 {
+		window = defaultViolationWindow
+	}
+	if duration == 0 {
+		duration = defaultViolationBanDuration
+	}
+
+	return &violationTracker{
+		threshold: config.Ban_Threshold,
+		window:    time.Duration(window) * time.Second,
+		duration:  time.Duration(duration) * time.Second,
+		addresses: make(map[netip.Addr]*addressViolations),
+		lastSweep: time.Now(),
+	}
+}
+
+// record counts a violation, returning whether the address has reached the threshold within the
+// window. Its count starts over once it has.
+func (t *violationTracker) record(ip netip.Addr) bool {
+	if t.threshold == 0 {
+		return false
+	}
+
+	t.Lock()
+	defer t.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.lastSweep) > t.window {
+		for addr, violations := range t.addresses {
+			if now.Sub(violations.since) > t.window {
+				delete(t.addresses, addr)
+			}
+		}
+		t.lastSweep = now
+	}
+
+	violations, ok := t.addresses[ip]
+	if !ok || now.Sub(violations.since) > t.window {
+		violations = &addressViolations{since: now}
+		t.addresses[ip] = violations
+	}
+	violations.count++
+	if violations.count < t.threshold {
+		return false
+	}
+	delete(t.addresses, ip)
+	return true
+}
+
+// accountIds splits the client's channel into its account and avatar ids, which are 0 until the
+// client has been given a channel other than the one it was allocated.
+func (c *Client) accountIds() (account uint32, avatar uint32) {
+	if c.channel == c.allocatedChannel {
+		return 0, 0
+	}
+	return uint32(c.channel >> 32), uint32(c.channel)
+}
+
+// securityViolation reports a client ejected for a security violation to the security event stream,
+// along with the offending datagram if there is one, and bans its address for a while once it has
+// had too many of them.
+func (c *Client) securityViolation(reason uint16, message string, dg *Datagram) {
+	msgType, dump := "-", ""
+	if dg != nil {
+		data := dg.Bytes()
+		if len(data) >= Blobsize {
+			msgType = strconv.Itoa(int(binary.LittleEndian.Uint16(data)))
+		}
+		dump = hex.EncodeToString(data[:min(len(data), maxSecurityDump)])
+	}
+
+	conn, _ := c.connected()
+	ip, hasIP := connectionIP(conn)
+	address := "-"
+	if hasIP {
+		address = ip.String()
+	}
+
+	account, avatar := c.accountIds()
+	eventlogger.NewLoggedEvent("client-ejected-security", "Client", strconv.FormatUint(uint64(c.allocatedChannel), 10),
+		fmt.Sprintf("%d|%s|%d|%d|%s|%s|%s", reason, message, account, avatar, address, msgType, dump),
+	).SendSecurity()
+
+	if !hasIP || !c.ca.violations.record(ip) {
+		return
+	}
+
+	violations := c.ca.violations
+	duration := violations.duration
+	banReason := fmt.Sprintf("%d security violations within %s", violations.threshold, violations.window)
+	if err := c.ca.bans.BanFor(address, banReason, duration); err != nil {
+		c.log.Errorf("Unable to ban %s: %s", address, err)
+		return
+	}
+
+	c.log.Warnf("[SECURITY] Banned %s for %s: %s", address, duration, banReason)
+	eventlogger.NewLoggedEvent("client-auto-banned", "ClientAgent", address,
+		fmt.Sprintf("%s|%s", duration, banReason),
+	).SendSecurity()
+}
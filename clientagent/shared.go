@@ -0,0 +1,173 @@
+package clientagent
+
+import (
+	"fmt"
+	. "otpgo/util"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// maxSharedDepth limits how deeply tables stored in the shared state may be nested.
+const maxSharedDepth = 16
+
+// sharedTable is a copy of a Lua table kept outside of any Lua state.
+type sharedTable map[any]any
+
+// SharedState holds values shared by the Lua workers of a CA. Values are copied in and out, so
+// only nil, booleans, numbers, strings, Int64/Uint64 and tables of those may be stored.
+type SharedState struct {
+	sync.Mutex
+	values map[string]any
+}
+
+func NewSharedState() *SharedState {
+	return &SharedState{values: make(map[string]any)}
+}
+
+// RegisterSharedState exposes the shared state to a Lua state as the shared global.
+func RegisterSharedState(L *lua.LState, s *SharedState) {
+	L.SetGlobal("shared", L.SetFuncs(L.NewTable(), map[string]lua.LGFunction{
+		"get":         s.luaGet,
+		"set":         s.luaSet,
+		"increment":   s.luaIncrement,
+		"setIfAbsent": s.luaSetIfAbsent,
+	}))
+}
+
+// shared.get(key) returns a copy of the value stored under key, or nil.
+func (s *SharedState) luaGet(L *lua.LState) int {
+	key := L.CheckString(1)
+
+	s.Lock()
+	value := s.values[key]
+	s.Unlock()
+
+	L.Push(toLuaValue(L, value))
+	return 1
+}
+
+// shared.set(key, value) stores a copy of value under key; a nil value removes the key.
+func (s *SharedState) luaSet(L *lua.LState) int {
+	key := L.CheckString(1)
+	value := checkSharedValue(L, 2)
+
+	s.Lock()
+	defer s.Unlock()
+	if value == nil {
+		delete(s.values, key)
+	} else {
+		s.values[key] = value
+	}
+	return 0
+}
+
+// shared.increment(key, delta) adds delta (default 1) to the number stored under key, treating
+// a missing key as 0, and returns the new value.
+func (s *SharedState) luaIncrement(L *lua.LState) int {
+	key := L.CheckString(1)
+	delta := L.OptNumber(2, 1)
+
+	s.Lock()
+	defer s.Unlock()
+	current := lua.LNumber(0)
+	if value, ok := s.values[key]; ok {
+		number, ok := value.(lua.LNumber)
+		if !ok {
+			L.RaiseError("shared value \"%s\" is not a number", key)
+			return 0
+		}
+		current = number
+	}
+	current += delta
+	s.values[key] = current
+	L.Push(current)
+	return 1
+}
+
+// shared.setIfAbsent(key, value) stores a copy of value under key if nothing is stored there yet,
+// and returns whether it did.
+func (s *SharedState) luaSetIfAbsent(L *lua.LState) int {
+	key := L.CheckString(1)
+	value := checkSharedValue(L, 2)
+
+	s.Lock()
+	defer s.Unlock()
+	if _, ok := s.values[key]; ok || value == nil {
+		L.Push(lua.LFalse)
+		return 1
+	}
+	s.values[key] = value
+	L.Push(lua.LTrue)
+	return 1
+}
+
+func checkSharedValue(L *lua.LState, n int) any {
+	value, err := fromLuaValue(L.Get(n), 0)
+	if err != nil {
+		L.ArgError(n, err.Error())
+	}
+	return value
+}
+
+// fromLuaValue copies a Lua value so that it can be handed to another Lua state.
+func fromLuaValue(value lua.LValue, depth int) (any, error) {
+	switch value := value.(type) {
+	case *lua.LNilType:
+		return nil, nil
+	case lua.LBool, lua.LNumber, lua.LString:
+		return value, nil
+	case *lua.LUserData:
+		switch v := value.Value.(type) {
+		case int64, uint64:
+			return v, nil
+		}
+		return nil, fmt.Errorf("userdata can't be shared")
+	case *lua.LTable:
+		if depth >= maxSharedDepth {
+			return nil, fmt.Errorf("tables nested more than %d deep can't be shared", maxSharedDepth)
+		}
+		table := make(sharedTable)
+		var err error
+		value.ForEach(func(k lua.LValue, v lua.LValue) {
+			if err != nil {
+				return
+			}
+			var key, val any
+			switch k.(type) {
+			case lua.LBool, lua.LNumber, lua.LString:
+				key = k
+			default:
+				err = fmt.Errorf("tables with %s keys can't be shared", k.Type())
+				return
+			}
+			if val, err = fromLuaValue(v, depth+1); err == nil {
+				table[key] = val
+			}
+		})
+		return table, err
+	default:
+		return nil, fmt.Errorf("a %s can't be shared", value.Type())
+	}
+}
+
+// toLuaValue recreates a value copied by fromLuaValue in a Lua state.
+func toLuaValue(L *lua.LState, value any) lua.LValue {
+	switch value := value.(type) {
+	case nil:
+		return lua.LNil
+	case lua.LValue:
+		return value
+	case int64:
+		return NewLuaInt64(L, value)
+	case uint64:
+		return NewLuaUint64(L, value)
+	case sharedTable:
+		table := L.NewTable()
+		for k, v := range value {
+			table.RawSet(k.(lua.LValue), toLuaValue(L, v))
+		}
+		return table
+	}
+	return lua.LNil
+}
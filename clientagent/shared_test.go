@@ -0,0 +1,112 @@
+package clientagent
+
+import (
+	"github.com/stretchr/testify/require"
+	. "otpgo/util"
+	"strings"
+	"testing"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// newSharedLuaState makes a Lua state with the shared global, as a worker would have it.
+func newSharedLuaState(t *testing.T, s *SharedState) *lua.LState {
+	L := lua.NewState()
+	t.Cleanup(L.Close)
+	RegisterLuaUtilTypes(L)
+	RegisterSharedState(L, s)
+	return L
+}
+
+func TestSharedState_CopyInOut(t *testing.T) {
+	s := NewSharedState()
+	first, second := newSharedLuaState(t, s), newSharedLuaState(t, s)
+	first.SetGlobal("big", NewLuaInt64(first, -1<<40))
+	first.SetGlobal("ubig", NewLuaUint64(first, 1<<63))
+
+	require.NoError(t, first.DoString(`
+		local value = {name = "lobby", [1] = 10, [true] = false, nested = {deeper = {big = big, ubig = ubig}}}
+		shared.set("district", value)
+		-- The stored value is a copy
+		value.name = "changed"
+		value.nested.deeper.big = nil
+	`))
+	require.NoError(t, second.DoString(`
+		local value = shared.get("district")
+		assert(value.name == "lobby")
+		assert(value[1] == 10 and value[true] == false)
+		assert(value.nested.deeper.big ~= nil and value.nested.deeper.ubig ~= nil)
+
+		-- So is every value handed out
+		value.name = "changed"
+		assert(shared.get("district").name == "lobby")
+		assert(shared.get("district") ~= shared.get("district"))
+
+		assert(shared.get("missing") == nil)
+		shared.set("district", nil)
+		assert(shared.get("district") == nil)
+	`))
+
+	// Int64 and Uint64 keep their type and value in the other state
+	require.NoError(t, first.DoString(`shared.set("big", {big, ubig})`))
+	require.NoError(t, second.DoString(`copied = shared.get("big")`))
+	copied := second.GetGlobal("copied").(*lua.LTable)
+	big, ubig := copied.RawGetInt(1).(*lua.LUserData), copied.RawGetInt(2).(*lua.LUserData)
+	require.Equal(t, int64(-1<<40), big.Value)
+	require.Equal(t, uint64(1<<63), ubig.Value)
+	require.Equal(t, second.GetTypeMetatable("int64"), big.Metatable)
+	require.Equal(t, second.GetTypeMetatable("uint64"), ubig.Metatable)
+}
+
+func TestSharedState_Increment(t *testing.T) {
+	s := NewSharedState()
+	L := newSharedLuaState(t, s)
+
+	require.NoError(t, L.DoString(`
+		assert(shared.increment("players") == 1)
+		assert(shared.increment("players", 5) == 6)
+		assert(shared.increment("players", -2) == 4)
+		assert(shared.setIfAbsent("players", 0) == false)
+		assert(shared.setIfAbsent("district", "lobby") == true)
+		assert(shared.get("district") == "lobby")
+	`))
+	err := L.DoString(`shared.increment("district")`)
+	require.ErrorContains(t, err, "is not a number")
+}
+
+func TestSharedState_Rejected(t *testing.T) {
+	s := NewSharedState()
+	L := newSharedLuaState(t, s)
+	L.SetGlobal("userdata", L.NewUserData())
+
+	for script, reason := range map[string]string{
+		`shared.set("fn", print)`:                  "can't be shared",
+		`shared.set("ud", userdata)`:               "userdata can't be shared",
+		`shared.set("ud", {inner = {userdata}})`:   "userdata can't be shared",
+		`shared.set("key", {[{}] = 1})`:            "keys can't be shared",
+		`shared.setIfAbsent("fn", function() end)`: "can't be shared",
+	} {
+		require.ErrorContains(t, L.DoString(script), reason, script)
+	}
+
+	// Tables may only be nested so deep
+	nested := func(depth int) string {
+		return "shared.set(\"deep\", " + strings.Repeat("{", depth) + strings.Repeat("}", depth) + ")"
+	}
+	require.NoError(t, L.DoString(nested(maxSharedDepth)))
+	require.ErrorContains(t, L.DoString(nested(maxSharedDepth+1)), "nested more than")
+
+	// Nothing rejected was stored
+	require.NoError(t, L.DoString(`assert(shared.get("fn") == nil and shared.get("ud") == nil and shared.get("key") == nil)`))
+	require.Len(t, s.values, 1)
+}
+
+func TestSharedState_SelfReference(t *testing.T) {
+	// A table containing itself is nested infinitely deep, which is caught by the depth limit
+	L := newSharedLuaState(t, NewSharedState())
+	require.ErrorContains(t, L.DoString(`
+		local value = {}
+		value.self = value
+		shared.set("loop", value)
+	`), "nested more than")
+}
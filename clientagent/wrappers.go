@@ -48,6 +48,8 @@ var ClientMethods = map[string]lua.LGFunction{
 	"addSessionObject":             LuaAddSessionObject,
 	"addPostRemove":                LuaAddPostRemove,
 	"authenticated":                LuaGetSetAuthenticated,
+	"capture":                      LuaCapture,
+	"interestPermission":           LuaGetSetInterestPermission,
 	"clearPostRemoves":             LuaClearPostRemoves,
 	"createDatabaseObject":         LuaCreateDatabaseObject,
 	"declareObject":                LuaDeclareObject,
@@ -67,6 +69,8 @@ var ClientMethods = map[string]lua.LGFunction{
 	"queryAllRequiredFields":       LuaQueryAllRequiredFields,
 	"queryObjectFields":            LuaQueryObjectFields,
 	"removeSessionObject":          LuaRemoveSessionObject,
+	"resume":                       LuaResume,
+	"resumeToken":                  LuaResumeToken,
 	"routeDatagram":                LuaRouteDatagram,
 	"sendActivateObject":           LuaSendActivateObject,
 	"sendDatagram":                 LuaSendDatagram,
@@ -164,6 +168,23 @@ func LuaGetSetAuthenticated(L *lua.LState) int {
 	return 1
 }
 
+// client:interestPermission() returns whether the client may add interests itself: "enabled",
+// "visible" (only in objects it can see) or "disabled". client:interestPermission(name) changes it.
+func LuaGetSetInterestPermission(L *lua.LState) int {
+	client := CheckClient(L, 1)
+	if L.GetTop() == 2 {
+		permission, ok := ParseInterestPermission(L.CheckString(2))
+		if !ok {
+			L.ArgError(2, "Expected \"enabled\", \"visible\" or \"disabled\".")
+			return 0
+		}
+		client.allowedInterests = permission
+	} else {
+		L.Push(lua.LString(client.allowedInterests.String()))
+	}
+	return 1
+}
+
 func LuaCreateDatabaseObject(L *lua.LState) int {
 	client := CheckClient(L, 1)
 	clsName := L.CheckString(2)
@@ -283,10 +304,50 @@ func LuaHandleDisconnect(L *lua.LState) int {
 	return 1
 }
 
+// client:resumeToken() returns the token the client may resume its session with after losing its
+// connection, or nil if sessions can't be resumed.
+func LuaResumeToken(L *lua.LState) int {
+	client := CheckClient(L, 1)
+	if client.config.Client.Resume.Window == 0 {
+		L.Push(lua.LNil)
+		return 1
+	}
+
+	token, err := client.issueResumeToken()
+	if err != nil {
+		L.RaiseError("unable to issue a resume token: %s", err)
+	}
+	L.Push(lua.LString(token))
+	return 1
+}
+
+// client:resume(token) moves the connection over to the session the token was issued to, returning
+// whether there was one. Datagrams from the connection are handled by that session from then on.
+func LuaResume(L *lua.LState) int {
+	client := CheckClient(L, 1)
+	token := L.CheckString(2)
+	L.Push(lua.LBool(client.resume(token)))
+	return 1
+}
+
+// client:capture([seconds]) captures the client's datagrams to a file for the given number of
+// seconds, 60 by default, returning the path of the file.
+func LuaCapture(L *lua.LState) int {
+	client := CheckClient(L, 1)
+	seconds := L.OptInt(2, 0)
+
+	path, err := client.startCapture(seconds)
+	if err != nil {
+		L.RaiseError("unable to start a capture: %s", err)
+	}
+	L.Push(lua.LString(path))
+	return 1
+}
+
 func LuaSendDatagram(L *lua.LState) int {
 	client := CheckClient(L, 1)
 	dg := CheckDatagram(L, 2)
-	client.client.SendDatagram(*dg)
+	client.send(*dg)
 	return 1
 }
 
@@ -534,7 +595,7 @@ func LuaQueryObjectFields(L *lua.LState) int {
 
 	if len(fieldIds) == 0 {
 		client.log.Warnf("queryObjectFields: Nothing to do for class \"%s\"!", clsName)
-		client.ca.CallLuaFunction(callback, client, lua.LNumber(doId), lua.LTrue, client.ca.L.NewTable())
+		client.ca.CallLuaFunction(callback, client, lua.LNumber(doId), lua.LTrue, client.worker.L().NewTable())
 		return 1
 	}
 
@@ -556,7 +617,7 @@ func LuaQueryObjectFields(L *lua.LState) int {
 		found := len(fields)
 		client.log.Debugf("queryObjectFields: Found %d fields for %s(%d)", found, clsName, doId)
 
-		fieldTable := client.ca.L.NewTable()
+		fieldTable := client.worker.L().NewTable()
 
 		DCLock.Lock()
 		defer DCLock.Unlock()
@@ -576,7 +637,7 @@ func LuaQueryObjectFields(L *lua.LState) int {
 				continue
 			}
 			unpacker.BeginUnpack(field)
-			lValue := core.UnpackDataToLuaValue(unpacker, client.ca.L)
+			lValue := core.UnpackDataToLuaValue(unpacker, client.worker.L())
 			if !unpacker.EndUnpack() {
 				client.log.Warnf("queryObjectFields: Unable to unpack field \"%s\"!\n%s", field.GetName(), DumpUnpacker(unpacker))
 				continue
@@ -623,7 +684,7 @@ func LuaQueryAllRequiredFields(L *lua.LState) int {
 
 	if len(fieldIds) == 0 {
 		client.log.Warnf("queryObjectFields: Nothing to do for class \"%s\"!", clsName)
-		client.ca.CallLuaFunction(callback, client, lua.LNumber(doId), lua.LTrue, client.ca.L.NewTable())
+		client.ca.CallLuaFunction(callback, client, lua.LNumber(doId), lua.LTrue, client.worker.L().NewTable())
 		return 1
 	}
 
@@ -645,7 +706,7 @@ func LuaQueryAllRequiredFields(L *lua.LState) int {
 		found := len(fields)
 		client.log.Debugf("queryObjectFields: Found %d fields for %s(%d)", found, clsName, doId)
 
-		resultTable := client.ca.L.NewTable()
+		resultTable := client.worker.L().NewTable()
 
 		DCLock.Lock()
 		defer DCLock.Unlock()
@@ -665,12 +726,12 @@ func LuaQueryAllRequiredFields(L *lua.LState) int {
 				continue
 			}
 			unpacker.BeginUnpack(field)
-			lValue := core.UnpackDataToLuaValue(unpacker, client.ca.L)
+			lValue := core.UnpackDataToLuaValue(unpacker, client.worker.L())
 			if !unpacker.EndUnpack() {
 				client.log.Warnf("queryObjectFields: Unable to unpack field \"%s\"!\n%s", field.GetName(), DumpUnpacker(unpacker))
 				continue
 			}
-			fieldTable := client.ca.L.NewTable()
+			fieldTable := client.worker.L().NewTable()
 			fieldTable.Append(lua.LString(field.GetName()))
 			fieldTable.Append(lValue)
 
@@ -785,6 +846,10 @@ func LuaHandleAddInterest(L *lua.LState) int {
 		})
 	}
 
+	if !client.interestAllowed(parent) {
+		return 1
+	}
+
 	i := client.buildInterest(handle, parent, zones, false)
 
 	client.Lock()
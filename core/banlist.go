@@ -0,0 +1,52 @@
+package core
+
+import (
+	"errors"
+	"sync"
+)
+
+// BanList is a list of addresses a role refuses connections from.
+type BanList interface {
+	Ban(address string, reason string) error
+	Unban(address string) (bool, error)
+}
+
+var (
+	banListLock sync.Mutex
+	banLists    []BanList
+)
+
+// AddBanList registers a ban list to be edited through Ban and Unban, which is what the
+// CONTROL_BAN_ADDRESS and CONTROL_UNBAN_ADDRESS messages do.
+func AddBanList(list BanList) {
+	banListLock.Lock()
+	defer banListLock.Unlock()
+	banLists = append(banLists, list)
+}
+
+// Ban bans an IP address or CIDR range on every registered ban list.
+func Ban(address string, reason string) error {
+	banListLock.Lock()
+	lists := banLists
+	banListLock.Unlock()
+
+	var errs []error
+	for _, list := range lists {
+		errs = append(errs, list.Ban(address, reason))
+	}
+	return errors.Join(errs...)
+}
+
+// Unban lifts a ban on every registered ban list.
+func Unban(address string) error {
+	banListLock.Lock()
+	lists := banLists
+	banListLock.Unlock()
+
+	var errs []error
+	for _, list := range lists {
+		_, err := list.Unban(address)
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
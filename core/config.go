@@ -30,20 +30,38 @@ type Role struct {
 	Version string
 	DC_Hash int
 	Tuning  struct {
-		Interest_Timeout int
+		Interest_Timeout  int
+		Max_Datagram_Size int // bytes; datagrams may be up to 65535 bytes if 0
 	}
-	Lua_File string
-	Client   struct {
+	Lua_File    string
+	Lua_Workers int // number of Lua states clients are spread over; 1 if 0
+	// If TLS is set, clients connect over TLS.
+	TLS *ClientTLS
+	// If WebSocket is set, clients connect through WebSockets instead of plain sockets.
+	WebSocket *ClientWebSocket
+	Client    struct {
 		Add_Interest         string
 		Write_Buffer_Size    int
 		Heartbeat_Timeout    int
 		Keepalive            int
 		Relocate             bool
 		Legacy_Handle_Object bool
+		Rate_Limit           ClientRateLimit
+		Drain                ClientDrain
+		Connection_Limit     ClientConnectionLimit
+		// Ban_List is a file of IP addresses and CIDR ranges to refuse connections from.
+		Ban_List string
+		// Max_Clients caps the clients connected at once; 0 only limits them to the channel range.
+		Max_Clients int
+		Resume      ClientResume
+		Security    ClientSecurity
+		Capture     ClientCapture
 	}
 	Channels struct {
 		Min int
 		Max int
+		// Reuse_Delay is how many seconds a freed channel is held back before it is handed out again.
+		Reuse_Delay int
 	}
 
 	// STATESERVER
@@ -82,12 +100,100 @@ type Role struct {
 	RotateInterval string
 }
 
+type ClientTLS struct {
+	Certificate string
+	Key_File    string
+	Chain_File  string // intermediate certificates sent along with the certificate
+	Tlsv1       *bool  // enabled unless set to false
+	Sslv2       bool
+	Sslv3       bool
+	// Cert_Authority is a file or directory of certificates which clients' certificates must be signed by.
+	Cert_Authority   string
+	Max_Verify_Depth int
+}
+
+// ClientRateLimit limits what a client may send per second; a limit of 0 is disabled.
+type ClientRateLimit struct {
+	Datagrams     float64
+	Bytes         float64
+	Field_Updates float64 // updates to each DC field
+	// Burst is the number of seconds worth of each limit a client may use up at once; it is never
+	// less than one datagram of the maximum size.
+	Burst float64
+}
+
+// ClientConnectionLimit limits the connections accepted from each IP address; a limit of 0 is disabled.
+type ClientConnectionLimit struct {
+	Per_IP int     // connections open at once
+	Rate   float64 // new connections per second
+	// Burst is the number of seconds worth of Rate an address may use up at once.
+	Burst float64
+}
+
+// ClientCapture configures the captures of clients' datagrams started through Lua or
+// CLIENTAGENT_START_CAPTURE.
+type ClientCapture struct {
+	Directory    string // where capture files are written; the working directory if empty
+	Max_Duration int    // seconds a capture may last at most; 300 if 0
+}
+
+// ClientSecurity bans the addresses of clients which are ejected for security violations too often.
+type ClientSecurity struct {
+	Ban_Threshold int // violations which get an address banned; disabled if 0
+	Ban_Window    int // seconds the violations have to happen within; 60 if 0
+	Ban_Duration  int // seconds the address is banned for; 600 if 0
+}
+
+// ClientResume lets clients which lose their connection resume their session on a new one.
+type ClientResume struct {
+	Window int // seconds a session is held for after its connection is lost; disabled if 0
+	Buffer int // datagrams held back for a suspended session; 1024 if 0
+}
+
+// ClientDrain configures how a ClientAgent disconnects its clients ahead of a shutdown.
+type ClientDrain struct {
+	Message string // sent with CLIENT_GO_GET_LOST
+	// Countdown_Message is broadcast through CLIENT_SYSTEM_MESSAGE while a drain counts down;
+	// %d is replaced with the number of seconds left.
+	Countdown_Message string
+	Timeout           int // seconds to wait for clients to be cleaned up; 10 if 0
+}
+
+type ClientWebSocket struct {
+	Path    string   // defaults to /
+	Origins []string // origins browsers may connect from; any origin if empty
+	// Forwarded_For takes the client address from the X-Forwarded-For header set by a proxy.
+	Forwarded_For bool
+	// Trusted_Proxies are the IPs or CIDRs of the proxies whose X-Forwarded-For header is taken,
+	// or "unix" for those on a unix socket; the header is ignored from everyone else.
+	Trusted_Proxies []string
+}
+
+// ACL restricts what MD connections may subscribe and send to. Channels are only allowed
+// if they fall within one of the listed ranges.
+type ACL struct {
+	Address   string // IP or CIDR the connection comes from, or "unix"; matches any address if empty
+	Identity  string // common name of the TLS client certificate; matches any connection if empty
+	Subscribe []ChannelRange
+	Send      []ChannelRange
+	Violation string // "drop" or "disconnect"
+	// Admin allows querying participants, reloading Lua, draining clients, banning addresses and
+	// capturing clients, which no connection may do otherwise.
+	Admin bool
+}
+
+type ChannelRange struct {
+	Min util.Channel_t
+	Max util.Channel_t
+}
+
 type ServerConfig struct {
 	Daemon struct {
 		Name string
 	}
 	General struct {
 		Eventlogger                         string
+		Security_Eventlogger                string // receives the security events of ClientAgents instead
 		DC_Files                            []string
 		DC_Disable_Multiple_Inheritance     bool
 		DC_Disable_Virtual_Inheritance      bool
@@ -100,6 +206,40 @@ type ServerConfig struct {
 	MessageDirector struct {
 		Bind    string
 		Connect string
+		// Workers is the number of goroutines routing datagrams; defaults to GOMAXPROCS.
+		Workers int
+		// Reconnect tunes how the link to the upstream MD is re-established when it drops.
+		Reconnect struct {
+			Min_Delay int // milliseconds
+			Max_Delay int // milliseconds
+			Buffer    int // bytes of datagrams held while disconnected
+		}
+		// Queue bounds how many datagrams may be waiting inside the MD.
+		Queue struct {
+			Participant_Limit int // datagrams a connection may have waiting to be routed
+			Total_Limit       int // datagrams waiting to be routed across the MD
+			Outbound_Buffer   int // datagrams waiting to be written to a connection
+			// Slow_Consumer is what happens once a connection's outbound buffer is full:
+			// "block", "drop" or "disconnect" (the default).
+			Slow_Consumer string
+		}
+		// TLS encrypts both the listener and the link to the upstream MD. When Ca is set, the
+		// other end must present a certificate signed by it.
+		TLS struct {
+			Enabled bool
+			Cert    string
+			Key     string
+			Ca      string
+		}
+		// Secret must be sent through CONTROL_AUTHENTICATE before a connection may send anything else.
+		Secret string
+		// Connections get the first ACL that matches them; those which match none are unrestricted,
+		// unless Default_ACL is "deny".
+		ACLs        []ACL
+		Default_ACL string // "allow" (the default) or "deny"
+		// Record is a file every routed datagram is written to, for use with `otpgo replay`.
+		// It may contain strftime directives.
+		Record string
 	}
 	Debug struct {
 		Pprof bool
@@ -0,0 +1,36 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	drainLock sync.Mutex
+	drainers  []func(countdown time.Duration)
+)
+
+// OnDrain registers a function which disconnects a role's clients ahead of a shutdown, once the
+// countdown has passed. It should only return once they have been cleaned up.
+func OnDrain(fn func(countdown time.Duration)) {
+	drainLock.Lock()
+	defer drainLock.Unlock()
+	drainers = append(drainers, fn)
+}
+
+// Drain calls every function registered with OnDrain, and waits for them to return.
+func Drain(countdown time.Duration) {
+	drainLock.Lock()
+	fns := drainers
+	drainLock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, fn := range fns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			fn(countdown)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,27 @@
+package core
+
+import "sync"
+
+var (
+	reloadLock sync.Mutex
+	reloaders  []func()
+)
+
+// OnReload registers a function to be called whenever the daemon is asked to reload its Lua
+// scripts, either through SIGHUP or a CONTROL_RELOAD_LUA message.
+func OnReload(fn func()) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	reloaders = append(reloaders, fn)
+}
+
+// ReloadLua calls every function registered with OnReload.
+func ReloadLua() {
+	reloadLock.Lock()
+	fns := reloaders
+	reloadLock.Unlock()
+
+	for _, fn := range fns {
+		fn()
+	}
+}
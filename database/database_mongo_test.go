@@ -55,15 +55,10 @@ func TestMain(m *testing.M) {
 		panic(err)
 	}
 
-	StartDaemon(
-		core.ServerConfig{MessageDirector: struct {
-			Bind    string
-			Connect string
-		}{Bind: "127.0.0.1:57123"},
-			General: struct {
-				Eventlogger string
-				DC_Files    []string
-			}{Eventlogger: "", DC_Files: []string{"../test/test.dc"}}})
+	config := core.ServerConfig{}
+	config.MessageDirector.Bind = "127.0.0.1:57123"
+	config.General.DC_Files = []string{"../test/test.dc"}
+	StartDaemon(config)
 	if err := core.LoadDC(); err != nil {
 		os.Exit(1)
 	}
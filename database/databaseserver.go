@@ -2,8 +2,6 @@ package database
 
 import (
 	"fmt"
-	"os"
-	"os/signal"
 	"otpgo/core"
 	"otpgo/messagedirector"
 	. "otpgo/util"
@@ -128,10 +126,9 @@ func (d *DatabaseServer) getOperationFromQueue() OperationQueueEntry {
 	return op
 }
 
+// queueLoop carries on after an interrupt, as post-removes are still routed to the database
+// while the daemon drains.
 func (d *DatabaseServer) queueLoop() {
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, os.Interrupt)
-
 	for {
 		select {
 		case <-d.processQueue:
@@ -146,8 +143,6 @@ func (d *DatabaseServer) queueLoop() {
 					d.backend.SetStoredValues(op.doId, op.data.(map[string]dc.Vector))
 				}
 			}
-		case <-signalCh:
-			return
 		case <-core.StopChan:
 			return
 		}
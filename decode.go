@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"otpgo/clientagent"
+	"otpgo/core"
+	"otpgo/dc"
+	"otpgo/util"
+	"slices"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// clientMessageNames names the client messages the ClientAgent sends or handles itself; others are
+// up to the Lua script.
+var clientMessageNames = map[uint16]string{
+	clientagent.CLIENT_GO_GET_LOST:                        "CLIENT_GO_GET_LOST",
+	clientagent.CLIENT_OBJECT_UPDATE_FIELD:                "CLIENT_OBJECT_UPDATE_FIELD",
+	clientagent.CLIENT_OBJECT_DISABLE:                     "CLIENT_OBJECT_DISABLE",
+	clientagent.CLIENT_OBJECT_DISABLE_OWNER:               "CLIENT_OBJECT_DISABLE_OWNER",
+	clientagent.CLIENT_OBJECT_DELETE:                      "CLIENT_OBJECT_DELETE",
+	clientagent.CLIENT_CREATE_OBJECT_REQUIRED:             "CLIENT_CREATE_OBJECT_REQUIRED",
+	clientagent.CLIENT_CREATE_OBJECT_REQUIRED_OTHER:       "CLIENT_CREATE_OBJECT_REQUIRED_OTHER",
+	clientagent.CLIENT_CREATE_OBJECT_REQUIRED_OTHER_OWNER: "CLIENT_CREATE_OBJECT_REQUIRED_OTHER_OWNER",
+	clientagent.CLIENT_DISCONNECT:                         "CLIENT_DISCONNECT",
+	clientagent.CLIENT_DONE_INTEREST_RESP:                 "CLIENT_DONE_INTEREST_RESP",
+	clientagent.CLIENT_HEARTBEAT:                          "CLIENT_HEARTBEAT",
+	clientagent.CLIENT_SYSTEM_MESSAGE:                     "CLIENT_SYSTEM_MESSAGE",
+	clientagent.CLIENT_ADD_INTEREST:                       "CLIENT_ADD_INTEREST",
+	clientagent.CLIENT_REMOVE_INTEREST:                    "CLIENT_REMOVE_INTEREST",
+	clientagent.CLIENT_OBJECT_LOCATION:                    "CLIENT_OBJECT_LOCATION",
+}
+
+// decode prints the datagrams of a client capture, using the DC file to print field updates.
+func decode(args []string) {
+	flags := pflag.NewFlagSet("decode", pflag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf(
+			`Usage:    otpgo decode [options]... CAPTURE [CONFIG_FILE]
+
+      Prints the datagrams of a client capture, as written by the
+      ClientAgent when a client is captured through client:capture()
+      or "otpgo capture".  Field updates are unpacked with the DC files
+      of the configuration file, which must match those the capture
+      was made with.
+
+      -t, --msgtype   Only print datagrams with this message type;
+                        may be given more than once.
+      -x, --hex       Print a hex dump of every datagram.
+      -h, --help      Print this help dialog.
+`)
+		os.Exit(1)
+	}
+
+	msgTypes := flags.UintSliceP("msgtype", "t", nil, "Only print datagrams with this message type.")
+	dump := flags.BoolP("hex", "x", false, "Print a hex dump of every datagram.")
+	help := flags.BoolP("help", "h", false, "Show the decode usage.")
+
+	flags.Parse(args)
+	if *help || flags.NArg() == 0 {
+		flags.Usage()
+	}
+
+	reader, err := clientagent.OpenCapture(flags.Arg(0))
+	if err != nil {
+		mainLog.Fatal(err.Error())
+	}
+	defer reader.Close()
+
+	loadConfig(flags.Args()[1:])
+	if err := core.LoadDC(); err != nil {
+		mainLog.Fatal(err.Error())
+	}
+
+	fmt.Printf("Capture of client %d, started %s\n", reader.Channel, reader.Start.Format("2006-01-02 15:04:05.000000"))
+
+	decoded := 0
+	for {
+		rec, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			mainLog.Errorf("Capture stopped after %d datagrams: %s", decoded, err)
+			break
+		}
+		decoded++
+
+		data := rec.Datagram.Bytes()
+		var msgType uint16
+		if len(data) >= util.Blobsize {
+			msgType = uint16(data[0]) | uint16(data[1])<<8
+		}
+		if len(*msgTypes) > 0 && !slices.Contains(*msgTypes, uint(msgType)) {
+			continue
+		}
+
+		direction := "OUT"
+		if rec.Inbound {
+			direction = "IN "
+		}
+		fmt.Printf("+%.6fs %s %s\n", rec.Time.Sub(reader.Start).Seconds(), direction, describeClientDatagram(data))
+		if *dump {
+			fmt.Print(indent(hex.Dump(data)))
+		}
+	}
+}
+
+// describeClientDatagram names the message of a datagram to or from a client, along with the
+// contents of those which can be read without the state of the session.
+func describeClientDatagram(data []byte) (description string) {
+	if len(data) < util.Blobsize {
+		return fmt.Sprintf("truncated datagram of %d bytes", len(data))
+	}
+
+	dg := util.NewDatagram()
+	dg.Write(data)
+	dgi := util.NewDatagramIterator(&dg)
+	msgType := dgi.ReadUint16()
+
+	name, ok := clientMessageNames[msgType]
+	if !ok {
+		name = "unknown"
+	}
+	description = fmt.Sprintf("%s (%d), %d bytes", name, msgType, len(data))
+
+	defer func() {
+		if r := recover(); r != nil {
+			if _, eof := r.(util.DatagramIteratorEOF); !eof {
+				panic(r)
+			}
+			description += ": truncated"
+		}
+	}()
+
+	switch msgType {
+	case clientagent.CLIENT_OBJECT_UPDATE_FIELD:
+		do, number := dgi.ReadDoid(), dgi.ReadUint16()
+		field := core.DC.GetFieldByIndex(int(number))
+		if field == dc.SwigcptrDCField(0) {
+			return fmt.Sprintf("%s: unknown field %d of object %d", description, number, do)
+		}
+
+		fieldName := field.GetName()
+		if class := field.GetClass(); class != dc.SwigcptrDCClass(0) {
+			fieldName = class.GetName() + "." + fieldName
+		}
+		formatted := util.FormatFieldData(field, dgi.ReadRemainder())
+		if formatted == "" {
+			formatted = "invalid or truncated data"
+		}
+		return fmt.Sprintf("%s: %d %s %s", description, do, fieldName, formatted)
+	case clientagent.CLIENT_GO_GET_LOST:
+		reason := dgi.ReadUint16()
+		return fmt.Sprintf("%s: %d %q", description, reason, dgi.ReadString())
+	case clientagent.CLIENT_SYSTEM_MESSAGE:
+		return fmt.Sprintf("%s: %q", description, dgi.ReadString())
+	}
+	return description
+}
+
+func indent(text string) string {
+	lines := strings.SplitAfter(strings.TrimSuffix(text, "\n"), "\n")
+	return "        " + strings.Join(lines, "        ") + "\n"
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"otpgo/core"
+	"otpgo/util"
+
+	"github.com/spf13/pflag"
+)
+
+// drain asks a running daemon to drain the clients of its ClientAgents through its MD.
+func drain(args []string) {
+	flags := pflag.NewFlagSet("drain", pflag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf(
+			`Usage:    otpgo drain [options]... [CONFIG_FILE]
+
+      Asks a running OtpGo to drain its ClientAgents ahead of a shutdown,
+      by sending CONTROL_DRAIN_CLIENTS to its MD, whose ACL has to grant
+      it admin.  The ClientAgents stop accepting clients, announce the
+      drain to connected clients during the countdown, then disconnect
+      them.  The daemon keeps running
+      afterwards; interrupting it during the countdown drains at once.
+
+      -c, --countdown Seconds to wait before disconnecting clients.
+      -a, --address   Connect to the MD at this address instead of
+                        messagedirector.bind.
+      -h, --help      Print this help dialog.
+`)
+		os.Exit(1)
+	}
+
+	countdown := flags.Uint32P("countdown", "c", 0, "Seconds to wait before disconnecting clients.")
+	address := flags.StringP("address", "a", "", "Connect to the MD at this address.")
+	help := flags.BoolP("help", "h", false, "Show the drain usage.")
+
+	flags.Parse(args)
+	if *help {
+		flags.Usage()
+	}
+
+	loadConfig(flags.Args())
+	if *address == "" {
+		*address = core.Config.MessageDirector.Bind
+	}
+
+	dg := util.NewDatagram()
+	dg.AddControlHeader(util.CONTROL_DRAIN_CLIENTS)
+	dg.AddUint32(*countdown)
+	sendControlMessage(*address, dg)
+	mainLog.Infof("Asked the MD at %s to drain clients in %d seconds", *address, *countdown)
+}
@@ -1,6 +1,7 @@
 package eventlogger
 
 import (
+	"errors"
 	"fmt"
 	"net"
 	"os"
@@ -75,29 +76,45 @@ func handleInterrupts() {
 
 func processLoggedEvent(le LoggedEvent) {
 	timeStr := strftime.Format("%Y-%m-%d %H:%M:%S%z", time.Now())
-	log := fmt.Sprintf("%s|%s|%s|%s|%s\n", timeStr, le.roleName, le.channel, le.eventType, le.description)
+	roleName := le.roleName
+	if roleName == "AIEvent" {
+		roleName = fmt.Sprintf("AIEvent:%d", le.fromChannel)
+	}
+	log := fmt.Sprintf("%s|%s|%s|%s|%s", timeStr, roleName, le.channel, le.eventType, le.description)
+	if le.sender != "" {
+		// Events forwarded by an MD carry the name of the connection they came from.
+		log += "|" + le.sender
+	}
 
-	_, err := logfile.WriteString(log)
+	_, err := logfile.WriteString(log + "\n")
 	if err != nil {
 		EventLoggerLog.Fatalf("failed to write to logfile: %s", err)
 	}
 	logfile.Sync()
 }
 
-func processPacket(dg Datagram, addr *net.UDPAddr) {
-	dgi := NewDatagramIterator(&dg)
-
+// ReadLoggedEvent decodes an event in the format used by the event logger's UDP socket (without
+// the length prefix), which is also the payload of CONTROL_LOG_MESSAGE.
+func ReadLoggedEvent(dgi *DatagramIterator) (le LoggedEvent, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			if _, ok := r.(DatagramIteratorEOF); ok {
-				EventLoggerLog.Error("Reached end of datagram")
+				err = errors.New("reached end of datagram")
+			} else {
+				panic(r)
 			}
 		}
 	}()
 
-	// Skip length
-	dgi.Skip(2)
 	messageType := dgi.ReadUint16()
+	if messageType == 3 {
+		// Forwarded event; the original event follows the sender's name.
+		sender := dgi.ReadString()
+		le, err = ReadLoggedEvent(dgi)
+		le.sender = sender
+		return le, err
+	}
+
 	serverType := dgi.ReadUint16()
 	fromChannel := dgi.ReadUint32()
 
@@ -114,7 +131,7 @@ func processPacket(dg Datagram, addr *net.UDPAddr) {
 	case 5:
 		serverTypeString = "DatabaseServer"
 	case 6:
-		serverTypeString = fmt.Sprintf("AIEvent:%d", fromChannel)
+		serverTypeString = "AIEvent"
 	case 7:
 		// Other
 		serverTypeString = dgi.ReadString()
@@ -137,16 +154,38 @@ func processPacket(dg Datagram, addr *net.UDPAddr) {
 		objectCount := dgi.ReadUint32()
 		description = fmt.Sprintf("Avatars:%d|TotalObjects:%d", avatarCount, objectCount)
 	default:
-		EventLoggerLog.Errorf("Received unknown message type: %d", messageType)
-		return
+		return le, fmt.Errorf("unknown message type: %d", messageType)
 	}
 
-	le := NewLoggedEvent(eventType, serverTypeString, who, description)
+	le = NewLoggedEvent(eventType, serverTypeString, who, description)
+	le.fromChannel = fromChannel
+	return le, nil
+}
+
+func processPacket(dg Datagram, addr *net.UDPAddr) {
+	dgi := NewDatagramIterator(&dg)
+
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(DatagramIteratorEOF); ok {
+				EventLoggerLog.Error("Reached end of datagram")
+			}
+		}
+	}()
+
+	// Skip length
+	dgi.Skip(2)
+	le, err := ReadLoggedEvent(dgi)
+	if err != nil {
+		EventLoggerLog.Errorf("Received invalid event: %s", err)
+		return
+	}
 	processLoggedEvent(le)
 }
 
 func listen() {
-	buff := make([]byte, 1024)
+	// Events may be as large as a UDP datagram; security events carry a dump of the offending datagram.
+	buff := make([]byte, 65535)
 	for {
 		n, addr, err := server.ReadFromUDP(buff)
 		if err != nil {
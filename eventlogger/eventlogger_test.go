@@ -0,0 +1,66 @@
+package eventlogger
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "otpgo/util"
+)
+
+func TestReadLoggedEvent(t *testing.T) {
+	ai := NewLoggedEvent("ai-crashed", "AIEvent", "4000", "traceback")
+	ai.fromChannel = 400000
+	forwarded := NewLoggedEvent("client-lost", "Client", "1000001", "reset by peer")
+	forwarded.SetSender("ai #1")
+
+	for _, event := range []LoggedEvent{
+		NewLoggedEvent("client-ejected", "ClientAgent", "1000000", "122|bad account"),
+		NewLoggedEvent("lua-error", "LuaRole", "", "attempt to index a nil value"),
+		ai,
+		forwarded,
+	} {
+		dg := event.datagram()
+		read, err := ReadLoggedEvent(NewDatagramIterator(&dg))
+		if err != nil {
+			t.Fatalf("Unable to read back %+v: %s", event, err)
+		}
+		if read != event {
+			t.Errorf("Read back %+v as %+v", event, read)
+		}
+	}
+
+	// Cut off in the middle of fromChannel
+	dg := ai.datagram()
+	truncated := NewDatagram()
+	truncated.Write(dg.Bytes()[:6])
+	if _, err := ReadLoggedEvent(NewDatagramIterator(&truncated)); err == nil {
+		t.Error("Truncated event was read")
+	}
+}
+
+func TestProcessLoggedEvent(t *testing.T) {
+	var err error
+	logfile, err = os.Create(filepath.Join(t.TempDir(), "events.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		logfile.Close()
+		logfile = nil
+	}()
+
+	event := NewLoggedEvent("ai-crashed", "AIEvent", "4000", "traceback")
+	event.fromChannel = 400000
+	event.SetSender("ai #1")
+	processLoggedEvent(event)
+
+	data, err := os.ReadFile(logfile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line := strings.TrimSpace(string(data)); !strings.HasSuffix(line, "|AIEvent:400000|4000|ai-crashed|traceback|ai #1") {
+		t.Errorf("Unexpected log line %q", line)
+	}
+}
@@ -10,11 +10,20 @@ import (
 var senderSocket *net.UDPConn
 var senderLog *log.Entry
 
+// securitySocket receives security events, if they have an event logger of their own.
+var securitySocket *net.UDPConn
+
 type LoggedEvent struct {
 	eventType   string
 	roleName    string
 	channel     string
 	description string
+
+	// fromChannel is the channel of the AI which sent an AIEvent.
+	fromChannel uint32
+
+	// sender is the name of the MD connection the event was forwarded from, if any.
+	sender string
 }
 
 func NewLoggedEvent(eventType string, roleName string, channel string, description string) LoggedEvent {
@@ -27,13 +36,45 @@ func NewLoggedEvent(eventType string, roleName string, channel string, descripti
 	return *le
 }
 
+// SetSender records the name of the MD connection which forwarded the event.
+func (l *LoggedEvent) SetSender(sender string) {
+	l.sender = sender
+}
+
 func (l LoggedEvent) Send() {
 	// processLoggedEvent(l)
-	if senderSocket == nil {
+	l.sendTo(senderSocket)
+}
+
+// SendSecurity sends the event to the security event logger, or to the regular one if there is
+// none.
+func (l LoggedEvent) SendSecurity() {
+	if securitySocket != nil {
+		l.sendTo(securitySocket)
+	} else {
+		l.sendTo(senderSocket)
+	}
+}
+
+func (l LoggedEvent) sendTo(socket *net.UDPConn) {
+	if socket == nil {
 		senderLog.Debug("Not active, not sending.")
 		return
 	}
 
+	eventDg := l.datagram()
+	dg := NewDatagram()
+	dg.AddBlob(&eventDg)
+
+	_, err := socket.Write(dg.Bytes())
+	if err != nil {
+		senderLog.Errorf("Error when attempting to write to UDP socket: %s", err.Error())
+	}
+
+}
+
+// datagram encodes the event as read by ReadLoggedEvent.
+func (l LoggedEvent) datagram() Datagram {
 	var serverType uint16
 	switch l.roleName {
 	case "MessageDirector":
@@ -54,24 +95,20 @@ func (l LoggedEvent) Send() {
 	}
 
 	eventDg := NewDatagram()
-	eventDg.AddUint16(1)          // message type
-	eventDg.AddUint16(serverType) // serverType
-	eventDg.AddUint32(0)          // fromChannel
+	if l.sender != "" {
+		eventDg.AddUint16(3)        // message type (forwarded)
+		eventDg.AddString(l.sender) // sender
+	}
+	eventDg.AddUint16(1)             // message type
+	eventDg.AddUint16(serverType)    // serverType
+	eventDg.AddUint32(l.fromChannel) // fromChannel
 	if serverType == 7 {
 		eventDg.AddString(l.roleName) // roleName
 	}
 	eventDg.AddString(l.eventType)   // eventType
 	eventDg.AddString(l.channel)     // who
 	eventDg.AddString(l.description) // description
-
-	dg := NewDatagram()
-	dg.AddBlob(&eventDg)
-
-	_, err := senderSocket.Write(dg.Bytes())
-	if err != nil {
-		senderLog.Errorf("Error when attempting to write to UDP socket: %s", err.Error())
-	}
-
+	return eventDg
 }
 
 func StartEventSender(address string) {
@@ -83,16 +120,31 @@ func StartEventSender(address string) {
 		senderLog.Debug("Not enabled.")
 	}
 
+	senderSocket = dialEventLogger(address)
+	senderLog.Debug("Started.")
+
+}
+
+// StartSecuritySender sends security events to their own event logger, so that they can be kept
+// apart from the rest.
+func StartSecuritySender(address string) {
+	if securitySocket != nil || address == "" {
+		return
+	}
+
+	securitySocket = dialEventLogger(address)
+	senderLog.Debugf("Sending security events to %s.", address)
+}
+
+func dialEventLogger(address string) *net.UDPConn {
 	addr, err := net.ResolveUDPAddr("udp", address)
 	if err != nil {
 		senderLog.Fatalf("Unable to resolve UDP address \"%s\": %s", address, err.Error())
 	}
 
-	senderSocket, err = net.DialUDP("udp", nil, addr)
+	socket, err := net.DialUDP("udp", nil, addr)
 	if err != nil {
 		senderLog.Fatalf("Unable to dial to UDP address \"%s\": %s", address, err.Error())
 	}
-
-	senderLog.Debug("Started.")
-
+	return socket
 }
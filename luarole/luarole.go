@@ -3,8 +3,6 @@ package luarole
 import (
 	"fmt"
 	"net/http"
-	"os"
-	"os/signal"
 	"otpgo/core"
 	"otpgo/eventlogger"
 	"otpgo/messagedirector"
@@ -25,6 +23,13 @@ type LuaQueueEntry struct {
 	fn     lua.LValue
 	sender Channel_t
 	args   []lua.LValue
+
+	// run is called instead of a Lua function if set.
+	run func()
+
+	// state is the Lua state current when the call was queued, which fn and args come from. Calls
+	// are made on it even if the script has been reloaded since.
+	state *lua.LState
 }
 
 type LuaRole struct {
@@ -44,7 +49,8 @@ type LuaRole struct {
 	getContextMap    *MutexMap[uint32, func(doId Doid_t, dgi *DatagramIterator)]
 	queryContextMap  *MutexMap[uint32, func(dgi *DatagramIterator)]
 
-	L            *lua.LState
+	// L is replaced when the script is reloaded.
+	L            atomic.Pointer[lua.LState]
 	LQueue       []LuaQueueEntry
 	processQueue chan bool
 }
@@ -66,7 +72,6 @@ func NewLuaRole(config core.Role) *LuaRole {
 		createContextMap: NewMutexMap[uint32, func(doId Doid_t)](),
 		getContextMap:    NewMutexMap[uint32, func(doId Doid_t, dgi *DatagramIterator)](),
 		queryContextMap:  NewMutexMap[uint32, func(dgi *DatagramIterator)](),
-		L:                lua.NewState(),
 		LQueue:           []LuaQueueEntry{},
 		processQueue:     make(chan bool),
 	}
@@ -74,46 +79,77 @@ func NewLuaRole(config core.Role) *LuaRole {
 	role.Init(role)
 	role.SetName(name)
 
-	libs.Preload(role.L)
+	role.log.Infof("Running Lua script: %s", role.config.Lua_File)
+	L, err := role.load()
+	if err != nil {
+		role.log.Fatal(err.Error())
+		return nil
+	}
+	role.L.Store(L)
+	core.OnReload(role.Reload)
+
+	go role.queueLoop()
+	return role
+}
+
+// load runs the script in a new Lua state and calls its init function, if there is one.
+func (l *LuaRole) load() (*lua.LState, error) {
+	L := lua.NewState()
+
+	libs.Preload(L)
 	// Replace gopher-lua-libs's crypto module with
 	// gluacrypto since it has more methods.
-	gluacrypto.Preload(role.L)
+	gluacrypto.Preload(L)
 	// Used for web requests within Lua
-	role.L.PreloadModule("http", gluahttp.NewHttpModule(&http.Client{}).Loader)
-	RegisterLuaUtilTypes(role.L)
-	core.RegisterLuaDCTypes(role.L)
-	RegisterLuaParticipantType(role.L)
+	L.PreloadModule("http", gluahttp.NewHttpModule(&http.Client{}).Loader)
+	RegisterLuaUtilTypes(L)
+	core.RegisterLuaDCTypes(L)
+	RegisterLuaParticipantType(L)
 
 	// Set globals
-	role.L.SetGlobal("dcFile", core.NewLuaDCFile(role.L, core.DC))
+	L.SetGlobal("dcFile", core.NewLuaDCFile(L, core.DC))
 
-	role.log.Infof("Running Lua script: %s", role.config.Lua_File)
-	if err := role.L.DoFile(role.config.Lua_File); err != nil {
-		role.log.Fatal(err.Error())
-		return nil
+	if err := L.DoFile(l.config.Lua_File); err != nil {
+		L.Close()
+		return nil, err
 	}
 
 	// Santity check to make sure certian global functions exists:
-	if _, ok := role.L.GetGlobal("handleDatagram").(*lua.LFunction); !ok {
-		role.log.Fatal("Missing \"handleDatagram\" function in Lua script.")
-		return nil
+	if _, ok := L.GetGlobal("handleDatagram").(*lua.LFunction); !ok {
+		L.Close()
+		return nil, fmt.Errorf("missing \"handleDatagram\" function in Lua script")
 	}
 
 	// Call the init function if there's any:
-	if initFunction, ok := role.L.GetGlobal("init").(*lua.LFunction); ok {
-		err := role.L.CallByParam(lua.P{
+	if initFunction, ok := L.GetGlobal("init").(*lua.LFunction); ok {
+		err := L.CallByParam(lua.P{
 			Fn:      initFunction,
 			NRet:    0,
 			Protect: true,
-		}, NewLuaParticipant(role.L, role))
+		}, NewLuaParticipant(L, l))
 		if err != nil {
-			role.log.Fatal(err.Error())
-			return nil
+			L.Close()
+			return nil, err
 		}
 	}
+	return L, nil
+}
 
-	go role.queueLoop()
-	return role
+// Reload loads the script into a new Lua state, which is used for every call queued once it is in
+// place. If the script fails to load, the role keeps its current state.
+func (l *LuaRole) Reload() {
+	l.log.Infof("Reloading Lua script: %s", l.config.Lua_File)
+	l.queue(LuaQueueEntry{run: func() {
+		L, err := l.load()
+		if err != nil {
+			l.log.Errorf("Failed to reload Lua script, keeping the old one: %s", err)
+			eventlogger.NewLoggedEvent("lua-reload-failed", l.Name(), "", err.Error()).Send()
+			return
+		}
+		// The old state isn't closed, as calls queued before the reload are still made on it.
+		l.L.Store(L)
+		l.log.Info("Reloaded Lua script")
+	}})
 }
 
 func (l *LuaRole) getEntryFromQueue() LuaQueueEntry {
@@ -130,18 +166,21 @@ func (l *LuaRole) getEntryFromQueue() LuaQueueEntry {
 	return op
 }
 
+// queueLoop carries on after an interrupt, as post-removes are still routed to the role while
+// the daemon drains.
 func (l *LuaRole) queueLoop() {
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, os.Interrupt)
-
 	for {
 		select {
 		case <-l.processQueue:
 			for len(l.LQueue) > 0 {
 				entry := l.getEntryFromQueue()
+				if entry.run != nil {
+					entry.run()
+					continue
+				}
 				// Store last sender.
 				l.sender = entry.sender
-				err := l.L.CallByParam(lua.P{
+				err := entry.state.CallByParam(lua.P{
 					Fn:      entry.fn,
 					NRet:    0,
 					Protect: true,
@@ -152,8 +191,6 @@ func (l *LuaRole) queueLoop() {
 					event.Send()
 				}
 			}
-		case <-signalCh:
-			return
 		case <-core.StopChan:
 			return
 		}
@@ -161,9 +198,15 @@ func (l *LuaRole) queueLoop() {
 }
 
 func (l *LuaRole) CallLuaFunction(fn lua.LValue, sender Channel_t, args ...lua.LValue) {
-	// Queue the call
+	l.queue(LuaQueueEntry{fn: fn, sender: sender, args: args})
+}
+
+func (l *LuaRole) queue(entry LuaQueueEntry) {
+	if entry.state == nil {
+		entry.state = l.L.Load()
+	}
+
 	l.queueLock.Lock()
-	entry := LuaQueueEntry{fn, sender, args}
 	l.LQueue = append(l.LQueue, entry)
 	l.queueLock.Unlock()
 
@@ -187,11 +230,11 @@ func (l *LuaRole) HandleDatagram(dg Datagram, dgi *DatagramIterator) {
 		l.handleGetStoredValuesResp(dgi)
 	default:
 		// Let Lua handle it.
-		l.CallLuaFunction(l.L.GetGlobal("handleDatagram"), sender,
+		l.CallLuaFunction(l.L.Load().GetGlobal("handleDatagram"), sender,
 			// Arguments:
-			NewLuaParticipant(l.L, l),
+			NewLuaParticipant(l.L.Load(), l),
 			lua.LNumber(msgType),
-			NewLuaDatagramIteratorFromExisting(l.L, dgi))
+			NewLuaDatagramIteratorFromExisting(l.L.Load(), dgi))
 	}
 }
 
@@ -318,7 +361,7 @@ func (l *LuaRole) handleUpdateField(dgi *DatagramIterator, className string) {
 		return
 	}
 
-	lFunc := l.L.GetGlobal(fmt.Sprintf("handle%s_%s", dclass.GetName(), dcField.GetName()))
+	lFunc := l.L.Load().GetGlobal(fmt.Sprintf("handle%s_%s", dclass.GetName(), dcField.GetName()))
 	if lFunc.Type() != lua.LTFunction {
 		l.log.Warnf("Function \"handle%s_%s\" does not exist in Lua file!", className, dcField.GetName())
 		return
@@ -329,12 +372,12 @@ func (l *LuaRole) handleUpdateField(dgi *DatagramIterator, className string) {
 
 	unpacker.SetUnpackData(packedData)
 	unpacker.BeginUnpack(dcField)
-	lValue := core.UnpackDataToLuaValue(unpacker, l.L)
+	lValue := core.UnpackDataToLuaValue(unpacker, l.L.Load())
 	if !unpacker.EndUnpack() {
 		l.log.Warnf("EndUnpack returned false on handleUpdateField somehow...\n%s", DumpUnpacker(unpacker))
 		return
 	}
-	l.CallLuaFunction(lFunc, l.sender, NewLuaParticipant(l.L, l), lua.LNumber(fieldId), lValue)
+	l.CallLuaFunction(lFunc, l.sender, NewLuaParticipant(l.L.Load(), l), lua.LNumber(fieldId), lValue)
 }
 
 func (l *LuaRole) sendUpdateToChannel(channel Channel_t, fromDoId Doid_t, className string, fieldName string, value lua.LValue) {
@@ -0,0 +1,89 @@
+package luarole
+
+import (
+	"os"
+	"os/signal"
+	"otpgo/core"
+	"otpgo/messagedirector"
+	. "otpgo/test"
+	. "otpgo/util"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	lua "github.com/yuin/gopher-lua"
+)
+
+func TestMain(m *testing.M) {
+	core.Config = &core.ServerConfig{}
+	core.Config.MessageDirector.Bind = "127.0.0.1:57140"
+	messagedirector.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	os.Exit(m.Run())
+}
+
+// newTestRole runs a role whose script counts the datagrams it handles by message type.
+func newTestRole(t *testing.T) *LuaRole {
+	file := filepath.Join(t.TempDir(), "role.lua")
+	require.NoError(t, os.WriteFile(file, []byte(`
+		received = {}
+		function handleDatagram(participant, msgType, dgi)
+			received[msgType] = (received[msgType] or 0) + 1
+		end
+	`), 0600))
+	return NewLuaRole(core.Role{Lua_File: file, Name: "Test role"})
+}
+
+// received reads how many datagrams of a type the role's script has handled, from its queue loop.
+func (l *LuaRole) received(t *testing.T, msgType uint16) int {
+	count := make(chan int)
+	l.queue(LuaQueueEntry{run: func() {
+		received := l.L.Load().GetGlobal("received").(*lua.LTable)
+		n, _ := received.RawGetInt(int(msgType)).(lua.LNumber)
+		count <- int(n)
+	}})
+
+	select {
+	case n := <-count:
+		return n
+	case <-time.After(time.Second):
+		t.Fatal("Role's queue loop has stopped")
+		return 0
+	}
+}
+
+func TestLuaRole_PostRemoveAfterInterrupt(t *testing.T) {
+	role := newTestRole(t)
+	role.SubscribeChannel(4000)
+
+	// A connection leaves a post-remove for the role behind
+	pr := NewDatagram()
+	pr.AddServerHeader(4000, 5000, CLIENTAGENT_EJECT)
+	dg := NewDatagram()
+	dg.AddControlHeader(CONTROL_ADD_POST_REMOVE)
+	dg.AddBlob(&pr)
+
+	conn := (&TestMDConnection{}).Connect("127.0.0.1:57140", "post-remove")
+	conn.SendDatagram(dg)
+	time.Sleep(50 * time.Millisecond)
+
+	// An interrupt drains the daemon, which disconnects everything before it exits
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt)
+	defer signal.Stop(interrupted)
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGINT))
+	select {
+	case <-interrupted:
+	case <-time.After(time.Second):
+		t.Fatal("Interrupt was not delivered")
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	// The role still handles what is routed to it meanwhile
+	conn.Close(false)
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, role.received(t, CLIENTAGENT_EJECT))
+}
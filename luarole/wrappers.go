@@ -410,7 +410,7 @@ func LuaQueryObjectFields(L *lua.LState) int {
 
 	if len(fieldIds) == 0 {
 		participant.log.Warnf("queryObjectFields: Nothing to do for class \"%s\"!", clsName)
-		participant.CallLuaFunction(callback, senderContext, lua.LNumber(doId), lua.LTrue, participant.L.NewTable())
+		participant.CallLuaFunction(callback, senderContext, lua.LNumber(doId), lua.LTrue, participant.L.Load().NewTable())
 		return 1
 	}
 
@@ -432,7 +432,7 @@ func LuaQueryObjectFields(L *lua.LState) int {
 		found := len(fields)
 		participant.log.Debugf("queryObjectFields: Found %d fields for %s(%d)", found, clsName, doId)
 
-		fieldTable := participant.L.NewTable()
+		fieldTable := participant.L.Load().NewTable()
 
 		DCLock.Lock()
 		defer DCLock.Unlock()
@@ -452,7 +452,7 @@ func LuaQueryObjectFields(L *lua.LState) int {
 				continue
 			}
 			unpacker.BeginUnpack(field)
-			lValue := core.UnpackDataToLuaValue(unpacker, participant.L)
+			lValue := core.UnpackDataToLuaValue(unpacker, participant.L.Load())
 			if !unpacker.EndUnpack() {
 				participant.log.Warnf("queryObjectFields: Unable to unpack field \"%s\"!\n%s", field.GetName(), DumpUnpacker(unpacker))
 				continue
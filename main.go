@@ -18,6 +18,8 @@ import (
 	"path"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/apex/log"
 	"github.com/carlmjohnson/versioninfo"
@@ -26,6 +28,9 @@ import (
 
 var mainLog *log.Entry
 
+// mdFlushTimeout bounds how long the daemon waits for the MD to route what was left after draining.
+const mdFlushTimeout = 5 * time.Second
+
 func init() {
 	log.SetHandler(core.Log)
 	log.SetLevel(log.DebugLevel)
@@ -36,9 +41,45 @@ func init() {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		replay(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "reload" {
+		reload(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "drain" {
+		drain(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ban" {
+		ban(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "unban" {
+		unban(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "capture" {
+		capture(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "decode" {
+		decode(os.Args[2:])
+		return
+	}
+
 	pflag.Usage = func() {
 		fmt.Printf(
 			`Usage:    otpgo [options]... [CONFIG_FILE]
+          otpgo replay [options]... RECORDING [CONFIG_FILE]
+          otpgo reload [options]... [CONFIG_FILE]
+          otpgo drain [options]... [CONFIG_FILE]
+          otpgo ban [options]... ADDRESS [CONFIG_FILE]
+          otpgo unban [options]... ADDRESS [CONFIG_FILE]
+          otpgo capture [options]... CHANNEL [CONFIG_FILE]
+          otpgo decode [options]... CAPTURE [CONFIG_FILE]
 
       OtpGo is an OTP (Online Theme Park) server written in Go.
       By default OtpGo looks for a configuration file in the current
@@ -50,6 +91,15 @@ func main() {
       -L, --log       Specify a file to write log messages to.
       -l, --loglevel  Specify the minimum log level that should be logged;
                         Error and Fatal levels will always be logged.
+
+      Sending SIGHUP to OtpGo reloads the Lua scripts of every
+      ClientAgent and Lua role, as does "otpgo reload".  SIGINT and
+      SIGTERM drain the clients of every ClientAgent before exiting;
+      "otpgo drain" drains them ahead of time.  A second SIGINT or
+      SIGTERM exits at once.  "otpgo ban" and "otpgo unban" edit the
+      ban lists of the ClientAgents of a running OtpGo.
+
+      Run "otpgo replay --help" for details on replaying MD recordings.
 `)
 		os.Exit(1)
 	}
@@ -103,8 +153,13 @@ Revision: %s
 		log.SetHandler(handler)
 	}
 
+	startDaemon(pflag.Args())
+	waitForInterrupt()
+}
+
+// loadConfig loads the configuration file named by args, if any.
+func loadConfig(args []string) {
 	var configPath, configName string
-	args := pflag.Args()
 	if len(args) > 0 {
 		configName = filepath.Base(args[0])
 		configName = strings.TrimSuffix(configName, path.Ext(configName))
@@ -119,7 +174,16 @@ Revision: %s
 	if err := core.LoadConfig(configPath, configName); err != nil {
 		mainLog.Fatal(err.Error())
 	}
+}
+
+// startDaemon loads the configuration file named by args, if any, and starts every configured role.
+func startDaemon(args []string) {
+	loadConfig(args)
+	runDaemon()
+}
 
+// runDaemon starts every role of the loaded configuration.
+func runDaemon() {
 	if err := core.LoadDC(); err != nil {
 		mainLog.Fatal(err.Error())
 	}
@@ -135,6 +199,7 @@ Revision: %s
 	}
 
 	eventlogger.StartEventSender(core.Config.General.Eventlogger)
+	eventlogger.StartSecuritySender(core.Config.General.Security_Eventlogger)
 	messagedirector.Start()
 
 	// Configure UberDOG list
@@ -170,10 +235,38 @@ Revision: %s
 		}
 	}
 
-	c := make(chan os.Signal)
-	signal.Notify(c, os.Interrupt)
+	go reloadOnHangup()
+}
+
+// reloadOnHangup reloads the Lua scripts whenever the process receives SIGHUP.
+func reloadOnHangup() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	for range c {
+		mainLog.Info("Got SIGHUP, reloading Lua scripts...")
+		core.ReloadLua()
+	}
+}
+
+// waitForInterrupt drains the daemon and exits once it is interrupted.
+func waitForInterrupt() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 
 	sig := <-c
-	mainLog.Fatal(fmt.Sprintf("Got %s signal. Aborting...", sig))
-	os.Exit(1)
+	mainLog.Infof("Got %s signal. Draining clients...", sig)
+	go func() {
+		sig := <-c
+		mainLog.Fatal(fmt.Sprintf("Got %s signal. Aborting...", sig))
+		os.Exit(1)
+	}()
+
+	core.Drain(0)
+	if !messagedirector.MD.Flush(mdFlushTimeout) {
+		mainLog.Warn("Timed out waiting for the MD to route everything")
+	}
+	messagedirector.MD.CloseRecorder()
+	mainLog.Info("Exiting")
+	os.Exit(0)
 }
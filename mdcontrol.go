@@ -0,0 +1,54 @@
+package main
+
+import (
+	"crypto/tls"
+	gonet "net"
+	"otpgo/core"
+	"otpgo/net"
+	"otpgo/util"
+)
+
+// sendControlMessage connects to the MD at address as configured in the loaded configuration file,
+// authenticating if the MD has a secret, and sends it a control message, or any other datagram
+// for it to route.
+func sendControlMessage(address string, dg util.Datagram) {
+	config := core.Config.MessageDirector
+
+	var conn gonet.Conn
+	var err error
+	if config.TLS.Enabled {
+		var tlsConfig *tls.Config
+		tlsConfig, err = net.NewTLSConfig(config.TLS.Cert, config.TLS.Key, config.TLS.Ca, false)
+		if err != nil {
+			mainLog.Fatalf("Unable to set up TLS: %s", err)
+		}
+		network, addr := net.SplitAddress(address)
+		if host, _, err := gonet.SplitHostPort(addr); err == nil {
+			tlsConfig.ServerName = host
+		}
+		conn, err = tls.Dial(network, addr, tlsConfig)
+	} else {
+		conn, err = net.Dial(address)
+	}
+	if err != nil {
+		mainLog.Fatalf("Unable to connect to the MD at %s: %s", address, err)
+	}
+	defer conn.Close()
+
+	var datagrams []util.Datagram
+	if config.Secret != "" {
+		auth := util.NewDatagram()
+		auth.AddControlHeader(util.CONTROL_AUTHENTICATE)
+		auth.AddString(config.Secret)
+		datagrams = append(datagrams, auth)
+	}
+	datagrams = append(datagrams, dg)
+
+	for _, dg := range datagrams {
+		frame := util.NewDatagram()
+		frame.AddBlob(&dg)
+		if _, err := conn.Write(frame.Bytes()); err != nil {
+			mainLog.Fatalf("Unable to send to the MD at %s: %s", address, err)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package messagedirector
+
+import (
+	"crypto/tls"
+	"fmt"
+	gonet "net"
+	"otpgo/core"
+	. "otpgo/util"
+	"sort"
+	"strings"
+)
+
+// channelACL restricts which channels a connection may subscribe and send to.
+type channelACL struct {
+	network  *gonet.IPNet
+	unix     bool
+	identity string
+
+	// subscribe and send are sorted and non-overlapping.
+	subscribe []Range
+	send      []Range
+
+	// disconnect drops connections which violate the ACL; otherwise only the offending datagram is dropped.
+	disconnect bool
+	// admin allows the connection to query participants, reload Lua, drain clients, ban addresses and
+	// capture clients.
+	admin bool
+}
+
+func newChannelACL(config core.ACL) (*channelACL, error) {
+	acl := &channelACL{identity: config.Identity, admin: config.Admin}
+
+	if config.Address == "unix" {
+		acl.unix = true
+	} else if config.Address != "" {
+		address := config.Address
+		if !strings.Contains(address, "/") {
+			if ip := gonet.ParseIP(address); ip != nil && ip.To4() == nil {
+				address += "/128"
+			} else {
+				address += "/32"
+			}
+		}
+		_, network, err := gonet.ParseCIDR(address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address \"%s\": %v", config.Address, err)
+		}
+		acl.network = network
+	}
+
+	for _, rng := range config.Subscribe {
+		acl.subscribe = addRange(acl.subscribe, Range{rng.Min, rng.Max})
+	}
+	for _, rng := range config.Send {
+		acl.send = addRange(acl.send, Range{rng.Min, rng.Max})
+	}
+
+	switch config.Violation {
+	case "", "drop":
+	case "disconnect":
+		acl.disconnect = true
+	default:
+		return nil, fmt.Errorf("unknown violation policy \"%s\"", config.Violation)
+	}
+	return acl, nil
+}
+
+// matches returns whether the ACL applies to a connection. The TLS handshake has to be complete
+// for the connection's identity to be known.
+func (a *channelACL) matches(conn gonet.Conn) bool {
+	if a.unix {
+		if _, ok := conn.RemoteAddr().(*gonet.UnixAddr); !ok {
+			return false
+		}
+	} else if a.network != nil {
+		addr, ok := conn.RemoteAddr().(*gonet.TCPAddr)
+		if !ok || !a.network.Contains(addr.IP) {
+			return false
+		}
+	}
+
+	if a.identity != "" {
+		return connIdentity(conn) == a.identity
+	}
+	return true
+}
+
+// connIdentity returns the common name of the certificate a connection authenticated with, if any.
+func connIdentity(conn gonet.Conn) string {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	certs := tlsConn.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return ""
+	}
+	return certs[0].Subject.CommonName
+}
+
+func (a *channelACL) canSubscribe(rng Range) bool {
+	return containsRange(a.subscribe, rng)
+}
+
+func (a *channelACL) canSend(ch Channel_t) bool {
+	return containsRange(a.send, Range{ch, ch})
+}
+
+// containsRange returns whether a range lies entirely within a sorted list of non-overlapping ranges.
+func containsRange(ranges []Range, rng Range) bool {
+	i := sort.Search(len(ranges), func(i int) bool {
+		return ranges[i].Max >= rng.Min
+	})
+	return i < len(ranges) && ranges[i].Min <= rng.Min && ranges[i].Max >= rng.Max
+}
+
+// setAccess replaces the secret and ACLs that connections are checked against. Connections which
+// have already been checked keep what they were given.
+func (m *MessageDirector) setAccess(secret string, acls []*channelACL, defaultACL *channelACL) {
+	m.accessLock.Lock()
+	defer m.accessLock.Unlock()
+	m.secret, m.acls, m.defaultACL = secret, acls, defaultACL
+}
+
+func (m *MessageDirector) getSecret() string {
+	m.accessLock.RLock()
+	defer m.accessLock.RUnlock()
+	return m.secret
+}
+
+// lookupACL returns the first ACL matching a connection, or the default ACL if none does; nil
+// means the connection is unrestricted.
+func (m *MessageDirector) lookupACL(conn gonet.Conn) *channelACL {
+	m.accessLock.RLock()
+	defer m.accessLock.RUnlock()
+
+	for _, acl := range m.acls {
+		if acl.matches(conn) {
+			return acl
+		}
+	}
+	return m.defaultACL
+}
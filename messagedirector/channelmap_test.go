@@ -0,0 +1,137 @@
+package messagedirector
+
+import (
+	"fmt"
+	. "otpgo/util"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+type benchParticipant struct {
+	MDParticipantBase
+	received int
+}
+
+func (b *benchParticipant) HandleDatagram(dg Datagram, dgi *DatagramIterator) {
+	b.received++
+}
+
+func newBenchSubscriber() *Subscriber {
+	p := &benchParticipant{}
+	sub := &Subscriber{participant: p, active: true}
+	sub.Init()
+	p.subscriber = sub
+	return sub
+}
+
+func TestRangeMap_Segments(t *testing.T) {
+	rm := NewRangeMap()
+	a, b := newBenchSubscriber(), newBenchSubscriber()
+
+	rm.Add(Range{1000, 1999}, a)
+	rm.Add(Range{1500, 2500}, b)
+	require.Len(t, rm.segments, 3)
+	require.ElementsMatch(t, rm.Lookup(1000), []*Subscriber{a})
+	require.ElementsMatch(t, rm.Lookup(1999), []*Subscriber{a, b})
+	require.ElementsMatch(t, rm.Lookup(2500), []*Subscriber{b})
+	require.Empty(t, rm.Lookup(999))
+	require.Empty(t, rm.Lookup(2501))
+
+	// Removing the middle of A's range only silences what B doesn't cover.
+	require.Equal(t, []Range{{1300, 1499}}, rm.Remove(Range{1300, 1700}, a))
+	require.Empty(t, rm.Lookup(1400))
+	require.ElementsMatch(t, rm.Lookup(1600), []*Subscriber{b})
+
+	// Re-adding the hole coalesces everything back into the original segments.
+	rm.Add(Range{1300, 1700}, a)
+	require.Len(t, rm.segments, 3)
+
+	require.Equal(t, []Range{{1000, 1499}}, rm.Remove(Range{0, 1999}, a))
+	require.Equal(t, []Range{{1500, 2500}}, rm.Remove(Range{1500, 2500}, b))
+	require.Empty(t, rm.segments)
+
+	// The end of the channel space must not overflow.
+	rm.Add(Range{CHANNEL_MAX - 10, CHANNEL_MAX}, a)
+	rm.Add(Range{CHANNEL_MAX - 5, CHANNEL_MAX}, b)
+	require.ElementsMatch(t, rm.Lookup(CHANNEL_MAX), []*Subscriber{a, b})
+	require.Equal(t, []Range{{CHANNEL_MAX - 10, CHANNEL_MAX - 6}}, rm.Remove(Range{0, CHANNEL_MAX}, a))
+	require.Equal(t, []Range{{CHANNEL_MAX - 5, CHANNEL_MAX}}, rm.Remove(Range{0, CHANNEL_MAX}, b))
+}
+
+func TestRangeMap_RangeLists(t *testing.T) {
+	ranges := addRange(nil, Range{10, 20})
+	ranges = addRange(ranges, Range{30, 40})
+	ranges = addRange(ranges, Range{21, 29})
+	require.Equal(t, []Range{{10, 40}}, ranges)
+
+	ranges = removeRange(ranges, Range{15, 35})
+	require.Equal(t, []Range{{10, 14}, {36, 40}}, ranges)
+}
+
+// Every subscriber listens to its own range and a handful of shared ones, which is roughly
+// what a cluster of CAs, DBSSes and AIs looks like.
+func populateChannelMap(subscribers int, rangesPerSub int) *ChannelMap {
+	cm := &ChannelMap{}
+	cm.init()
+
+	for n := 0; n < subscribers; n++ {
+		sub := newBenchSubscriber()
+		for r := 0; r < rangesPerSub; r++ {
+			lo := Channel_t(n*rangesPerSub+r) * 1000
+			cm.ranges.Add(Range{lo, lo + 499}, sub)
+			sub.ranges = addRange(sub.ranges, Range{lo, lo + 499})
+		}
+		ch := Channel_t(n)*1000 + 750
+		cm.subscriptions.Set(ch, []*Subscriber{sub}, false)
+		sub.channels[ch] = struct{}{}
+	}
+	return cm
+}
+
+func BenchmarkRangeMap_Lookup(b *testing.B) {
+	for _, subs := range []int{10, 100, 1000, 10000} {
+		b.Run(fmt.Sprintf("subscribers=%d", subs), func(b *testing.B) {
+			cm := populateChannelMap(subs, 4)
+			space := Channel_t(subs * 4 * 1000)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				cm.ranges.Lookup(Channel_t(i*7919) % space)
+			}
+		})
+	}
+}
+
+func BenchmarkChannelMap_Send(b *testing.B) {
+	dg := NewDatagram()
+	dg.AddServerHeader(0, 0, 0)
+	for _, subs := range []int{10, 100, 1000, 10000} {
+		b.Run(fmt.Sprintf("subscribers=%d", subs), func(b *testing.B) {
+			cm := populateChannelMap(subs, 4)
+			space := Channel_t(subs * 4 * 1000)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				ch := Channel_t(i*7919) % space
+				mdDg := &MDDatagram{dg: NewDatagramIterator(&dg)}
+				cm.Send(ch, mdDg)
+				cm.Send(ch+250, mdDg)
+			}
+		})
+	}
+}
+
+func BenchmarkRangeMap_Subscribe(b *testing.B) {
+	for _, ranges := range []int{100, 1000, 10000} {
+		b.Run(fmt.Sprintf("ranges=%d", ranges), func(b *testing.B) {
+			cm := populateChannelMap(ranges/4, 4)
+			sub := newBenchSubscriber()
+			space := Channel_t(ranges * 1000)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				lo := Channel_t(i*7919) % space
+				cm.ranges.Add(Range{lo, lo + 2000}, sub)
+				cm.ranges.Remove(Range{lo, lo + 2000}, sub)
+			}
+		})
+	}
+}
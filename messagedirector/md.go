@@ -3,17 +3,50 @@ package messagedirector
 import (
 	"fmt"
 	gonet "net"
-	"os"
-	"os/signal"
 	"otpgo/core"
 	"otpgo/net"
 	. "otpgo/util"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/apex/log"
+	"github.com/jehiah/go-strftime"
 )
 
+const (
+	defaultParticipantQueueLimit = 4096
+	defaultTotalQueueLimit       = 65536
+	defaultOutboundBuffer        = 1024
+
+	// tlsHandshakeTimeout bounds the TLS handshake of links with other MDs, in either direction.
+	tlsHandshakeTimeout = 10 * time.Second
+)
+
+// slowConsumerPolicy is what happens to a connection once its outbound buffer is full.
+type slowConsumerPolicy int
+
+const (
+	slowConsumerBlock slowConsumerPolicy = iota
+	slowConsumerDrop
+	slowConsumerDisconnect
+)
+
+var slowConsumerPolicies = map[string]slowConsumerPolicy{
+	"block":      slowConsumerBlock,
+	"drop":       slowConsumerDrop,
+	"disconnect": slowConsumerDisconnect,
+}
+
+func (p slowConsumerPolicy) String() string {
+	for name, policy := range slowConsumerPolicies {
+		if policy == p {
+			return name
+		}
+	}
+	return "unknown"
+}
+
 type QueueEntry struct {
 	dg Datagram
 	md MDParticipant
@@ -37,16 +70,28 @@ type MessageDirector struct {
 	// previousAllocatedParticipantId was the last ID assigned when a participant needed a fresh ID.
 	previousAllocatedParticipantId atomic.Uint32
 
-	// MD participants may directly queue datagrams to be routed by adding it into the
-	// queue map, where they will be processed asynchronously
-	Queue                       map[uint32][]QueueEntry
-	queueLock                   sync.Mutex
-	queueCurrentPosition        atomic.Uint32
-	queuePreviousStoredPosition atomic.Uint32
-
-	// RouteDatagram will insert to this channel to let the queue loop know there are
-	// datagrams to be processed.
-	shouldProcess chan bool
+	// MD participants queue datagrams to be routed through the router, which processes them
+	// asynchronously and concurrently while preserving the order of each participant's datagrams.
+	router *Router
+
+	// Datagrams are written to connections from a buffer of outboundBuffer datagrams; once it is full,
+	// slowConsumer decides whether routing waits for the connection, skips it or drops it. Waiting
+	// holds up the read loops of the connections routing to it, so two MDs linked to each other
+	// can stall one another under the block policy.
+	outboundBuffer int
+	slowConsumer   slowConsumerPolicy
+
+	// If secret is set, connections must authenticate with it before they may send anything else.
+	// accessLock guards secret and the ACLs, which may be replaced while connections are open.
+	accessLock sync.RWMutex
+	secret     string
+	// acls restrict what connections may subscribe and send to; the first one that matches applies.
+	// Connections matching none get defaultACL, which is nil if they are unrestricted.
+	acls       []*channelACL
+	defaultACL *channelACL
+
+	// If recorder is set, every datagram routed through the MD is written to it.
+	recorder *Recorder
 
 	// If an MD is configurated to be upstream, it will connect to the downstream MD and route channelmap
 	// events through it. Clients subscribing to channels that reside in other parts of the network will
@@ -63,10 +108,61 @@ func init() {
 
 func Start() {
 	MD = &MessageDirector{}
-	MD.Queue = make(map[uint32][]QueueEntry)
-	MD.queueCurrentPosition.Store(1)
-	MD.queuePreviousStoredPosition.Store(0)
-	MD.shouldProcess = make(chan bool)
+	config := core.Config.MessageDirector
+	if config.Queue.Participant_Limit == 0 {
+		config.Queue.Participant_Limit = defaultParticipantQueueLimit
+	}
+	if config.Queue.Total_Limit == 0 {
+		config.Queue.Total_Limit = defaultTotalQueueLimit
+	}
+	if config.Queue.Outbound_Buffer == 0 {
+		config.Queue.Outbound_Buffer = defaultOutboundBuffer
+	}
+	if config.Queue.Slow_Consumer == "" {
+		config.Queue.Slow_Consumer = "disconnect"
+	}
+
+	policy, ok := slowConsumerPolicies[config.Queue.Slow_Consumer]
+	if !ok {
+		MDLog.Fatalf("Unknown slow consumer policy \"%s\"", config.Queue.Slow_Consumer)
+	}
+	MD.slowConsumer = policy
+	MD.outboundBuffer = config.Queue.Outbound_Buffer
+
+	MD.router = NewRouter(MD, config.Workers, config.Queue.Participant_Limit, config.Queue.Total_Limit)
+	if config.Record != "" {
+		path := strftime.Format(config.Record, time.Now())
+		recorder, err := NewRecorder(path)
+		if err != nil {
+			MDLog.Fatalf("Unable to open recording: %s", err)
+		}
+		MD.recorder = recorder
+		MDLog.Infof("Recording routed datagrams to %s", path)
+	}
+	var acls []*channelACL
+	for n, aclConfig := range config.ACLs {
+		acl, err := newChannelACL(aclConfig)
+		if err != nil {
+			MDLog.Fatalf("Invalid ACL #%d: %s", n+1, err)
+		}
+		acls = append(acls, acl)
+	}
+	var defaultACL *channelACL
+	switch config.Default_ACL {
+	case "", "allow":
+	case "deny":
+		defaultACL = &channelACL{}
+	default:
+		MDLog.Fatalf("Unknown default ACL \"%s\"", config.Default_ACL)
+	}
+	MD.setAccess(config.Secret, acls, defaultACL)
+	if config.TLS.Enabled {
+		tlsConfig, err := net.NewTLSConfig(config.TLS.Cert, config.TLS.Key, config.TLS.Ca, true)
+		if err != nil {
+			MDLog.Fatalf("Unable to set up TLS: %s", err)
+		}
+		MD.TLSConfig = tlsConfig
+	}
 	MD.participants = NewMutexMap[uint32, MDParticipant]()
 	MD.freeParticipantIds = NewMutexMap[uint32, bool]()
 	MD.previousAllocatedParticipantId.Store(0)
@@ -90,7 +186,7 @@ func Start() {
 		go MD.Start(bindAddr, errChan, false)
 	}
 
-	go MD.queueLoop()
+	MD.router.Start()
 
 	connectAddr := core.Config.MessageDirector.Connect
 	if connectAddr != "" {
@@ -98,102 +194,6 @@ func Start() {
 	}
 }
 
-func (m *MessageDirector) queueIsEmpty() bool {
-	m.queueLock.Lock()
-	defer m.queueLock.Unlock()
-
-	// If we have no entries at all, return true.
-	if len(MD.Queue) == 0 {
-		return true
-	}
-
-	// Otherwise, check the rest of the entries for datagrams.
-	for _, entry := range MD.Queue {
-		if len(entry) > 0 {
-			return false
-		}
-	}
-
-	// If we got here, no entries have datagrams.
-	return true
-}
-
-func (m *MessageDirector) getDatagramFromQueue() QueueEntry {
-	m.queueLock.Lock()
-	defer m.queueLock.Unlock()
-	curPos := MD.queueCurrentPosition.Load()
-	_, ok := MD.Queue[curPos]
-	hasDgs := ok && len(MD.Queue[curPos]) > 0
-
-	for !hasDgs {
-		// At this point, the first entry has run out of datagrams, so we will delete the entry and move on.
-		delete(MD.Queue, curPos)
-		curPos = MD.queueCurrentPosition.Add(1)
-		_, ok = MD.Queue[curPos]
-		hasDgs = ok && len(MD.Queue[curPos]) > 0
-	}
-
-	obj := MD.Queue[curPos][0]
-	MD.Queue[curPos] = MD.Queue[curPos][1:]
-	return obj
-}
-
-func (m *MessageDirector) queueLoop() {
-	finish := make(chan bool)
-	signalCh := make(chan os.Signal, 1)
-	signal.Notify(signalCh, os.Interrupt)
-
-	for {
-		select {
-		case <-MD.shouldProcess:
-			for !m.queueIsEmpty() {
-				obj := m.getDatagramFromQueue()
-				go func() {
-					// We are running in a goroutine so that our main read loop will not crash if a datagram EOF is thrown.
-					defer func() {
-						if r := recover(); r != nil {
-							if _, ok := r.(DatagramIteratorEOF); ok {
-								MDLog.Error("Reached end of datagram")
-								// TODO
-							}
-							finish <- true
-						}
-					}()
-
-					// Iterate the datagram for receivers
-					var receivers []Channel_t
-					dgi := NewDatagramIterator(&obj.dg)
-					chanCount := dgi.ReadUint8()
-					for n := 0; uint8(n) < chanCount; n++ {
-						receivers = append(receivers, dgi.ReadChannel())
-					}
-
-					// MDLog.Debugf("Routing datagram to channels: %v", receivers)
-
-					// Send payload datagram to every available receiver
-					seekDgi := NewDatagramIterator(&obj.dg)
-					seekDgi.Seek(dgi.Tell())
-					mdDg := &MDDatagram{dg: seekDgi, sender: obj.md}
-					for _, recv := range receivers {
-						channelMap.Send(recv, mdDg)
-					}
-
-					// Send message upstream if necessary
-					if obj.md != nil && m.upstream != nil {
-						m.upstream.HandleDatagram(obj.dg, nil)
-					}
-					finish <- true
-				}()
-				<-finish
-			}
-		case <-signalCh:
-			return
-		case <-core.StopChan:
-			return
-		}
-	}
-}
-
 // AddChannel and similar functions subscribe an upstream MD to events that may occur downstream regarding
 // objects that exist in the upstream's channel map.
 func (m *MessageDirector) AddChannel(ch Channel_t) {
@@ -221,24 +221,55 @@ func (m *MessageDirector) RemoveRange(lo Channel_t, hi Channel_t) {
 }
 
 func (m *MessageDirector) HandleConnect(conn gonet.Conn) {
-	MDLog.Infof("Incoming connection from %s", conn.RemoteAddr())
-	NewMDParticipant(conn)
+	MDLog.Infof("Incoming connection from %s", net.RemoteName(conn))
+	if m.TLSConfig == nil {
+		NewMDParticipant(conn)
+		return
+	}
+
+	// Connections are accepted one at a time, so the handshake can't hold up the listener.
+	go func() {
+		if err := net.Handshake(conn, tlsHandshakeTimeout); err != nil {
+			MDLog.Warnf("TLS handshake with %s failed: %s", net.RemoteName(conn), err)
+			conn.Close()
+			return
+		}
+		NewMDParticipant(conn)
+	}()
 }
 
 func (m *MessageDirector) PreroutePostRemove(pr Datagram) {
 	if m.upstream != nil {
-		dg := NewDatagram()
-		dg.AddControlHeader(CONTROL_ADD_POST_REMOVE)
-		dg.AddBlob(&pr)
-		m.upstream.HandleDatagram(dg, nil)
+		m.upstream.AddPostRemove(pr)
 	}
 }
 
 func (m *MessageDirector) RecallPostRemoves() {
 	if m.upstream != nil {
-		dg := NewDatagram()
-		dg.AddControlHeader(CONTROL_CLEAR_POST_REMOVES)
-		m.upstream.HandleDatagram(dg, nil)
+		m.upstream.ClearPostRemoves()
+	}
+}
+
+// Flush waits until every queued datagram has been routed and written to the upstream MD, for at
+// most timeout; it returns whether it got there.
+func (m *MessageDirector) Flush(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !m.router.Idle() || (m.upstream != nil && !m.upstream.Idle()) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// CloseRecorder writes out and closes the recording, if there is one. It should be called once
+// the MD has been flushed, so that nothing routed is left out of it.
+func (m *MessageDirector) CloseRecorder() {
+	if m.recorder != nil {
+		if err := m.recorder.Close(); err != nil {
+			MDLog.Errorf("Unable to close the recording: %s", err)
+		}
 	}
 }
 
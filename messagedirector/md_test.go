@@ -3,40 +3,46 @@
 package messagedirector
 
 import (
+	"fmt"
+	"io"
 	"otpgo/core"
+	"otpgo/net"
 	. "otpgo/test"
 	. "otpgo/util"
 	// "github.com/apex/log"
 	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
 var mainClient, client1, client2 *TestMDConnection
+var upstream *UpstreamHandler
 
 func TestMain(m *testing.M) {
 	// SETUP
 	// Silence the (very annoying) logger while we're testing
 	// log.SetHandler(log.HandlerFunc(func(*log.Entry) error { return nil }))
-	upstream := StartUpstream("127.0.0.1:57124")
+	upstream = StartUpstream("127.0.0.1:57124")
 
 	time.Sleep(100 * time.Millisecond)
 
-	StartDaemon(
-		core.ServerConfig{MessageDirector: struct {
-			Bind    string
-			Connect string
-		}{Bind: "127.0.0.1:57123", Connect: "127.0.0.1:57124"}})
+	config := core.ServerConfig{}
+	config.MessageDirector.Bind = "127.0.0.1:57123"
+	config.MessageDirector.Connect = "127.0.0.1:57124"
+	config.MessageDirector.Workers = 4
+	config.MessageDirector.Reconnect.Min_Delay = 50
+	StartDaemon(config)
 	Start()
 
 	time.Sleep(100 * time.Millisecond)
 
-	for {
-		if upstream.Server != nil {
-			break
-		}
+	conn := upstream.Accept(time.Second)
+	if conn == nil {
+		panic("MD never connected to the upstream")
 	}
-	mainClient = (&TestMDConnection{}).Set(*upstream.Server, "main")
+	mainClient = (&TestMDConnection{}).Set(conn, "main")
 
 	client1 = (&TestMDConnection{}).Connect(":57123", "client #1")
 	client2 = (&TestMDConnection{}).Connect(":57123", "client #2")
@@ -597,3 +603,838 @@ func TestMD_Ranges(t *testing.T) {
 	client2.Close(true)
 	mainClient.Close(true)
 }
+
+// earlyParticipant answers every datagram it receives with a burst of datagrams routed early,
+// the same way the state server answers queries.
+type earlyParticipant struct {
+	MDParticipantBase
+
+	reply Channel_t
+	burst int
+}
+
+func (p *earlyParticipant) HandleDatagram(dg Datagram, dgi *DatagramIterator) {
+	for n := 0; n < p.burst; n++ {
+		reply := (&TestDatagram{}).Create([]Channel_t{p.reply}, 0, 9000)
+		reply.AddUint32(uint32(n))
+		p.RouteDatagramEarly(*reply)
+	}
+}
+
+// readSequence returns the sender and sequence number of a datagram created by the ordering tests.
+func readSequence(dg *Datagram) (Channel_t, uint32) {
+	dgi := NewDatagramIterator(dg)
+	sender := dgi.Sender()
+	dgi.SeekPayload()
+	dgi.ReadChannel()
+	dgi.ReadUint16()
+	return sender, dgi.ReadUint32()
+}
+
+func TestMD_Ordering(t *testing.T) {
+	mainClient.Flush()
+	client1.Flush()
+	client2.Flush()
+
+	client1.SendDatagram(*(&TestDatagram{}).CreateAddChannel(77770))
+	mainClient.Expect(t, *(&TestDatagram{}).CreateAddChannel(77770), false)
+
+	// Datagrams from a single sender must arrive in the order they were sent
+	for n := 0; n < 150; n++ {
+		dg := (&TestDatagram{}).Create([]Channel_t{77770}, 1, 1234)
+		dg.AddUint32(uint32(n))
+		client2.SendDatagram(*dg)
+	}
+
+	for n := 0; n < 150; n++ {
+		recv := client1.ReceiveMaybe()
+		if recv == nil {
+			t.Fatalf("Received %d out of 150 datagrams", n)
+		}
+		if _, seq := readSequence(recv); seq != uint32(n) {
+			t.Fatalf("Expected datagram #%d, got #%d", n, seq)
+		}
+		mainClient.ReceiveMaybe()
+	}
+	client1.ExpectNone(t)
+
+	client1.SendDatagram(*(&TestDatagram{}).CreateRemoveChannel(77770))
+	mainClient.Expect(t, *(&TestDatagram{}).CreateRemoveChannel(77770), false)
+}
+
+func TestMD_OrderingConcurrent(t *testing.T) {
+	mainClient.Flush()
+	client1.Flush()
+	client2.Flush()
+
+	client3 := (&TestMDConnection{}).Connect(":57123", "client #3")
+	client4 := (&TestMDConnection{}).Connect(":57123", "client #4")
+
+	client1.SendDatagram(*(&TestDatagram{}).CreateAddChannel(77771))
+	mainClient.Expect(t, *(&TestDatagram{}).CreateAddChannel(77771), false)
+
+	// Interleave senders; every sender's datagrams must still be received in order
+	senders := []*TestMDConnection{client2, client3, client4}
+	for n := 0; n < 50; n++ {
+		for i, sender := range senders {
+			dg := (&TestDatagram{}).Create([]Channel_t{77771}, Channel_t(i), 1234)
+			dg.AddUint32(uint32(n))
+			sender.SendDatagram(*dg)
+		}
+	}
+
+	next := make(map[Channel_t]uint32)
+	for n := 0; n < 50*len(senders); n++ {
+		recv := client1.ReceiveMaybe()
+		if recv == nil {
+			t.Fatalf("Received %d out of %d datagrams", n, 50*len(senders))
+		}
+		sender, seq := readSequence(recv)
+		if seq != next[sender] {
+			t.Fatalf("Expected datagram #%d from sender %d, got #%d", next[sender], sender, seq)
+		}
+		next[sender]++
+		mainClient.ReceiveMaybe()
+	}
+	client1.ExpectNone(t)
+
+	client1.SendDatagram(*(&TestDatagram{}).CreateRemoveChannel(77771))
+	client3.Close(true)
+	client4.Close(true)
+	time.Sleep(100 * time.Millisecond)
+	mainClient.Flush()
+}
+
+func TestMD_OrderingEarly(t *testing.T) {
+	mainClient.Flush()
+	client1.Flush()
+	client2.Flush()
+
+	responder := &earlyParticipant{reply: 77773, burst: 20}
+	responder.Init(responder)
+	responder.SubscribeChannel(77772)
+	mainClient.Expect(t, *(&TestDatagram{}).CreateAddChannel(77772), false)
+
+	for _, ch := range []Channel_t{77773, 77774} {
+		client1.SendDatagram(*(&TestDatagram{}).CreateAddChannel(ch))
+		mainClient.Expect(t, *(&TestDatagram{}).CreateAddChannel(ch), false)
+	}
+
+	// The responses to the query are routed early, so they must all come before the
+	// datagram that was sent right after it.
+	query := (&TestDatagram{}).Create([]Channel_t{77772}, 1, 1234)
+	query.AddUint32(0)
+	followUp := (&TestDatagram{}).Create([]Channel_t{77774}, 1, 1234)
+	followUp.AddUint32(0)
+	client2.SendDatagram(*query)
+	client2.SendDatagram(*followUp)
+
+	for n := 0; n < responder.burst; n++ {
+		recv := client1.ReceiveMaybe()
+		if recv == nil {
+			t.Fatalf("Received %d out of %d responses", n, responder.burst)
+		}
+		if _, seq := readSequence(recv); NewDatagramIterator(recv).MessageType() != 9000 || seq != uint32(n) {
+			t.Fatalf("Expected response #%d", n)
+		}
+	}
+	client1.Expect(t, *followUp, false)
+	client1.ExpectNone(t)
+
+	for _, ch := range []Channel_t{77773, 77774} {
+		client1.SendDatagram(*(&TestDatagram{}).CreateRemoveChannel(ch))
+	}
+	responder.Cleanup()
+	time.Sleep(100 * time.Millisecond)
+	mainClient.Flush()
+}
+
+// sharedParticipant records whether it handles a datagram while another participant it shares
+// deliveries with is still handling one.
+type sharedParticipant struct {
+	MDParticipantBase
+
+	handling *atomic.Int32
+	overlap  *atomic.Bool
+	handled  chan bool
+}
+
+func (p *sharedParticipant) HandleDatagram(dg Datagram, dgi *DatagramIterator) {
+	if p.handling.Add(1) > 1 {
+		p.overlap.Store(true)
+	}
+	time.Sleep(time.Millisecond)
+	p.handling.Add(-1)
+	p.handled <- true
+}
+
+func TestMD_DeliverWith(t *testing.T) {
+	mainClient.Flush()
+
+	// An owner and a participant delivered with it, the way objects are with their state server
+	handling, overlap, handled := &atomic.Int32{}, &atomic.Bool{}, make(chan bool, 100)
+	owner := &sharedParticipant{handling: handling, overlap: overlap, handled: handled}
+	owner.Init(owner)
+	owner.SubscribeChannel(77775)
+	object := &sharedParticipant{handling: handling, overlap: overlap, handled: handled}
+	object.Init(object)
+	object.DeliverWith(owner)
+	object.SubscribeChannel(77776)
+
+	// Different senders are routed on different shards, but their datagrams are still handled in turn
+	client3 := (&TestMDConnection{}).Connect(":57123", "client #3")
+	for n := 0; n < 25; n++ {
+		client2.SendDatagram(*(&TestDatagram{}).Create([]Channel_t{77775}, 1, 1234))
+		client3.SendDatagram(*(&TestDatagram{}).Create([]Channel_t{77776}, 1, 1234))
+	}
+	for n := 0; n < 50; n++ {
+		select {
+		case <-handled:
+		case <-time.After(time.Second):
+			t.Fatalf("Handled %d out of 50 datagrams", n)
+		}
+	}
+	if overlap.Load() {
+		t.Error("Deliveries to participants sharing them overlapped")
+	}
+
+	owner.Cleanup()
+	object.Cleanup()
+	client3.Close(true)
+	time.Sleep(100 * time.Millisecond)
+	mainClient.Flush()
+}
+
+func TestMD_UpstreamReconnect(t *testing.T) {
+	mainClient.Flush()
+	client1.Flush()
+	client2.Flush()
+
+	subscriptions := []Datagram{
+		*(&TestDatagram{}).CreateAddChannel(88880),
+		*(&TestDatagram{}).CreateAddRange(88890, 88899),
+	}
+	for _, dg := range subscriptions {
+		client1.SendDatagram(dg)
+		mainClient.Expect(t, dg, false)
+	}
+
+	prDg := (&TestDatagram{}).Create([]Channel_t{88881}, 88881, 2000)
+	addPrDg := NewDatagram()
+	addPrDg.AddControlHeader(CONTROL_ADD_POST_REMOVE)
+	addPrDg.AddBlob(prDg)
+	client1.SendDatagram(addPrDg)
+	mainClient.Expect(t, addPrDg, false)
+
+	// Drop the link from the upstream's end
+	mainClient.Close(true)
+	time.Sleep(20 * time.Millisecond)
+
+	// Datagrams routed in the meantime should be held until the link is back
+	dg := (&TestDatagram{}).Create([]Channel_t{88882}, 0, 1234)
+	dg.AddString("buffered")
+	client2.SendDatagram(*dg)
+
+	conn := upstream.Accept(2 * time.Second)
+	if conn == nil {
+		t.Fatal("MD never reconnected to the upstream")
+	}
+	mainClient = (&TestMDConnection{}).Set(conn, "main")
+
+	// Subscriptions and post-removes are replayed, followed by the backlog
+	mainClient.ExpectMany(t, append(subscriptions, addPrDg, *dg), false, true)
+	mainClient.ExpectNone(t)
+
+	// The replayed post-remove still fires when the participant goes away
+	clearPrDg := NewDatagram()
+	clearPrDg.AddControlHeader(CONTROL_CLEAR_POST_REMOVES)
+	client1.Close(true)
+	client1 = (&TestMDConnection{}).Connect(":57123", "client #1")
+	mainClient.ExpectMany(t, []Datagram{
+		*prDg,
+		clearPrDg,
+		*(&TestDatagram{}).CreateRemoveChannel(88880),
+		*(&TestDatagram{}).CreateRemoveRange(88890, 88899),
+	}, false, true)
+}
+
+// connectAdmin connects with an ACL granting the administrative controls, and nothing else.
+func connectAdmin(t *testing.T) *TestMDConnection {
+	acl, err := newChannelACL(core.ACL{
+		Admin:     true,
+		Subscribe: []core.ChannelRange{{Min: 0, Max: ^Channel_t(0)}},
+		Send:      []core.ChannelRange{{Min: 0, Max: ^Channel_t(0)}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The ACL is looked up when the first datagram is handled, after which it may be taken away
+	MD.setAccess("", []*channelACL{acl}, nil)
+	conn := (&TestMDConnection{}).Connect(":57123", "admin")
+	conn.SendDatagram(*(&TestDatagram{}).CreateSetConName("admin"))
+	time.Sleep(50 * time.Millisecond)
+	MD.setAccess("", nil, nil)
+
+	t.Cleanup(func() {
+		conn.Close(false)
+		time.Sleep(100 * time.Millisecond)
+		mainClient.Flush()
+	})
+	return conn
+}
+
+func TestMD_QueryParticipants(t *testing.T) {
+	mainClient.Flush()
+	client1.Flush()
+	client2.Flush()
+
+	client1.SendDatagram(*(&TestDatagram{}).CreateSetConName("query test"))
+	client1.SendDatagram(*(&TestDatagram{}).CreateSetConUrl("otp://query-test"))
+	client1.SendDatagram(*(&TestDatagram{}).CreateAddChannel(99990))
+	client1.SendDatagram(*(&TestDatagram{}).CreateAddRange(99995, 99999))
+	mainClient.ExpectMany(t, []Datagram{
+		*(&TestDatagram{}).CreateAddChannel(99990),
+		*(&TestDatagram{}).CreateAddRange(99995, 99999),
+	}, false, true)
+
+	dg := (&TestDatagram{}).Create([]Channel_t{99990}, 0, 1234)
+	client2.SendDatagram(*dg)
+	client1.Expect(t, *dg, false)
+
+	// Only connections whose ACL grants it may query participants
+	query := (&TestDatagram{}).CreateControl()
+	query.AddUint16(CONTROL_QUERY_PARTICIPANTS)
+	query.AddUint32(42)
+	client1.SendDatagram(*query)
+	client1.ExpectNone(t)
+
+	admin := connectAdmin(t)
+	admin.SendDatagram(*query)
+
+	var found *ParticipantInfo
+	for received, total := uint32(0), uint32(1); received < total; received++ {
+		recv := admin.ReceiveMaybe()
+		if recv == nil {
+			t.Fatalf("Received %d out of %d participants", received, total)
+		}
+		dgi := NewDatagramIterator(recv)
+		dgi.SeekPayload()
+		if msgType := dgi.ReadUint16(); msgType != CONTROL_QUERY_PARTICIPANTS_RESP {
+			t.Fatalf("Unexpected message type %d", msgType)
+		}
+		if context := dgi.ReadUint32(); context != 42 {
+			t.Fatalf("Unexpected context %d", context)
+		}
+		total = dgi.ReadUint32()
+		if info := ReadParticipantInfo(dgi); info.Name == "query test" {
+			found = &info
+		}
+	}
+
+	if found == nil {
+		t.Fatal("Querying participant was not listed")
+	}
+	localAddr := fmt.Sprintf("%s:%d", client1.LocalIP(), client1.LocalPort())
+	if found.Url != "otp://query-test" || found.RemoteAddr != localAddr {
+		t.Errorf("Unexpected participant URL or address: %s, %s", found.Url, found.RemoteAddr)
+	}
+	if len(found.Channels) != 1 || found.Channels[0] != 99990 {
+		t.Errorf("Unexpected channels: %v", found.Channels)
+	}
+	if len(found.Ranges) != 1 || found.Ranges[0] != (Range{99995, 99999}) {
+		t.Errorf("Unexpected ranges: %v", found.Ranges)
+	}
+	if found.Delivered == 0 {
+		t.Error("Delivered datagrams were not counted")
+	}
+
+	// The sender should have the routed datagram accounted for
+	routed := uint64(0)
+	for _, info := range MD.Participants() {
+		routed += info.Routed
+	}
+	if routed == 0 {
+		t.Error("Routed datagrams were not counted")
+	}
+
+	client1.SendDatagram(*(&TestDatagram{}).CreateRemoveChannel(99990))
+	client1.SendDatagram(*(&TestDatagram{}).CreateRemoveRange(99995, 99999))
+	time.Sleep(100 * time.Millisecond)
+	mainClient.Flush()
+}
+
+func TestMD_SlowConsumer(t *testing.T) {
+	mainClient.Flush()
+	client1.Flush()
+	client2.Flush()
+
+	policy := MD.slowConsumer
+	MD.slowConsumer = slowConsumerDrop
+	defer func() { MD.slowConsumer = policy }()
+
+	// The test connection stops reading once it has 200 datagrams waiting, so it can't keep up
+	slow := (&TestMDConnection{}).Connect(":57123", "slow client")
+	slow.SendDatagram(*(&TestDatagram{}).CreateSetConName("slow client"))
+	slow.SendDatagram(*(&TestDatagram{}).CreateAddChannel(77780))
+	mainClient.Expect(t, *(&TestDatagram{}).CreateAddChannel(77780), false)
+
+	// Everything routed is relayed upwards as well, so the upstream has to keep reading
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				mainClient.ReceiveMaybe()
+			}
+		}
+	}()
+	defer close(done)
+
+	payload := make([]byte, 2048)
+	for n := 0; n < 10000; n++ {
+		dg := (&TestDatagram{}).Create([]Channel_t{77780}, 1, 1234)
+		dg.AddData(payload)
+		client1.SendDatagram(*dg)
+	}
+
+	var info *ParticipantInfo
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		for _, participant := range MD.Participants() {
+			if participant.Name == "slow client" {
+				info = &participant
+			}
+		}
+		if info != nil && info.Dropped > 0 && MD.QueueStats().Queued == 0 {
+			break
+		}
+	}
+
+	if info == nil || info.Dropped == 0 {
+		t.Fatal("Datagrams to the slow consumer were not dropped")
+	}
+	if info.Outbound == 0 {
+		t.Error("Outbound buffer of the slow consumer was not reported")
+	}
+	if stats := MD.QueueStats(); stats.Queued != 0 || len(stats.Shards) != 4 {
+		t.Errorf("Unexpected queue stats: %+v", stats)
+	}
+
+	slow.Close(true)
+	time.Sleep(100 * time.Millisecond)
+	mainClient.Flush()
+}
+
+func TestMD_Authentication(t *testing.T) {
+	mainClient.Flush()
+
+	MD.setAccess("hunter2", nil, nil)
+	defer MD.setAccess("", nil, nil)
+
+	// Connections have to authenticate before doing anything else
+	intruder := (&TestMDConnection{}).Connect(":57123", "intruder")
+	intruder.SendDatagram(*(&TestDatagram{}).CreateAddChannel(77790))
+	wrong := (&TestMDConnection{}).Connect(":57123", "wrong secret")
+	wrong.SendDatagram(*(&TestDatagram{}).CreateAuthenticate("hunter3"))
+	wrong.SendDatagram(*(&TestDatagram{}).CreateAddChannel(77791))
+
+	for start := time.Now(); intruder.Connected() || wrong.Connected(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("Unauthenticated connections were not dropped")
+		}
+	}
+
+	// Their subscriptions must not have made it upstream
+	for recv := mainClient.ReceiveMaybe(); recv != nil; recv = mainClient.ReceiveMaybe() {
+		dgi := NewDatagramIterator(recv)
+		dgi.SeekPayload()
+		if dgi.ReadUint16() == CONTROL_SET_CHANNEL {
+			t.Fatal("Unauthenticated connection subscribed to a channel")
+		}
+	}
+
+	conn := (&TestMDConnection{}).Connect(":57123", "authenticated")
+	conn.SendDatagram(*(&TestDatagram{}).CreateAuthenticate("hunter2"))
+	conn.SendDatagram(*(&TestDatagram{}).CreateAddChannel(77792))
+	mainClient.Expect(t, *(&TestDatagram{}).CreateAddChannel(77792), false)
+
+	conn.Close(true)
+	time.Sleep(100 * time.Millisecond)
+	mainClient.Flush()
+}
+
+func TestMD_ACL(t *testing.T) {
+	mainClient.Flush()
+	client1.Flush()
+
+	client1.SendDatagram(*(&TestDatagram{}).CreateAddChannel(77850))
+	mainClient.Expect(t, *(&TestDatagram{}).CreateAddChannel(77850), false)
+
+	config := core.ACL{
+		Address:   "127.0.0.1",
+		Subscribe: []core.ChannelRange{{Min: 77800, Max: 77809}},
+		Send:      []core.ChannelRange{{Min: 77800, Max: 77809}, {Min: 77850, Max: 77850}},
+	}
+	acl, err := newChannelACL(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	MD.setAccess("", []*channelACL{acl}, nil)
+	defer MD.setAccess("", nil, nil)
+
+	conn := (&TestMDConnection{}).Connect(":57123", "restricted")
+
+	// Only subscriptions within the allowed ranges go through
+	conn.SendDatagram(*(&TestDatagram{}).CreateAddChannel(77900))
+	conn.SendDatagram(*(&TestDatagram{}).CreateAddRange(77805, 77815))
+	conn.SendDatagram(*(&TestDatagram{}).CreateAddRange(77800, 77804))
+	conn.SendDatagram(*(&TestDatagram{}).CreateAddChannel(77805))
+	mainClient.ExpectMany(t, []Datagram{
+		*(&TestDatagram{}).CreateAddRange(77800, 77804),
+		*(&TestDatagram{}).CreateAddChannel(77805),
+	}, false, true)
+	mainClient.ExpectNone(t)
+
+	// Datagrams are dropped unless every recipient is allowed
+	denied := (&TestDatagram{}).Create([]Channel_t{77850, 77900}, 1, 1234)
+	conn.SendDatagram(*denied)
+	allowed := (&TestDatagram{}).Create([]Channel_t{77850}, 1, 1234)
+	conn.SendDatagram(*allowed)
+	client1.Expect(t, *allowed, false)
+	client1.ExpectNone(t)
+
+	// Violations may drop the connection instead
+	config.Violation = "disconnect"
+	if acl, err = newChannelACL(config); err != nil {
+		t.Fatal(err)
+	}
+	MD.setAccess("", []*channelACL{acl}, nil)
+	conn.Close(false)
+	conn = (&TestMDConnection{}).Connect(":57123", "disconnected")
+	conn.SendDatagram(*denied)
+	for start := time.Now(); conn.Connected(); time.Sleep(10 * time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("Connection violating its ACL was not dropped")
+		}
+	}
+
+	client1.SendDatagram(*(&TestDatagram{}).CreateRemoveChannel(77850))
+	time.Sleep(100 * time.Millisecond)
+	mainClient.Flush()
+}
+
+func TestMD_DefaultACL(t *testing.T) {
+	mainClient.Flush()
+
+	path := filepath.Join(t.TempDir(), "md.sock")
+	server := &net.NetworkServer{Handler: MD}
+	errChan := make(chan error)
+	go server.Start("unix:"+path, errChan, false)
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown()
+
+	acl, err := newChannelACL(core.ACL{
+		Address:   "unix",
+		Subscribe: []core.ChannelRange{{Min: 77880, Max: 77889}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	MD.setAccess("", []*channelACL{acl}, &channelACL{})
+	defer MD.setAccess("", nil, nil)
+
+	// Connections matching no ACL may do nothing
+	denied := (&TestMDConnection{}).Connect(":57123", "denied")
+	denied.SendDatagram(*(&TestDatagram{}).CreateAddChannel(77880))
+	mainClient.ExpectNone(t)
+
+	// Unix sockets don't match address ranges, but may be matched on their own
+	unixClient := (&TestMDConnection{}).Connect("unix:"+path, "unix client")
+	unixClient.SendDatagram(*(&TestDatagram{}).CreateAddChannel(77890))
+	unixClient.SendDatagram(*(&TestDatagram{}).CreateAddChannel(77880))
+	mainClient.Expect(t, *(&TestDatagram{}).CreateAddChannel(77880), false)
+	mainClient.ExpectNone(t)
+
+	unixClient.SendDatagram(*(&TestDatagram{}).CreateRemoveChannel(77880))
+	mainClient.Expect(t, *(&TestDatagram{}).CreateRemoveChannel(77880), false)
+
+	denied.Close(false)
+	unixClient.Close(false)
+	time.Sleep(100 * time.Millisecond)
+	mainClient.Flush()
+}
+
+func TestMD_RecordReplay(t *testing.T) {
+	mainClient.Flush()
+	client1.Flush()
+	client2.Flush()
+
+	path := filepath.Join(t.TempDir(), "md.rec")
+	recorder, err := NewRecorder(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	MD.recorder = recorder
+
+	client2.SendDatagram(*(&TestDatagram{}).CreateSetConName("recorded"))
+	first := (&TestDatagram{}).Create([]Channel_t{77860, 77861}, 5, 1234)
+	first.AddString("first")
+	second := (&TestDatagram{}).Create([]Channel_t{77862}, 5, 4321)
+	second.AddString("second")
+	client2.SendDatagram(*first)
+	client2.SendDatagram(*second)
+	mainClient.ExpectMany(t, []Datagram{*first, *second}, false, true)
+
+	MD.recorder = nil
+	if err := recorder.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := OpenRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var recorded []RecordedDatagram
+	for rec, err := reader.Next(); err != io.EOF; rec, err = reader.Next() {
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorded = append(recorded, rec)
+	}
+	reader.Close()
+
+	if len(recorded) != 2 {
+		t.Fatalf("Expected 2 recorded datagrams, got %d", len(recorded))
+	}
+	if recorded[0].SenderName != "recorded" || recorded[0].Sender != recorded[1].Sender {
+		t.Errorf("Unexpected sender: %d %s", recorded[0].Sender, recorded[0].SenderName)
+	}
+	if recipients := recorded[0].Recipients(); len(recipients) != 2 || recipients[1] != 77861 {
+		t.Errorf("Unexpected recipients: %v", recipients)
+	}
+	if recorded[1].MsgType() != 4321 || recorded[1].Time.Before(recorded[0].Time) {
+		t.Errorf("Unexpected message type %d or time %s", recorded[1].MsgType(), recorded[1].Time)
+	}
+
+	// Replaying with a filter only routes the matching datagrams
+	client1.SendDatagram(*(&TestDatagram{}).CreateAddRange(77860, 77869))
+	mainClient.Expect(t, *(&TestDatagram{}).CreateAddRange(77860, 77869), false)
+
+	reader, err = OpenRecording(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	replayed, err := Replay(reader, func(rec *RecordedDatagram) bool { return rec.MsgType() == 4321 }, 0)
+	if err != nil || replayed != 1 {
+		t.Fatalf("Replayed %d datagrams: %v", replayed, err)
+	}
+	client1.Expect(t, *second, false)
+	client1.ExpectNone(t)
+
+	client1.SendDatagram(*(&TestDatagram{}).CreateRemoveRange(77860, 77869))
+	time.Sleep(100 * time.Millisecond)
+	mainClient.Flush()
+}
+
+func TestMD_UnixSocket(t *testing.T) {
+	mainClient.Flush()
+	client1.Flush()
+
+	path := filepath.Join(t.TempDir(), "md.sock")
+	server := &net.NetworkServer{Handler: MD}
+	errChan := make(chan error)
+	go server.Start("unix:"+path, errChan, false)
+	if err := <-errChan; err != nil {
+		t.Fatal(err)
+	}
+	defer server.Shutdown()
+
+	unixClient := (&TestMDConnection{}).Connect("unix:"+path, "unix client")
+	defer unixClient.Close(false)
+
+	unixClient.SendDatagram(*(&TestDatagram{}).CreateAddChannel(77870))
+	mainClient.Expect(t, *(&TestDatagram{}).CreateAddChannel(77870), false)
+
+	dg := (&TestDatagram{}).Create([]Channel_t{77870}, 5, 1234)
+	client1.SendDatagram(*dg)
+	unixClient.Expect(t, *dg, false)
+	mainClient.Expect(t, *dg, false)
+	unixClient.ExpectNone(t)
+
+	if unixClient.RemoteIP() != path || unixClient.RemotePort() != 0 {
+		t.Errorf("Unexpected remote address: %s:%d", unixClient.RemoteIP(), unixClient.RemotePort())
+	}
+
+	found := false
+	for _, info := range MD.Participants() {
+		found = found || info.RemoteAddr == "unix:"+path
+	}
+	if !found {
+		t.Error("Participant on the unix socket was not named after it")
+	}
+
+	unixClient.SendDatagram(*(&TestDatagram{}).CreateRemoveChannel(77870))
+	mainClient.Expect(t, *(&TestDatagram{}).CreateRemoveChannel(77870), false)
+}
+
+func TestMD_ReloadLua(t *testing.T) {
+	client1.Flush()
+
+	// The callback stays registered after the test, so it mustn't block on later reloads.
+	reloaded := make(chan bool, 1)
+	core.OnReload(func() {
+		select {
+		case reloaded <- true:
+		default:
+		}
+	})
+
+	reload := (&TestDatagram{}).CreateControl()
+	reload.AddUint16(CONTROL_RELOAD_LUA)
+
+	// Only connections granted it by their ACL may reload
+	client1.SendDatagram(*reload)
+	select {
+	case <-reloaded:
+		t.Fatal("CONTROL_RELOAD_LUA was allowed without an admin ACL")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	admin := connectAdmin(t)
+	admin.SendDatagram(*reload)
+	select {
+	case <-reloaded:
+	case <-time.After(time.Second):
+		t.Fatal("CONTROL_RELOAD_LUA did not reload Lua scripts")
+	}
+
+	client1.ExpectNone(t)
+	admin.ExpectNone(t)
+}
+
+func TestMD_DrainClients(t *testing.T) {
+	// Let anything left over from earlier tests reach the upstream first.
+	time.Sleep(100 * time.Millisecond)
+	mainClient.Flush()
+	client1.Flush()
+
+	drained := make(chan time.Duration, 1)
+	core.OnDrain(func(countdown time.Duration) { drained <- countdown })
+
+	drain := (&TestDatagram{}).CreateControl()
+	drain.AddUint16(CONTROL_DRAIN_CLIENTS)
+	drain.AddUint32(30)
+
+	// Only connections granted it by their ACL may drain
+	client1.SendDatagram(*drain)
+	select {
+	case <-drained:
+		t.Fatal("CONTROL_DRAIN_CLIENTS was allowed without an admin ACL")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	connectAdmin(t).SendDatagram(*drain)
+
+	select {
+	case countdown := <-drained:
+		if countdown != 30*time.Second {
+			t.Errorf("Unexpected countdown %s", countdown)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("CONTROL_DRAIN_CLIENTS did not drain clients")
+	}
+
+	// Whatever was routed upstream while draining has to be written before the daemon exits.
+	client1.SendDatagram(*(&TestDatagram{}).CreateAddChannel(77880))
+	time.Sleep(50 * time.Millisecond)
+	if !MD.Flush(time.Second) {
+		t.Error("MD did not flush")
+	}
+	mainClient.Expect(t, *(&TestDatagram{}).CreateAddChannel(77880), false)
+
+	client1.SendDatagram(*(&TestDatagram{}).CreateRemoveChannel(77880))
+	mainClient.Expect(t, *(&TestDatagram{}).CreateRemoveChannel(77880), false)
+}
+
+type testBanList chan string
+
+func (b testBanList) Ban(address string, reason string) error {
+	b <- "ban " + address + " " + reason
+	return nil
+}
+
+func (b testBanList) Unban(address string) (bool, error) {
+	b <- "unban " + address
+	return true, nil
+}
+
+func TestMD_BanAddress(t *testing.T) {
+	bans := make(testBanList, 2)
+	core.AddBanList(bans)
+
+	expect := func(msg string) {
+		select {
+		case got := <-bans:
+			if got != msg {
+				t.Errorf("Expected \"%s\", got \"%s\"", msg, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Ban list never got \"%s\"", msg)
+		}
+	}
+
+	ban := (&TestDatagram{}).CreateControl()
+	ban.AddUint16(CONTROL_BAN_ADDRESS)
+	ban.AddString("10.0.0.0/8")
+	ban.AddString("spam")
+	unban := (&TestDatagram{}).CreateControl()
+	unban.AddUint16(CONTROL_UNBAN_ADDRESS)
+	unban.AddString("10.0.0.0/8")
+
+	// Only connections granted it by their ACL may ban and unban
+	client1.SendDatagram(*ban)
+	client1.SendDatagram(*unban)
+	select {
+	case got := <-bans:
+		t.Fatalf("Ban list got \"%s\" without an admin ACL", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	admin := connectAdmin(t)
+	admin.SendDatagram(*ban)
+	expect("ban 10.0.0.0/8 spam")
+	admin.SendDatagram(*unban)
+	expect("unban 10.0.0.0/8")
+}
+
+func TestMD_StartCapture(t *testing.T) {
+	client2.SendDatagram(*(&TestDatagram{}).CreateAddChannel(78000))
+	time.Sleep(50 * time.Millisecond)
+	mainClient.Flush()
+	client2.Flush()
+
+	capture := (&TestDatagram{}).Create([]Channel_t{78000}, 5, CLIENTAGENT_START_CAPTURE)
+	capture.AddUint32(60)
+
+	// Only connections granted it by their ACL may have clients captured
+	client1.SendDatagram(*capture)
+	client2.ExpectNone(t)
+	mainClient.ExpectNone(t)
+
+	admin := connectAdmin(t)
+	admin.SendDatagram(*capture)
+	client2.Expect(t, *capture, false)
+
+	// Other messages to the client are unaffected
+	other := (&TestDatagram{}).Create([]Channel_t{78000}, 5, CLIENTAGENT_EJECT)
+	client1.SendDatagram(*other)
+	client2.Expect(t, *other, false)
+
+	client2.SendDatagram(*(&TestDatagram{}).CreateRemoveChannel(78000))
+	time.Sleep(50 * time.Millisecond)
+	mainClient.Flush()
+}
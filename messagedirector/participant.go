@@ -1,11 +1,17 @@
 package messagedirector
 
 import (
+	"crypto/subtle"
+	"encoding/binary"
 	"errors"
+	"fmt"
 	gonet "net"
+	"otpgo/core"
+	"otpgo/eventlogger"
 	"otpgo/net"
 	. "otpgo/util"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -35,11 +41,15 @@ type MDParticipantBase struct {
 
 	subscriber  *Subscriber
 	postRemoves []Datagram
+	lane        routeLane
 
 	name       string
 	url        string
 	id         uint32
-	terminated bool
+	terminated atomic.Bool
+
+	// routed counts the datagrams this participant has sent into the MD.
+	routed atomic.Uint64
 
 	mu sync.Mutex
 }
@@ -74,45 +84,28 @@ func (m *MDParticipantBase) Subscriber() *Subscriber {
 	return m.subscriber
 }
 
+// DeliverWith makes datagrams be delivered to this participant one at a time with those delivered
+// to owner, so that participants sharing state with it don't need to lock it. It must be called
+// before subscribing to anything.
+func (m *MDParticipantBase) DeliverWith(owner MDParticipant) {
+	sub := owner.Subscriber()
+	if sub.deliverWith != nil {
+		sub = sub.deliverWith
+	}
+	m.subscriber.deliverWith = sub
+}
+
 // RouteDatagram appends a datagram to the end of the MD queue.
 func (m *MDParticipantBase) RouteDatagram(datagram Datagram) {
-	MD.queueLock.Lock()
-	nextPos := MD.queuePreviousStoredPosition.Add(1)
-	queueEntry := QueueEntry{datagram, m}
-	queueSlice := make([]QueueEntry, 0)
-	queueSlice = append(queueSlice, queueEntry)
-	MD.Queue[nextPos] = queueSlice
-	MD.queueLock.Unlock()
-
-	select {
-	case MD.shouldProcess <- true:
-	default:
-	}
+	m.routed.Add(1)
+	MD.router.route(QueueEntry{datagram, m}, &m.lane, false)
 }
 
 // RouteDatagramEarly appends a datagram to the end of the current queue entry that will be processed.
 // This is used to keep datagrams in the same flow together, so they can be processed in the expected order.
 func (m *MDParticipantBase) RouteDatagramEarly(datagram Datagram) {
-	MD.queueLock.Lock()
-	curPos := MD.queueCurrentPosition.Load()
-	queueEntry := QueueEntry{datagram, m}
-	_, ok := MD.Queue[curPos]
-	if !ok {
-		// This entry isn't in the queue yet. Make a new one.
-		nextPos := MD.queuePreviousStoredPosition.Add(1)
-		queueSlice := make([]QueueEntry, 0)
-		queueSlice = append(queueSlice, queueEntry)
-		MD.Queue[nextPos] = queueSlice
-	} else {
-		// Entry is in the map. Append this datagram to the end of this entry.
-		MD.Queue[curPos] = append(MD.Queue[curPos], queueEntry)
-	}
-	MD.queueLock.Unlock()
-
-	select {
-	case MD.shouldProcess <- true:
-	default:
-	}
+	m.routed.Add(1)
+	MD.router.route(QueueEntry{datagram, m}, &m.lane, true)
 }
 
 func (m *MDParticipantBase) PostRemove() {
@@ -135,7 +128,7 @@ func (m *MDParticipantBase) ClearPostRemoves() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	clear(m.postRemoves)
+	m.postRemoves = m.postRemoves[:0]
 	MD.RecallPostRemoves()
 }
 
@@ -168,14 +161,14 @@ func (m *MDParticipantBase) Id() uint32 {
 }
 
 func (m *MDParticipantBase) IsTerminated() bool {
-	return m.terminated
+	return m.terminated.Load()
 }
 
 func (m *MDParticipantBase) Cleanup() {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	m.terminated = true
+	m.terminated.Store(true)
 	m.PostRemove()
 	channelMap.UnsubscribeAll(m.subscriber)
 	MD.RemoveParticipant(m)
@@ -186,12 +179,12 @@ func (m *MDParticipantBase) RecycleParticipant() {
 	defer m.mu.Unlock()
 
 	m.subscriber = nil
-	clear(m.postRemoves)
+	m.postRemoves = m.postRemoves[:0]
 	m.name = ""
 	m.url = ""
 	// We can't hold onto the ID; we can't ensure this participant will be reused before being garbage collected.
 	m.id = 0
-	m.terminated = false
+	m.terminated.Store(false)
 }
 
 func (m *MDParticipantBase) Terminate(err error) { /* virtual */ }
@@ -203,20 +196,85 @@ type MDNetworkParticipant struct {
 	client *net.Client
 	conn   gonet.Conn
 	mu     sync.Mutex
+
+	// dropped counts the datagrams discarded because the connection couldn't keep up with them.
+	dropped atomic.Uint64
+	// slow is set while the outbound buffer is full, so the event is only logged once per episode.
+	slow atomic.Bool
+	// terminating is set by the first call to Terminate, which may come from the read loop, the
+	// authentication timer or a routing goroutine under the disconnect policy.
+	terminating atomic.Bool
+
+	// If the MD has a secret, nothing but CONTROL_AUTHENTICATE is accepted until the connection
+	// has sent it; connections which don't within authTimeout are dropped.
+	authenticated bool
+	authTimer     *time.Timer
+
+	// acl is looked up once the connection sends its first datagram, as its TLS identity isn't
+	// known before then. Connections without an ACL are unrestricted, except for the administrative
+	// controls.
+	acl         *channelACL
+	aclResolved bool
 }
 
+const authTimeout = 10 * time.Second
+
 func NewMDParticipant(conn gonet.Conn) *MDNetworkParticipant {
-	participant := &MDNetworkParticipant{conn: conn}
+	participant := &MDNetworkParticipant{conn: conn, authenticated: MD.getSecret() == ""}
 	participant.MDParticipantBase.Init(participant)
+	if !participant.authenticated {
+		participant.authTimer = time.AfterFunc(authTimeout, participant.authTimedOut)
+	}
 	socket := net.NewSocketTransport(conn, 0, 4096)
 
-	participant.client = net.NewClient(socket, participant, 60*time.Second)
-	participant.SetName(conn.RemoteAddr().String())
+	// The client starts reading straight away; hold the read loop back until it has been stored, as
+	// the routing goroutines read it once the connection subscribes to anything.
+	participant.mu.Lock()
+	participant.client = net.NewBufferedClient(socket, participant, 60*time.Second, MD.outboundBuffer)
+	participant.SetName(net.RemoteName(conn))
+	participant.mu.Unlock()
 	return participant
 }
 
 func (m *MDNetworkParticipant) HandleDatagram(dg Datagram, dgi *DatagramIterator) {
-	m.client.SendDatagram(dg)
+	if MD.slowConsumer == slowConsumerBlock {
+		if !m.client.TrySendDatagram(dg) {
+			m.slowConsumer()
+			m.client.SendDatagram(dg)
+		}
+		m.slow.Store(false)
+		return
+	}
+
+	if m.client.TrySendDatagram(dg) {
+		m.slow.Store(false)
+		return
+	}
+
+	m.slowConsumer()
+	switch MD.slowConsumer {
+	case slowConsumerDrop:
+		m.dropped.Add(1)
+	case slowConsumerDisconnect:
+		m.Terminate(errors.New("outbound buffer is full"))
+	}
+}
+
+// slowConsumer logs an event when the connection first falls behind on the datagrams routed to it.
+func (m *MDNetworkParticipant) slowConsumer() {
+	if m.slow.Swap(true) {
+		return
+	}
+
+	description := fmt.Sprintf("%d datagrams waiting to be written; policy is %s", m.client.Outbound(), MD.slowConsumer)
+	MDLog.Warnf("MDNetworkParticipant %s is a slow consumer: %s", m.name, description)
+	eventlogger.NewLoggedEvent("slow-consumer", "MessageDirector", m.name, description).Send()
+}
+
+// Outbound returns the number of datagrams waiting to be written to the connection, and the number
+// of datagrams which have been dropped because it couldn't keep up.
+func (m *MDNetworkParticipant) Outbound() (int, uint64) {
+	return m.client.Outbound(), m.dropped.Load()
 }
 
 func (m *MDNetworkParticipant) ReceiveDatagram(dg Datagram) {
@@ -231,30 +289,80 @@ func (m *MDNetworkParticipant) ReceiveDatagram(dg Datagram) {
 		}
 	}()
 
+	if !m.authenticated {
+		m.authenticate(dg)
+		m.mu.Unlock()
+		return
+	}
+	if !m.aclResolved {
+		m.acl = MD.lookupACL(m.conn)
+		m.aclResolved = true
+	}
+
 	dgi := NewDatagramIterator(&dg)
 	channels := dgi.ReadUint8()
 	if channels == 1 && dgi.ReadChannel() == CONTROL_MESSAGE {
 		msg := dgi.ReadUint16()
 		switch msg {
+		case CONTROL_AUTHENTICATE:
+			// Either we've already been authenticated, or we don't need to be.
 		case CONTROL_SET_CHANNEL:
-			m.SubscribeChannel(dgi.ReadChannel())
+			if ch := dgi.ReadChannel(); m.permitSubscribe(Range{ch, ch}) {
+				m.SubscribeChannel(ch)
+			}
 		case CONTROL_REMOVE_CHANNEL:
 			m.UnsubscribeChannel(dgi.ReadChannel())
 		case CONTROL_ADD_RANGE:
-			m.SubscribeRange(Range{dgi.ReadChannel(), dgi.ReadChannel()})
+			if rng := (Range{dgi.ReadChannel(), dgi.ReadChannel()}); m.permitSubscribe(rng) {
+				m.SubscribeRange(rng)
+			}
 		case CONTROL_REMOVE_RANGE:
 			m.UnsubscribeRange(Range{dgi.ReadChannel(), dgi.ReadChannel()})
 		case CONTROL_ADD_POST_REMOVE:
-			m.AddPostRemove(*dgi.ReadDatagram())
+			if pr := dgi.ReadDatagram(); m.permitSend(*pr) {
+				m.AddPostRemove(*pr)
+			}
 		case CONTROL_CLEAR_POST_REMOVES:
 			m.ClearPostRemoves()
 		case CONTROL_SET_CON_NAME:
 			m.name = dgi.ReadString()
 		case CONTROL_SET_CON_URL:
 			m.url = dgi.ReadString()
+		case CONTROL_QUERY_PARTICIPANTS:
+			context := dgi.ReadUint32()
+			if m.permitAdmin("query participants") {
+				// The responses may fill the outbound buffer, which mustn't hold up the read loop.
+				go m.sendParticipants(context)
+			}
 		case CONTROL_LOG_MESSAGE:
-			// Our version of the eventlogger cannot log datagrams whatsoever, so this
-			//  feature is essentially deprecated.
+			m.forwardLogMessage(dgi.ReadDatagram())
+		case CONTROL_RELOAD_LUA:
+			if m.permitAdmin("reload Lua") {
+				MDLog.Infof("MDNetworkParticipant %s requested a Lua reload", m.name)
+				go core.ReloadLua()
+			}
+		case CONTROL_DRAIN_CLIENTS:
+			countdown := time.Duration(dgi.ReadUint32()) * time.Second
+			if m.permitAdmin("drain clients") {
+				MDLog.Infof("MDNetworkParticipant %s requested a drain in %s", m.name, countdown)
+				go core.Drain(countdown)
+			}
+		case CONTROL_BAN_ADDRESS:
+			address, reason := dgi.ReadString(), dgi.ReadString()
+			if m.permitAdmin("ban addresses") {
+				MDLog.Infof("MDNetworkParticipant %s banned %s: %s", m.name, address, reason)
+				if err := core.Ban(address, reason); err != nil {
+					MDLog.Errorf("Unable to ban %s: %s", address, err)
+				}
+			}
+		case CONTROL_UNBAN_ADDRESS:
+			address := dgi.ReadString()
+			if m.permitAdmin("unban addresses") {
+				MDLog.Infof("MDNetworkParticipant %s unbanned %s", m.name, address)
+				if err := core.Unban(address); err != nil {
+					MDLog.Errorf("Unable to unban %s: %s", address, err)
+				}
+			}
 		default:
 			MDLog.Errorf("MDNetworkParticipant got unknown control message with message type: %d", msg)
 		}
@@ -262,15 +370,144 @@ func (m *MDNetworkParticipant) ReceiveDatagram(dg Datagram) {
 		return
 	}
 
-	m.RouteDatagram(dg)
+	if !m.permitSend(dg) {
+		m.mu.Unlock()
+		return
+	}
+
+	// Unlike participants within the daemon, connections are held back while the MD is congested.
+	m.routed.Add(1)
+	MD.router.routeWait(QueueEntry{dg, m}, &m.lane)
 	m.mu.Unlock()
 }
 
+// authenticate expects the datagram to be a CONTROL_AUTHENTICATE carrying the MD's secret;
+// the connection is dropped otherwise.
+func (m *MDNetworkParticipant) authenticate(dg Datagram) {
+	dgi := NewDatagramIterator(&dg)
+	if dgi.ReadUint8() != 1 || dgi.ReadChannel() != CONTROL_MESSAGE || dgi.ReadUint16() != CONTROL_AUTHENTICATE {
+		m.Terminate(errors.New("sent a datagram before authenticating"))
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(dgi.ReadString()), []byte(MD.getSecret())) != 1 {
+		m.Terminate(errors.New("authentication failed"))
+		return
+	}
+
+	m.authenticated = true
+	m.authTimer.Stop()
+}
+
+// permitSubscribe and permitSend check a subscription or a datagram against the connection's ACL.
+// Violations are logged, and may drop the connection.
+func (m *MDNetworkParticipant) permitSubscribe(rng Range) bool {
+	if m.acl == nil || m.acl.canSubscribe(rng) {
+		return true
+	}
+
+	if rng.Min == rng.Max {
+		m.violateACL(fmt.Sprintf("subscribe to channel %d", rng.Min))
+	} else {
+		m.violateACL(fmt.Sprintf("subscribe to range %d-%d", rng.Min, rng.Max))
+	}
+	return false
+}
+
+func (m *MDNetworkParticipant) permitSend(dg Datagram) bool {
+	// A capture records everything a client sends, so asking for one is an administrative control.
+	if isCaptureRequest(dg) && !m.permitAdmin("start client captures") {
+		return false
+	}
+	if m.acl == nil {
+		return true
+	}
+
+	dgi := NewDatagramIterator(&dg)
+	for n := dgi.ReadUint8(); n > 0; n-- {
+		if ch := dgi.ReadChannel(); !m.acl.canSend(ch) {
+			m.violateACL(fmt.Sprintf("send to channel %d", ch))
+			return false
+		}
+	}
+	return true
+}
+
+// isCaptureRequest returns whether a datagram is a CLIENTAGENT_START_CAPTURE. It is only peeked at, as
+// the datagram may be truncated.
+func isCaptureRequest(dg Datagram) bool {
+	data := dg.Bytes()
+	if len(data) == 0 {
+		return false
+	}
+	msgType := 1 + int(data[0])*Chansize + Chansize
+	return len(data) >= msgType+Blobsize &&
+		binary.LittleEndian.Uint16(data[msgType:]) == CLIENTAGENT_START_CAPTURE
+}
+
+// permitAdmin checks that the connection's ACL explicitly allows an administrative control.
+func (m *MDNetworkParticipant) permitAdmin(action string) bool {
+	if m.acl != nil && m.acl.admin {
+		return true
+	}
+
+	m.violateACL(action)
+	return false
+}
+
+func (m *MDNetworkParticipant) violateACL(action string) {
+	description := fmt.Sprintf("not allowed to %s", action)
+	MDLog.Warnf("MDNetworkParticipant %s is %s", m.name, description)
+	eventlogger.NewLoggedEvent("acl-violation", "MessageDirector", m.name, description).Send()
+
+	if m.acl != nil && m.acl.disconnect {
+		m.Terminate(errors.New("violated its ACL"))
+	}
+}
+
+func (m *MDNetworkParticipant) authTimedOut() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.authenticated {
+		m.Terminate(errors.New("did not authenticate in time"))
+	}
+}
+
+// forwardLogMessage relays an event sent through CONTROL_LOG_MESSAGE to the event logger.
+func (m *MDNetworkParticipant) forwardLogMessage(payload *Datagram) {
+	event, err := eventlogger.ReadLoggedEvent(NewDatagramIterator(payload))
+	if err != nil {
+		MDLog.Errorf("MDNetworkParticipant %s sent an invalid log message: %s", m.name, err)
+		return
+	}
+	event.SetSender(m.name)
+	event.Send()
+}
+
+func (m *MDNetworkParticipant) RemoteAddr() string {
+	return net.RemoteName(m.conn)
+}
+
+// sendParticipants answers a CONTROL_QUERY_PARTICIPANTS with one response per participant, as the
+// whole list may not fit in a single datagram.
+func (m *MDNetworkParticipant) sendParticipants(context uint32) {
+	participants := MD.Participants()
+	for _, info := range participants {
+		dg := NewDatagram()
+		dg.AddControlHeader(CONTROL_QUERY_PARTICIPANTS_RESP)
+		dg.AddUint32(context)
+		dg.AddUint32(uint32(len(participants)))
+		AddParticipantInfo(&dg, info)
+		m.client.SendDatagram(dg)
+	}
+}
+
 func (m *MDNetworkParticipant) Terminate(err error) {
-	if m.terminated {
+	if !m.terminating.CompareAndSwap(false, true) {
 		return
 	}
-	MDLog.Infof("Lost connection from %s: %s", m.conn.RemoteAddr(), err.Error())
+	MDLog.Infof("Lost connection from %s: %s", net.RemoteName(m.conn), err.Error())
 	m.Cleanup()
 	m.client.Close(true)
 }
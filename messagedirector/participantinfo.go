@@ -0,0 +1,158 @@
+package messagedirector
+
+import (
+	"cmp"
+	. "otpgo/util"
+	"slices"
+)
+
+// ParticipantInfo is a snapshot of a participant's state, used to debug routing.
+type ParticipantInfo struct {
+	Id   uint32
+	Name string
+	Url  string
+	// RemoteAddr is empty for participants which aren't backed by a connection.
+	RemoteAddr string
+
+	Channels    []Channel_t
+	Ranges      []Range
+	PostRemoves []Datagram
+
+	// Routed counts the datagrams the participant has sent into the MD, Delivered the
+	// datagrams the MD has handed to it.
+	Routed    uint64
+	Delivered uint64
+
+	// Queued counts the participant's datagrams waiting to be routed, Outbound the datagrams waiting
+	// to be written to its connection and Dropped those discarded because it couldn't keep up.
+	Queued   uint32
+	Outbound uint32
+	Dropped  uint64
+}
+
+// remoteParticipant is implemented by participants which are backed by a connection.
+type remoteParticipant interface {
+	RemoteAddr() string
+	Outbound() (int, uint64)
+}
+
+func (m *MDParticipantBase) Info() ParticipantInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	info := ParticipantInfo{
+		Id:          m.id,
+		Name:        m.name,
+		Url:         m.url,
+		PostRemoves: slices.Clone(m.postRemoves),
+		Routed:      m.routed.Load(),
+		Queued:      uint32(m.lane.Pending()),
+	}
+
+	if m.subscriber == nil {
+		return info
+	}
+
+	if remote, ok := m.subscriber.participant.(remoteParticipant); ok {
+		info.RemoteAddr = remote.RemoteAddr()
+		outbound, dropped := remote.Outbound()
+		info.Outbound, info.Dropped = uint32(outbound), dropped
+	}
+	info.Delivered = m.subscriber.delivered.Load()
+
+	channelMap.Lock()
+	info.Channels = make([]Channel_t, 0, len(m.subscriber.channels))
+	for ch := range m.subscriber.channels {
+		info.Channels = append(info.Channels, ch)
+	}
+	info.Ranges = slices.Clone(m.subscriber.ranges)
+	channelMap.Unlock()
+
+	slices.Sort(info.Channels)
+	return info
+}
+
+// Participants returns a snapshot of every participant attached to the MD, ordered by id.
+func (m *MessageDirector) Participants() []ParticipantInfo {
+	// Participants lock themselves while being removed from the map, so we can't hold on to it.
+	participants := *m.participants.Clone()
+
+	infos := make([]ParticipantInfo, 0, len(participants))
+	for _, p := range participants {
+		if base, ok := p.(*MDParticipantBase); ok {
+			infos = append(infos, base.Info())
+		}
+	}
+
+	slices.SortFunc(infos, func(a, b ParticipantInfo) int {
+		return cmp.Compare(a.Id, b.Id)
+	})
+	return infos
+}
+
+// QueueStats reports how many datagrams are waiting to be routed through the MD.
+func (m *MessageDirector) QueueStats() QueueStats {
+	return m.router.Stats()
+}
+
+// AddParticipantInfo packs a participant into a CONTROL_QUERY_PARTICIPANTS_RESP.
+func AddParticipantInfo(dg *Datagram, info ParticipantInfo) {
+	dg.AddUint32(info.Id)
+	dg.AddString(info.Name)
+	dg.AddString(info.Url)
+	dg.AddString(info.RemoteAddr)
+
+	dg.AddUint32(uint32(len(info.Channels)))
+	for _, ch := range info.Channels {
+		dg.AddChannel(ch)
+	}
+
+	dg.AddUint32(uint32(len(info.Ranges)))
+	for _, rng := range info.Ranges {
+		dg.AddChannel(rng.Min)
+		dg.AddChannel(rng.Max)
+	}
+
+	dg.AddUint16(uint16(len(info.PostRemoves)))
+	for _, pr := range info.PostRemoves {
+		dg.AddBlob(&pr)
+	}
+
+	dg.AddUint64(info.Routed)
+	dg.AddUint64(info.Delivered)
+	dg.AddUint32(info.Queued)
+	dg.AddUint32(info.Outbound)
+	dg.AddUint64(info.Dropped)
+}
+
+// ReadParticipantInfo unpacks a participant from a CONTROL_QUERY_PARTICIPANTS_RESP.
+func ReadParticipantInfo(dgi *DatagramIterator) ParticipantInfo {
+	info := ParticipantInfo{
+		Id:         dgi.ReadUint32(),
+		Name:       dgi.ReadString(),
+		Url:        dgi.ReadString(),
+		RemoteAddr: dgi.ReadString(),
+	}
+
+	info.Channels = make([]Channel_t, dgi.ReadUint32())
+	for n := range info.Channels {
+		info.Channels[n] = dgi.ReadChannel()
+	}
+
+	info.Ranges = make([]Range, dgi.ReadUint32())
+	for n := range info.Ranges {
+		info.Ranges[n] = Range{dgi.ReadChannel(), dgi.ReadChannel()}
+	}
+
+	info.PostRemoves = make([]Datagram, dgi.ReadUint16())
+	for n := range info.PostRemoves {
+		info.PostRemoves[n] = *dgi.ReadDatagram()
+	}
+
+	info.Routed = dgi.ReadUint64()
+	info.Delivered = dgi.ReadUint64()
+	info.Queued = dgi.ReadUint32()
+	info.Outbound = dgi.ReadUint32()
+	info.Dropped = dgi.ReadUint64()
+	return info
+}
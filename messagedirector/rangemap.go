@@ -0,0 +1,222 @@
+package messagedirector
+
+import (
+	. "otpgo/util"
+	"slices"
+	"sort"
+	"sync"
+)
+
+type Range struct {
+	Min Channel_t
+	Max Channel_t
+}
+
+func (r Range) Size() Channel_t {
+	return r.Max - r.Min
+}
+
+func (r Range) Contains(ch Channel_t) bool {
+	return r.Min <= ch && ch <= r.Max
+}
+
+// segment is a run of channels which all share the exact same set of subscribers.
+type segment struct {
+	Range
+	// subs is copy-on-write; once a segment is published the slice is never mutated in place,
+	// which lets Lookup hand it out without holding the lock.
+	subs []*Subscriber
+}
+
+// RangeMap indexes range subscriptions as a sorted list of non-overlapping segments.
+//
+//	Subscribing [1000, 1999] and [1500, 2500] yields three segments:
+//	[1000, 1499] => {A}, [1500, 1999] => {A, B}, [2000, 2500] => {B}
+//
+// Routing a channel is a binary search over the segments, so its cost only grows with the
+// logarithm of the number of distinct boundaries, never with the number of subscribers.
+// Adjacent segments with identical subscriber sets are always coalesced.
+type RangeMap struct {
+	sync.RWMutex
+	segments []segment
+}
+
+func NewRangeMap() *RangeMap {
+	return &RangeMap{segments: make([]segment, 0)}
+}
+
+// search returns the index of the first segment that ends at or after ch.
+func (r *RangeMap) search(ch Channel_t) int {
+	return sort.Search(len(r.segments), func(i int) bool {
+		return r.segments[i].Max >= ch
+	})
+}
+
+// Lookup returns every subscriber which has a range containing the given channel.
+// The returned slice must not be modified.
+func (r *RangeMap) Lookup(ch Channel_t) []*Subscriber {
+	r.RLock()
+	defer r.RUnlock()
+
+	if i := r.search(ch); i < len(r.segments) && r.segments[i].Min <= ch {
+		return r.segments[i].subs
+	}
+	return nil
+}
+
+// IsSubscribed returns true if any subscriber has a range containing the given channel.
+func (r *RangeMap) IsSubscribed(ch Channel_t) bool {
+	return len(r.Lookup(ch)) > 0
+}
+
+// split makes sure that a segment boundary starts at the given channel.
+func (r *RangeMap) split(at Channel_t) {
+	i := r.search(at)
+	if i == len(r.segments) || r.segments[i].Min >= at {
+		return
+	}
+
+	seg := r.segments[i]
+	lo := segment{Range{seg.Min, at - 1}, seg.subs}
+	hi := segment{Range{at, seg.Max}, seg.subs}
+	r.segments[i] = lo
+	r.segments = slices.Insert(r.segments, i+1, hi)
+}
+
+// window splits the segments on the edges of a range and returns the [lo, hi) indices of
+// the segments contained within it.
+func (r *RangeMap) window(rng Range) (int, int) {
+	r.split(rng.Min)
+	if rng.Max != CHANNEL_MAX {
+		r.split(rng.Max + 1)
+	}
+
+	lo := r.search(rng.Min)
+	hi := lo
+	for hi < len(r.segments) && r.segments[hi].Max <= rng.Max {
+		hi++
+	}
+	return lo, hi
+}
+
+// coalesce merges adjacent segments with identical subscribers between the given indices.
+func (r *RangeMap) coalesce(lo int, hi int) {
+	lo = max(lo, 1)
+	hi = min(hi, len(r.segments)-1)
+	for i := hi; i >= lo; i-- {
+		prev, cur := r.segments[i-1], r.segments[i]
+		if prev.Max+1 == cur.Min && sameSubscribers(prev.subs, cur.subs) {
+			r.segments[i-1].Max = cur.Max
+			r.segments = slices.Delete(r.segments, i, i+1)
+		}
+	}
+}
+
+func (r *RangeMap) Add(rng Range, sub *Subscriber) {
+	r.Lock()
+	defer r.Unlock()
+
+	lo, hi := r.window(rng)
+
+	// Rebuild the window, filling gaps between existing segments with new ones.
+	replacement := make([]segment, 0, (hi-lo)*2+1)
+	cursor, done := rng.Min, false
+	for _, seg := range r.segments[lo:hi] {
+		if cursor < seg.Min {
+			replacement = append(replacement, segment{Range{cursor, seg.Min - 1}, []*Subscriber{sub}})
+		}
+		if !slices.Contains(seg.subs, sub) {
+			seg.subs = append(slices.Clip(seg.subs), sub)
+		}
+		replacement = append(replacement, seg)
+		if seg.Max == CHANNEL_MAX {
+			done = true
+			break
+		}
+		cursor = seg.Max + 1
+	}
+	if !done && cursor <= rng.Max {
+		replacement = append(replacement, segment{Range{cursor, rng.Max}, []*Subscriber{sub}})
+	}
+
+	r.segments = slices.Replace(r.segments, lo, hi, replacement...)
+	r.coalesce(lo, lo+len(replacement))
+}
+
+// Remove unsubscribes a subscriber from a range. It returns the (merged) ranges which no
+// longer have any subscribers; upstream MDs only need to be told about these.
+func (r *RangeMap) Remove(rng Range, sub *Subscriber) []Range {
+	r.Lock()
+	defer r.Unlock()
+
+	lo, hi := r.window(rng)
+
+	var silenced []Range
+	replacement := make([]segment, 0, hi-lo)
+	for _, seg := range r.segments[lo:hi] {
+		if i := slices.Index(seg.subs, sub); i != -1 {
+			seg.subs = slices.Delete(slices.Clone(seg.subs), i, i+1)
+		}
+		if len(seg.subs) > 0 {
+			replacement = append(replacement, seg)
+			continue
+		}
+
+		if n := len(silenced); n > 0 && silenced[n-1].Max+1 == seg.Min {
+			silenced[n-1].Max = seg.Max
+		} else {
+			silenced = append(silenced, seg.Range)
+		}
+	}
+
+	r.segments = slices.Replace(r.segments, lo, hi, replacement...)
+	r.coalesce(lo, lo+len(replacement))
+	return silenced
+}
+
+func sameSubscribers(a []*Subscriber, b []*Subscriber) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, sub := range a {
+		if !slices.Contains(b, sub) {
+			return false
+		}
+	}
+	return true
+}
+
+// addRange merges a range into a sorted list of non-overlapping ranges.
+func addRange(ranges []Range, rng Range) []Range {
+	result := make([]Range, 0, len(ranges)+1)
+	for _, r := range ranges {
+		switch {
+		case r.Max != CHANNEL_MAX && r.Max+1 < rng.Min:
+			result = append(result, r)
+		case rng.Max != CHANNEL_MAX && rng.Max+1 < r.Min:
+			result = append(result, rng)
+			rng = r
+		default:
+			rng = Range{min(r.Min, rng.Min), max(r.Max, rng.Max)}
+		}
+	}
+	return append(result, rng)
+}
+
+// removeRange cuts a range out of a sorted list of non-overlapping ranges.
+func removeRange(ranges []Range, rng Range) []Range {
+	result := make([]Range, 0, len(ranges)+1)
+	for _, r := range ranges {
+		if r.Max < rng.Min || r.Min > rng.Max {
+			result = append(result, r)
+			continue
+		}
+		if r.Min < rng.Min {
+			result = append(result, Range{r.Min, rng.Min - 1})
+		}
+		if r.Max > rng.Max {
+			result = append(result, Range{rng.Max + 1, r.Max})
+		}
+	}
+	return result
+}
@@ -0,0 +1,289 @@
+package messagedirector
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"otpgo/core"
+	. "otpgo/util"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Recordings start with recordingMagic, the format version and the time the recording was started
+// in nanoseconds. They are followed by records, each starting with its type:
+//
+//	recordParticipant: uvarint id, uvarint name length, name
+//	recordDatagram:    uvarint microseconds since the previous record, uvarint sender id,
+//	                   uvarint datagram length, datagram
+//
+// A participant record is written whenever a sender is first seen or has been renamed. Datagrams
+// routed from the upstream MD have a sender id of 0.
+const (
+	recordingMagic   = "OTPGOREC"
+	recordingVersion = uint16(1)
+
+	recordParticipant = byte('P')
+	recordDatagram    = byte('D')
+)
+
+// Recorder writes every datagram routed through the MD to a file, to be replayed later.
+type Recorder struct {
+	sync.Mutex
+
+	file  *os.File
+	w     *bufio.Writer
+	last  time.Time
+	names map[uint32]string
+	err   error
+
+	stop chan bool
+}
+
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Recorder{
+		file:  file,
+		w:     bufio.NewWriter(file),
+		last:  time.Now(),
+		names: make(map[uint32]string),
+		stop:  make(chan bool),
+	}
+
+	r.w.WriteString(recordingMagic)
+	binary.Write(r.w, binary.LittleEndian, recordingVersion)
+	binary.Write(r.w, binary.LittleEndian, r.last.UnixNano())
+
+	go r.flushLoop()
+	return r, nil
+}
+
+// flushLoop periodically flushes the recording to disk until the recorder is closed or the daemon stops.
+func (r *Recorder) flushLoop() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.Lock()
+			r.flush()
+			r.Unlock()
+		case <-core.StopChan:
+			r.Close()
+			return
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// flush must be called with the recorder locked.
+func (r *Recorder) flush() {
+	if r.err == nil {
+		r.err = r.w.Flush()
+		if r.err != nil {
+			MDLog.Errorf("Stopped recording after failing to write: %s", r.err)
+		}
+	}
+}
+
+func (r *Recorder) Record(dg Datagram, sender MDParticipant) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.err != nil || r.file == nil {
+		return
+	}
+
+	var id uint32
+	if sender != nil {
+		id = sender.Id()
+		if name := sender.Name(); r.names[id] != name {
+			r.names[id] = name
+			r.w.WriteByte(recordParticipant)
+			r.writeUvarint(uint64(id))
+			r.writeBytes([]byte(name))
+		}
+	}
+
+	now := time.Now()
+	elapsed := now.Sub(r.last)
+	r.last = now
+
+	r.w.WriteByte(recordDatagram)
+	r.writeUvarint(uint64(max(elapsed.Microseconds(), 0)))
+	r.writeUvarint(uint64(id))
+	r.writeBytes(dg.Bytes())
+}
+
+func (r *Recorder) writeUvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	r.w.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (r *Recorder) writeBytes(data []byte) {
+	r.writeUvarint(uint64(len(data)))
+	r.w.Write(data)
+}
+
+// Close flushes the recording and closes its file.
+func (r *Recorder) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.file == nil {
+		return nil
+	}
+
+	r.flush()
+	err := r.file.Close()
+	r.file = nil
+	close(r.stop)
+	return errors.Join(r.err, err)
+}
+
+// RecordedDatagram is a datagram read back from a recording.
+type RecordedDatagram struct {
+	Time time.Time
+	// Sender is the id of the participant which routed the datagram; SenderName is its name at the time.
+	Sender     uint32
+	SenderName string
+	Datagram   Datagram
+}
+
+// Recipients and MsgType panic with a DatagramIteratorEOF if the datagram is truncated.
+
+// Recipients returns the channels the datagram was addressed to.
+func (d *RecordedDatagram) Recipients() []Channel_t {
+	dgi := NewDatagramIterator(&d.Datagram)
+	recipients := make([]Channel_t, dgi.ReadUint8())
+	for n := range recipients {
+		recipients[n] = dgi.ReadChannel()
+	}
+	return recipients
+}
+
+// MsgType returns the message type of the datagram; control messages don't have a sender channel.
+func (d *RecordedDatagram) MsgType() uint16 {
+	recipients := d.Recipients()
+	dgi := NewDatagramIterator(&d.Datagram)
+	dgi.SeekPayload()
+	if !slices.Equal(recipients, []Channel_t{CONTROL_MESSAGE}) {
+		dgi.ReadChannel()
+	}
+	return dgi.ReadUint16()
+}
+
+// RecordingReader reads datagrams back from a recording.
+type RecordingReader struct {
+	r     *bufio.Reader
+	file  *os.File
+	time  time.Time
+	names map[uint32]string
+}
+
+func OpenRecording(path string) (*RecordingReader, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := &RecordingReader{
+		r:     bufio.NewReader(file),
+		file:  file,
+		names: make(map[uint32]string),
+	}
+
+	magic := make([]byte, len(recordingMagic))
+	var version uint16
+	var start int64
+	if _, err := io.ReadFull(reader.r, magic); err != nil || !bytes.Equal(magic, []byte(recordingMagic)) {
+		file.Close()
+		return nil, fmt.Errorf("%s is not a recording", path)
+	}
+	if err := binary.Read(reader.r, binary.LittleEndian, &version); err != nil || version != recordingVersion {
+		file.Close()
+		return nil, fmt.Errorf("%s has an unsupported recording version %d", path, version)
+	}
+	if err := binary.Read(reader.r, binary.LittleEndian, &start); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("%s is truncated", path)
+	}
+
+	reader.time = time.Unix(0, start)
+	return reader, nil
+}
+
+// Next returns the next datagram in the recording, or io.EOF once it has been read entirely.
+func (r *RecordingReader) Next() (RecordedDatagram, error) {
+	for {
+		kind, err := r.r.ReadByte()
+		if err != nil {
+			return RecordedDatagram{}, err
+		}
+
+		switch kind {
+		case recordParticipant:
+			id, err := binary.ReadUvarint(r.r)
+			if err != nil {
+				return RecordedDatagram{}, r.truncated(err)
+			}
+			name, err := r.readBytes()
+			if err != nil {
+				return RecordedDatagram{}, r.truncated(err)
+			}
+			r.names[uint32(id)] = string(name)
+		case recordDatagram:
+			elapsed, err := binary.ReadUvarint(r.r)
+			if err != nil {
+				return RecordedDatagram{}, r.truncated(err)
+			}
+			sender, err := binary.ReadUvarint(r.r)
+			if err != nil {
+				return RecordedDatagram{}, r.truncated(err)
+			}
+			data, err := r.readBytes()
+			if err != nil {
+				return RecordedDatagram{}, r.truncated(err)
+			}
+
+			r.time = r.time.Add(time.Duration(elapsed) * time.Microsecond)
+			dg := NewDatagram()
+			dg.Write(data)
+			return RecordedDatagram{r.time, uint32(sender), r.names[uint32(sender)], dg}, nil
+		default:
+			return RecordedDatagram{}, fmt.Errorf("unknown record type %d", kind)
+		}
+	}
+}
+
+func (r *RecordingReader) readBytes() ([]byte, error) {
+	length, err := binary.ReadUvarint(r.r)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(r.r, data)
+	return data, err
+}
+
+func (r *RecordingReader) truncated(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (r *RecordingReader) Close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,67 @@
+package messagedirector
+
+import (
+	"errors"
+	"io"
+	. "otpgo/util"
+	"time"
+)
+
+// replayParticipant routes recorded datagrams back through the MD.
+type replayParticipant struct {
+	MDParticipantBase
+}
+
+func (r *replayParticipant) HandleDatagram(dg Datagram, dgi *DatagramIterator) { /* not subscribed */ }
+func (r *replayParticipant) ReceiveDatagram(dg Datagram)                       { /* not needed */ }
+func (r *replayParticipant) Terminate(err error)                               { /* not needed */ }
+
+// Replay routes every datagram of a recording accepted by filter through the MD, returning how many
+// were replayed. Datagrams are spaced out as they were recorded, sped up by speed; if speed is 0,
+// they are replayed as fast as possible.
+func Replay(reader *RecordingReader, filter func(*RecordedDatagram) bool, speed float64) (int, error) {
+	participant := &replayParticipant{}
+	participant.Init(participant)
+	participant.SetName("replay")
+	defer participant.Cleanup()
+
+	var previous time.Time
+	replayed := 0
+	for {
+		rec, err := reader.Next()
+		if errors.Is(err, io.EOF) {
+			// Wait for the replayed datagrams to be routed before letting go of the participant.
+			for MD.QueueStats().Queued > 0 {
+				time.Sleep(10 * time.Millisecond)
+			}
+			return replayed, nil
+		} else if err != nil {
+			return replayed, err
+		}
+
+		if filter != nil && !accepts(filter, &rec) {
+			continue
+		}
+
+		if speed > 0 && !previous.IsZero() {
+			time.Sleep(time.Duration(float64(rec.Time.Sub(previous)) / speed))
+		}
+		previous = rec.Time
+
+		participant.RouteDatagram(rec.Datagram)
+		replayed++
+	}
+}
+
+// accepts runs a replay filter; truncated datagrams are never accepted.
+func accepts(filter func(*RecordedDatagram) bool, rec *RecordedDatagram) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, eof := r.(DatagramIteratorEOF); !eof {
+				panic(r)
+			}
+			ok = false
+		}
+	}()
+	return filter(rec)
+}
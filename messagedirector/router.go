@@ -0,0 +1,305 @@
+package messagedirector
+
+import (
+	"otpgo/core"
+	. "otpgo/util"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// routeItem is a queued datagram along with the lane of the participant that sent it.
+type routeItem struct {
+	QueueEntry
+	lane *routeLane
+}
+
+// routeLane tracks where a sender's datagrams are currently queued. As long as a sender has
+// datagrams waiting in a shard, everything else it sends is queued on that same shard; this is
+// what guarantees that datagrams from a single sender are always routed in the order they were sent.
+type routeLane struct {
+	sync.Mutex
+
+	shard   *routeShard
+	group   uint64
+	pending int
+}
+
+func (l *routeLane) release() {
+	l.Lock()
+	l.pending--
+	if l.pending == 0 {
+		l.shard = nil
+	}
+	l.Unlock()
+}
+
+// routeShard routes its queue on a dedicated goroutine. The queue is made of groups: RouteDatagram
+// starts a new group, while RouteDatagramEarly appends to the group that is currently being routed
+// so that datagrams belonging to the same flow are processed back-to-back.
+type routeShard struct {
+	router *Router
+
+	lock   sync.Mutex
+	groups [][]routeItem
+	// first is the sequence number of the group at the head of the queue.
+	first uint64
+	// depth is the number of datagrams in the queue.
+	depth int
+
+	// push will insert to this channel to let the shard know there are datagrams to be processed.
+	wake chan bool
+}
+
+// push queues a datagram; the caller must hold the lock of the item's lane. An early datagram may
+// only join the current group if it would not overtake anything its sender has queued before it.
+func (s *routeShard) push(item routeItem, early bool) {
+	lane := item.lane
+
+	s.lock.Lock()
+	if early && len(s.groups) > 0 && (lane.pending == 0 || lane.group == s.first) {
+		s.groups[0] = append(s.groups[0], item)
+		lane.group = s.first
+	} else {
+		s.groups = append(s.groups, []routeItem{item})
+		lane.group = s.first + uint64(len(s.groups)-1)
+	}
+	lane.pending++
+	s.depth++
+	s.lock.Unlock()
+
+	select {
+	case s.wake <- true:
+	default:
+	}
+}
+
+// next pops the next datagram off the queue. The current group is only discarded once it has been
+// drained, so that datagrams appended to it while routing are picked up first.
+func (s *routeShard) next() (routeItem, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for len(s.groups) > 0 {
+		if len(s.groups[0]) > 0 {
+			item := s.groups[0][0]
+			s.groups[0] = s.groups[0][1:]
+			s.depth--
+			return item, true
+		}
+		s.groups[0] = nil
+		s.groups = s.groups[1:]
+		s.first++
+	}
+	return routeItem{}, false
+}
+
+func (s *routeShard) loop() {
+	for {
+		select {
+		case <-s.wake:
+			for {
+				item, ok := s.next()
+				if !ok {
+					break
+				}
+				s.route(item.QueueEntry)
+				s.router.release(item.lane)
+			}
+		case <-s.router.stop:
+			return
+		}
+	}
+}
+
+func (s *routeShard) route(obj QueueEntry) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(DatagramIteratorEOF); ok {
+				MDLog.Error("Reached end of datagram")
+				// TODO
+			}
+		}
+	}()
+
+	if recorder := s.router.md.recorder; recorder != nil {
+		recorder.Record(obj.dg, obj.md)
+	}
+
+	// Iterate the datagram for receivers
+	var receivers []Channel_t
+	dgi := NewDatagramIterator(&obj.dg)
+	chanCount := dgi.ReadUint8()
+	for n := 0; uint8(n) < chanCount; n++ {
+		receivers = append(receivers, dgi.ReadChannel())
+	}
+
+	// Send payload datagram to every available receiver
+	seekDgi := NewDatagramIterator(&obj.dg)
+	seekDgi.Seek(dgi.Tell())
+	mdDg := &MDDatagram{dg: seekDgi, sender: obj.md, shard: s}
+	for _, recv := range receivers {
+		channelMap.Send(recv, mdDg)
+	}
+
+	// Send message upstream if necessary
+	if obj.md != nil && s.router.md.upstream != nil {
+		s.router.md.upstream.HandleDatagram(obj.dg, nil)
+	}
+}
+
+// Router distributes datagrams over a set of shards which are routed concurrently. Ordering is
+// only guaranteed between datagrams of the same sender, which is all that participants may rely on.
+type Router struct {
+	md     *MessageDirector
+	shards []*routeShard
+
+	// upstream is the lane for datagrams received from the upstream MD, which have no participant.
+	upstream routeLane
+
+	// Senders are held back once they have laneLimit datagrams waiting to be routed, or once
+	// totalLimit datagrams are waiting across the whole MD.
+	laneLimit  int
+	totalLimit int
+	queued     atomic.Int64
+	// waiting counts the senders blocked on space.
+	waiting   atomic.Int32
+	spaceLock sync.Mutex
+	space     *sync.Cond
+
+	stop chan bool
+}
+
+func NewRouter(md *MessageDirector, workers int, laneLimit int, totalLimit int) *Router {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+
+	r := &Router{md: md, laneLimit: laneLimit, totalLimit: totalLimit, stop: make(chan bool)}
+	r.space = sync.NewCond(&r.spaceLock)
+	r.shards = make([]*routeShard, workers)
+	for n := range r.shards {
+		r.shards[n] = &routeShard{router: r, wake: make(chan bool, 1)}
+	}
+	return r
+}
+
+func (r *Router) Start() {
+	for _, shard := range r.shards {
+		go shard.loop()
+	}
+
+	// Routing carries on after an interrupt, so that clients can be drained before the daemon exits.
+	go func() {
+		<-core.StopChan
+		close(r.stop)
+	}()
+}
+
+// home returns the shard a sender's datagrams are queued on when it has nothing in flight.
+func (r *Router) home(sender MDParticipant) *routeShard {
+	if sender == nil {
+		return r.shards[0]
+	}
+	return r.shards[sender.Id()%uint32(len(r.shards))]
+}
+
+// route queues a datagram on the given lane. Early datagrams join the group that is currently
+// being routed; when the sender is handling a datagram on behalf of a shard, they join that shard's
+// current group so that responses are routed directly after the datagram which triggered them.
+func (r *Router) route(entry QueueEntry, lane *routeLane, early bool) {
+	lane.Lock()
+	defer lane.Unlock()
+
+	if lane.shard == nil {
+		lane.shard = r.home(entry.md)
+		if early && entry.md != nil {
+			if sub := entry.md.Subscriber(); sub != nil {
+				if shard := sub.delivering.Load(); shard != nil {
+					lane.shard = shard
+				}
+			}
+		}
+	}
+	r.queued.Add(1)
+	lane.shard.push(routeItem{entry, lane}, early)
+}
+
+// routeWait queues a datagram once its lane and the MD as a whole are within their limits.
+// It must only be used by senders which don't hold anything the shards may need, such as
+// the read loops of network connections; participants within the daemon are never held back.
+func (r *Router) routeWait(entry QueueEntry, lane *routeLane) {
+	r.admit(lane)
+	r.route(entry, lane, false)
+}
+
+func (r *Router) full(lane *routeLane) bool {
+	if r.totalLimit > 0 && r.queued.Load() >= int64(r.totalLimit) {
+		return true
+	}
+
+	lane.Lock()
+	defer lane.Unlock()
+	return r.laneLimit > 0 && lane.pending >= r.laneLimit
+}
+
+// admit blocks until the sender's lane and the MD as a whole have room for another datagram.
+func (r *Router) admit(lane *routeLane) {
+	if !r.full(lane) {
+		return
+	}
+
+	r.spaceLock.Lock()
+	r.waiting.Add(1)
+	for r.full(lane) {
+		r.space.Wait()
+	}
+	r.waiting.Add(-1)
+	r.spaceLock.Unlock()
+}
+
+func (r *Router) release(lane *routeLane) {
+	lane.release()
+	r.queued.Add(-1)
+
+	if r.waiting.Load() > 0 {
+		r.spaceLock.Lock()
+		r.space.Broadcast()
+		r.spaceLock.Unlock()
+	}
+}
+
+// QueueStats reports how many datagrams are waiting to be routed.
+type QueueStats struct {
+	Queued int
+	// Shards holds the number of datagrams waiting on each shard.
+	Shards []int
+	// Blocked is the number of connections held back until the MD has room for their datagrams.
+	Blocked int
+}
+
+// Idle returns whether every queued datagram has been routed.
+func (r *Router) Idle() bool {
+	return r.queued.Load() == 0
+}
+
+func (r *Router) Stats() QueueStats {
+	stats := QueueStats{
+		Queued:  int(r.queued.Load()),
+		Shards:  make([]int, len(r.shards)),
+		Blocked: int(r.waiting.Load()),
+	}
+	for n, shard := range r.shards {
+		shard.lock.Lock()
+		stats.Shards[n] = shard.depth
+		shard.lock.Unlock()
+	}
+	return stats
+}
+
+// Pending returns the number of datagrams a lane has waiting to be routed.
+func (l *routeLane) Pending() int {
+	l.Lock()
+	defer l.Unlock()
+	return l.pending
+}
@@ -1,96 +1,339 @@
 package messagedirector
 
 import (
+	"crypto/tls"
 	gonet "net"
-	"os"
 	"otpgo/core"
 	"otpgo/net"
 	. "otpgo/util"
+	"sync"
 	"time"
 )
 
+const (
+	defaultReconnectMinDelay = 500 * time.Millisecond
+	defaultReconnectMaxDelay = 30 * time.Second
+	defaultUpstreamBuffer    = 4 * 1024 * 1024
+)
+
 type MDUpstream struct {
 	MDParticipantBase
 
-	md     *MessageDirector
+	md      *MessageDirector
+	address string
+	// tlsConfig is set if the link has to be encrypted.
+	tlsConfig *tls.Config
+
+	// lock guards the link and everything that has to be replayed when it is re-established.
+	lock sync.Mutex
+	link *upstreamLink
+
+	// The upstream MD forgets about us when the link drops, so we mirror what it has been
+	// told in order to replay it after reconnecting. Post-removes are kept in MDParticipantBase.
+	channels map[Channel_t]struct{}
+	ranges   []Range
+
+	// Datagrams routed while the link is down are held until it comes back, up to bufferLimit bytes.
+	backlog     []Datagram
+	backlogSize int
+	bufferLimit int
+	dropped     int
+
+	minDelay time.Duration
+	maxDelay time.Duration
+}
+
+// upstreamLink is a single connection to the upstream MD.
+type upstreamLink struct {
+	up     *MDUpstream
 	client *net.Client
 }
 
+func (l *upstreamLink) ReceiveDatagram(dg Datagram) {
+	l.up.ReceiveDatagram(dg)
+}
+
+func (l *upstreamLink) HandleDatagram(dg Datagram, dgi *DatagramIterator) { /* not needed */ }
+
+func (l *upstreamLink) Terminate(err error) {
+	// The client may call us while holding its own lock, so we can't reconnect synchronously.
+	go l.up.lost(l, err)
+}
+
 func NewMDUpstream(md *MessageDirector, address string) *MDUpstream {
-	up := &MDUpstream{md: md}
+	config := core.Config.MessageDirector.Reconnect
+	up := &MDUpstream{
+		md:          md,
+		address:     address,
+		channels:    make(map[Channel_t]struct{}),
+		ranges:      make([]Range, 0),
+		backlog:     make([]Datagram, 0),
+		bufferLimit: config.Buffer,
+		minDelay:    time.Duration(config.Min_Delay) * time.Millisecond,
+		maxDelay:    time.Duration(config.Max_Delay) * time.Millisecond,
+	}
+	up.postRemoves = []Datagram{}
+	up.name = core.Config.Daemon.Name
+
+	if up.bufferLimit == 0 {
+		up.bufferLimit = defaultUpstreamBuffer
+	}
+	if up.minDelay == 0 {
+		up.minDelay = defaultReconnectMinDelay
+	}
+	if up.maxDelay == 0 {
+		up.maxDelay = defaultReconnectMaxDelay
+	}
+	up.maxDelay = max(up.maxDelay, up.minDelay)
 
-	conn, err := gonet.Dial("tcp", address)
+	if tlsConfig := core.Config.MessageDirector.TLS; tlsConfig.Enabled {
+		var err error
+		up.tlsConfig, err = net.NewTLSConfig(tlsConfig.Cert, tlsConfig.Key, tlsConfig.Ca, false)
+		if err != nil {
+			MDLog.Fatalf("Unable to set up TLS for the upstream link: %s", err)
+		}
+		if host, _, err := gonet.SplitHostPort(address); err == nil {
+			up.tlsConfig.ServerName = host
+		}
+	}
+
+	if err := up.connect(); err != nil {
+		MDLog.Errorf("upstream failed to connect: %s", err)
+		go up.reconnect()
+	}
+	return up
+}
+
+func (m *MDUpstream) connect() error {
+	var conn gonet.Conn
+	var err error
+	if m.tlsConfig != nil {
+		network, addr := net.SplitAddress(m.address)
+		dialer := &gonet.Dialer{Timeout: tlsHandshakeTimeout}
+		conn, err = tls.DialWithDialer(dialer, network, addr, m.tlsConfig)
+	} else {
+		conn, err = net.Dial(m.address)
+	}
 	if err != nil {
-		MDLog.Fatalf("upstream failed to connect: %s", err)
-		return nil
+		return err
 	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	link := &upstreamLink{up: m}
 	socket := net.NewSocketTransport(conn, 0, 4096)
-	up.client = net.NewClient(socket, up, 60*time.Second)
-	MDLog.Infof("Successfully connected to upstream at %s", address)
-	if core.Config.Daemon.Name != "" {
-		up.SetName(core.Config.Daemon.Name)
+	link.client = net.NewClient(socket, link, 60*time.Second)
+	m.link = link
+
+	MDLog.Infof("Successfully connected to upstream at %s", m.address)
+	m.replay()
+	return nil
+}
+
+// reconnect dials the upstream MD until it succeeds or the daemon stops, backing off exponentially
+// between attempts.
+func (m *MDUpstream) reconnect() {
+	delay := m.minDelay
+	for {
+		select {
+		case <-time.After(delay):
+		case <-core.StopChan:
+			return
+		}
+		err := m.connect()
+		if err == nil {
+			return
+		}
+		delay = min(delay*2, m.maxDelay)
+		MDLog.Warnf("upstream failed to reconnect, retrying in %s: %s", delay, err)
 	}
-	return up
 }
 
-func (m *MDUpstream) SubscribeChannel(ch Channel_t) {
-	dg := NewDatagram()
-	dg.AddControlHeader(CONTROL_SET_CHANNEL)
-	dg.AddChannel(ch)
-	m.client.SendDatagram(dg)
+func (m *MDUpstream) lost(link *upstreamLink, err error) {
+	m.lock.Lock()
+	if m.link != link {
+		// This link has already been replaced.
+		m.lock.Unlock()
+		return
+	}
+	m.link = nil
+	m.lock.Unlock()
+
+	MDLog.Errorf("Lost connection to upstream MD: %s", err)
+	link.client.Close(true)
+	m.reconnect()
 }
 
-func (m *MDUpstream) UnsubscribeChannel(ch Channel_t) {
+// replay restores our state on a freshly connected upstream MD and flushes the backlog.
+// The caller must hold the lock.
+func (m *MDUpstream) replay() {
+	if secret := m.md.getSecret(); secret != "" {
+		m.send(authenticateDatagram(secret))
+	}
+	if m.name != "" {
+		m.send(setConNameDatagram(m.name))
+	}
+	for ch := range m.channels {
+		m.send(channelDatagram(CONTROL_SET_CHANNEL, ch))
+	}
+	for _, rng := range m.ranges {
+		m.send(rangeDatagram(CONTROL_ADD_RANGE, rng))
+	}
+	for _, pr := range m.postRemoves {
+		m.send(postRemoveDatagram(pr))
+	}
+
+	if m.dropped > 0 {
+		MDLog.Warnf("Dropped %d datagrams while the upstream link was down", m.dropped)
+		m.dropped = 0
+	}
+	for _, dg := range m.backlog {
+		m.send(dg)
+	}
+	m.backlog = m.backlog[:0]
+	m.backlogSize = 0
+}
+
+// send writes a datagram to the upstream MD; it is discarded if the link is down.
+// The caller must hold the lock.
+func (m *MDUpstream) send(dg Datagram) {
+	if m.link != nil {
+		m.link.client.SendDatagram(dg)
+	}
+}
+
+func channelDatagram(msgType uint16, ch Channel_t) Datagram {
 	dg := NewDatagram()
-	dg.AddControlHeader(CONTROL_REMOVE_CHANNEL)
+	dg.AddControlHeader(msgType)
 	dg.AddChannel(ch)
-	m.client.SendDatagram(dg)
+	return dg
 }
 
-func (m *MDUpstream) SubscribeRange(lo Channel_t, hi Channel_t) {
+func rangeDatagram(msgType uint16, rng Range) Datagram {
 	dg := NewDatagram()
-	dg.AddControlHeader(CONTROL_ADD_RANGE)
-	dg.AddChannel(lo)
-	dg.AddChannel(hi)
-	m.client.SendDatagram(dg)
+	dg.AddControlHeader(msgType)
+	dg.AddChannel(rng.Min)
+	dg.AddChannel(rng.Max)
+	return dg
 }
 
-func (m *MDUpstream) UnsubscribeRange(lo Channel_t, hi Channel_t) {
+func authenticateDatagram(secret string) Datagram {
 	dg := NewDatagram()
-	dg.AddControlHeader(CONTROL_REMOVE_RANGE)
-	dg.AddChannel(lo)
-	dg.AddChannel(hi)
-	m.client.SendDatagram(dg)
+	dg.AddControlHeader(CONTROL_AUTHENTICATE)
+	dg.AddString(secret)
+	return dg
 }
 
-func (m *MDUpstream) SetName(name string) {
+func setConNameDatagram(name string) Datagram {
 	dg := NewDatagram()
 	dg.AddControlHeader(CONTROL_SET_CON_NAME)
 	dg.AddString(name)
-	m.client.SendDatagram(dg)
+	return dg
+}
+
+func postRemoveDatagram(pr Datagram) Datagram {
+	dg := NewDatagram()
+	dg.AddControlHeader(CONTROL_ADD_POST_REMOVE)
+	dg.AddBlob(&pr)
+	return dg
+}
+
+func (m *MDUpstream) SubscribeChannel(ch Channel_t) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.channels[ch] = struct{}{}
+	m.send(channelDatagram(CONTROL_SET_CHANNEL, ch))
+}
+
+func (m *MDUpstream) UnsubscribeChannel(ch Channel_t) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delete(m.channels, ch)
+	m.send(channelDatagram(CONTROL_REMOVE_CHANNEL, ch))
+}
+
+func (m *MDUpstream) SubscribeRange(lo Channel_t, hi Channel_t) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.ranges = addRange(m.ranges, Range{lo, hi})
+	m.send(rangeDatagram(CONTROL_ADD_RANGE, Range{lo, hi}))
+}
+
+func (m *MDUpstream) UnsubscribeRange(lo Channel_t, hi Channel_t) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.ranges = removeRange(m.ranges, Range{lo, hi})
+	m.send(rangeDatagram(CONTROL_REMOVE_RANGE, Range{lo, hi}))
+}
+
+func (m *MDUpstream) AddPostRemove(pr Datagram) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.postRemoves = append(m.postRemoves, pr)
+	m.send(postRemoveDatagram(pr))
+}
+
+func (m *MDUpstream) ClearPostRemoves() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.postRemoves = m.postRemoves[:0]
+	dg := NewDatagram()
+	dg.AddControlHeader(CONTROL_CLEAR_POST_REMOVES)
+	m.send(dg)
+}
+
+func (m *MDUpstream) SetName(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.name = name
+	m.send(setConNameDatagram(name))
 }
 
 func (m *MDUpstream) HandleDatagram(datagram Datagram, dgi *DatagramIterator) {
-	m.client.SendDatagram(datagram)
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.link != nil {
+		m.send(datagram)
+		return
+	}
+
+	if m.backlogSize+datagram.Len() > m.bufferLimit {
+		if m.dropped == 0 {
+			MDLog.Warnf("Upstream buffer is full; dropping datagrams until the link is re-established")
+		}
+		m.dropped++
+		return
+	}
+	m.backlog = append(m.backlog, datagram)
+	m.backlogSize += datagram.Len()
 }
 
 func (m *MDUpstream) ReceiveDatagram(datagram Datagram) {
-	MD.queueLock.Lock()
-	nextPos := MD.queuePreviousStoredPosition.Add(1)
-	queueEntry := QueueEntry{datagram, nil}
-	queueSlice := make([]QueueEntry, 0)
-	queueSlice = append(queueSlice, queueEntry)
-	MD.Queue[nextPos] = queueSlice
-	MD.queueLock.Unlock()
+	MD.router.routeWait(QueueEntry{datagram, nil}, &MD.router.upstream)
+}
 
-	select {
-	case MD.shouldProcess <- true:
-	default:
-	}
+// Idle returns whether everything routed upstream has been written to the link.
+func (m *MDUpstream) Idle() bool {
+	m.lock.Lock()
+	link := m.link
+	backlog := len(m.backlog)
+	m.lock.Unlock()
+
+	return backlog == 0 && (link == nil || link.client.Idle())
 }
 
-func (m *MDUpstream) Terminate(err error) {
-	MDLog.Fatalf("Lost connection to upstream MD: %s", err)
-	m.client.Close(true)
-	os.Exit(0)
+// Connected returns whether the link to the upstream MD is currently up.
+func (m *MDUpstream) Connected() bool {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.link != nil
 }
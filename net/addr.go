@@ -0,0 +1,71 @@
+package net
+
+import (
+	gonet "net"
+	"os"
+	"strings"
+	"time"
+)
+
+// SplitAddress returns the network and address to listen on or dial for a configured address.
+// Addresses of the form unix:/path name a unix domain socket; anything else is a TCP address.
+func SplitAddress(address string) (network string, addr string) {
+	if path, ok := strings.CutPrefix(address, "unix:"); ok {
+		return "unix", path
+	}
+	return "tcp", address
+}
+
+// Dial connects to a configured address.
+func Dial(address string) (gonet.Conn, error) {
+	return gonet.Dial(SplitAddress(address))
+}
+
+// RemoteName describes the other end of a connection for logging. The peers of a unix socket are
+// normally unnamed, so they are described by the path of the socket instead.
+func RemoteName(conn gonet.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*gonet.UnixAddr); ok {
+		if local, ok := conn.LocalAddr().(*gonet.UnixAddr); ok && (addr.Name == "" || addr.Name == "@") {
+			addr = local
+		}
+		return "unix:" + addr.Name
+	}
+	return conn.RemoteAddr().String()
+}
+
+// staleSocket returns whether path is a unix socket which nothing is accepting connections on.
+func staleSocket(path string) bool {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return false
+	}
+	return !socketInUse(path)
+}
+
+// socketInUse returns whether something is accepting connections on a unix socket.
+func socketInUse(path string) bool {
+	conn, err := gonet.DialTimeout("unix", path, time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func addrIP(addr gonet.Addr) string {
+	switch addr := addr.(type) {
+	case *gonet.TCPAddr:
+		return addr.IP.String()
+	case nil:
+		return ""
+	default:
+		return addr.String()
+	}
+}
+
+func addrPort(addr gonet.Addr) uint16 {
+	if addr, ok := addr.(*gonet.TCPAddr); ok {
+		return uint16(addr.Port)
+	}
+	return 0
+}
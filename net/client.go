@@ -2,6 +2,7 @@ package net
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"errors"
 	gonet "net"
@@ -27,6 +28,18 @@ type DatagramHandler interface {
 	Terminate(error)
 }
 
+// SizeLimitedHandler is implemented by handlers which only accept datagrams up to a maximum size.
+// Datagrams over it are rejected as soon as their length has been read, and nothing else is read
+// from the client afterwards.
+type SizeLimitedHandler interface {
+	DatagramHandler
+	// MaxDatagramSize returns the maximum size of a datagram, or 0 if there is none.
+	MaxDatagramSize() int
+	// OversizedDatagram is given the length of the rejected datagram and whatever of it had been
+	// read along with its length, which may be nothing.
+	OversizedDatagram(size int, header []byte)
+}
+
 type Client struct {
 	sync.Mutex
 	tr      Transport
@@ -34,22 +47,39 @@ type Client struct {
 	buff    bytes.Buffer
 	timeout time.Duration
 
-	remote *gonet.TCPAddr
-	local  *gonet.TCPAddr
+	// remote and local are TCP addresses unless the client is on a unix socket.
+	remote gonet.Addr
+	local  gonet.Addr
 
 	// PROXY protocol TLVs
 	tlvs           []byte
 	readBufferPool sync.Pool
 	disconnecting  atomic.Bool
+	// done is closed once the client starts disconnecting.
+	done chan struct{}
+
+	// maxSize and oversized are only used by the read loop.
+	maxSize   int
+	oversized bool
+
+	// If the client has an outbound buffer, datagrams are written from it by a dedicated goroutine.
+	out chan Datagram
 }
 
 func NewClient(tr Transport, handler DatagramHandler, timeout time.Duration) *Client {
+	return NewBufferedClient(tr, handler, timeout, 0)
+}
+
+// NewBufferedClient creates a client which queues up to outbound datagrams and writes them on a
+// dedicated goroutine, so that senders aren't held up by a slow connection.
+func NewBufferedClient(tr Transport, handler DatagramHandler, timeout time.Duration, outbound int) *Client {
 	client := &Client{
 		tr:      tr,
 		handler: handler,
-		remote:  tr.Conn().RemoteAddr().(*gonet.TCPAddr),
-		local:   tr.Conn().LocalAddr().(*gonet.TCPAddr),
+		remote:  tr.Conn().RemoteAddr(),
+		local:   tr.Conn().LocalAddr(),
 		tlvs:    []byte{},
+		done:    make(chan struct{}),
 		readBufferPool: sync.Pool{
 			New: func() any {
 				buff := make([]byte, BUFF_SIZE)
@@ -57,14 +87,26 @@ func NewClient(tr Transport, handler DatagramHandler, timeout time.Duration) *Cl
 			},
 		},
 	}
-	client.initialize()
 	client.timeout = timeout
+	if limited, ok := handler.(SizeLimitedHandler); ok {
+		client.maxSize = limited.MaxDatagramSize()
+	}
+	if outbound > 0 {
+		client.out = make(chan Datagram, outbound)
+		go client.write()
+	}
+	client.initialize()
 	return client
 }
 
 func (c *Client) initialize() {
 	// FIXME: Properly test this.
-	if proxyConn, ok := c.tr.Conn().(*proxyproto.Conn); ok {
+	conn := c.tr.Conn()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		// The PROXY header precedes the TLS handshake.
+		conn = tlsConn.NetConn()
+	}
+	if proxyConn, ok := conn.(*proxyproto.Conn); ok {
 		header := proxyConn.ProxyHeader()
 		if header != nil {
 			tlvs, err := header.TLVs()
@@ -88,6 +130,9 @@ func (c *Client) defragment() {
 	for c.buff.Len() > Blobsize {
 		data := c.buff.Bytes()
 		sz := binary.LittleEndian.Uint16(data[0:Blobsize])
+		if c.rejectOversized(sz, data[Blobsize:]) {
+			return
+		}
 		if c.buff.Len() >= int(sz+Blobsize) {
 			overreadSz := c.buff.Len() - int(sz) - int(Blobsize)
 			dg := NewDatagram()
@@ -107,29 +152,45 @@ func (c *Client) defragment() {
 	}
 }
 
+// processInput is only ever called from the read loop, so the read buffer needs no locking. The
+// client mutex is left free for writers; handlers may block without stalling datagrams sent to them.
 func (c *Client) processInput(len int, data []byte) {
-	if !c.ConnectedAndIsNotDisconnecting() {
+	if !c.ConnectedAndIsNotDisconnecting() || c.oversized {
 		return
 	}
-	c.Lock()
 
 	// Check if we have enough data for a single datagram
 	if c.buff.Len() == 0 && len >= Blobsize {
 		sz := binary.LittleEndian.Uint16(data[0:Blobsize])
+		if c.rejectOversized(sz, data[Blobsize:]) {
+			return
+		}
 		if sz == uint16(len-Blobsize) {
 			// We have enough data for a full datagram; send it off
 			dg := NewDatagram()
 			dg.Write(data[Blobsize:])
 			c.handler.ReceiveDatagram(dg)
-			c.Unlock()
 			return
 		}
 	}
 
 	c.buff.Write(data)
 	c.defragment()
-	c.Unlock()
+}
+
+// rejectOversized checks the length of an incoming datagram against the handler's maximum size.
+// read is what has been read of the datagram so far.
+func (c *Client) rejectOversized(size uint16, read []byte) bool {
+	if c.maxSize == 0 || int(size) <= c.maxSize {
+		return false
+	}
 
+	// The read buffer is reused, so the handler gets a copy.
+	header := bytes.Clone(read[:min(len(read), int(size))])
+	c.oversized = true
+	c.buff.Reset()
+	c.handler.(SizeLimitedHandler).OversizedDatagram(int(size), header)
+	return true
 }
 
 func (c *Client) read() {
@@ -151,24 +212,99 @@ func (c *Client) read() {
 	}
 }
 
+// SendDatagram writes a datagram to the connection. If the client has an outbound buffer,
+// this only blocks while the buffer is full.
 func (c *Client) SendDatagram(datagram Datagram) {
 	if !c.ConnectedAndIsNotDisconnecting() {
 		return
 	}
 
-	dg := NewDatagram()
+	if c.out != nil {
+		select {
+		case c.out <- datagram:
+		case <-c.done:
+		}
+		return
+	}
 
 	c.Lock()
 	defer c.Unlock()
 
-	dg.AddUint16(uint16(datagram.Len()))
-	dg.Write(datagram.Bytes())
-
-	if _, err := c.tr.WriteDatagram(dg); err != nil {
+	if err := c.writeDatagram(datagram); err != nil {
 		c.disconnect(err, false)
 		return
 	}
+	if err := c.flush(); err != nil {
+		c.disconnect(err, false)
+	}
+}
+
+// TrySendDatagram queues a datagram on the outbound buffer without blocking, returning false if the
+// buffer is full. Clients without an outbound buffer write the datagram synchronously.
+func (c *Client) TrySendDatagram(datagram Datagram) bool {
+	if c.out == nil || !c.ConnectedAndIsNotDisconnecting() {
+		c.SendDatagram(datagram)
+		return true
+	}
 
+	select {
+	case c.out <- datagram:
+		return true
+	default:
+		return false
+	}
+}
+
+// Outbound returns the number of datagrams waiting in the outbound buffer.
+func (c *Client) Outbound() int {
+	return len(c.out)
+}
+
+// Idle returns whether everything sent to the client has been written out.
+func (c *Client) Idle() bool {
+	if len(c.out) > 0 {
+		return false
+	}
+
+	// The write loop holds the lock while it writes a datagram it has taken off the buffer.
+	c.Lock()
+	defer c.Unlock()
+	return len(c.out) == 0
+}
+
+// write drains the outbound buffer; the transport is only flushed once the buffer runs dry.
+func (c *Client) write() {
+	for {
+		select {
+		case datagram := <-c.out:
+			c.Lock()
+			err := c.writeDatagram(datagram)
+			if err == nil && len(c.out) == 0 {
+				err = c.flush()
+			}
+			if err != nil {
+				c.disconnect(err, false)
+				c.Unlock()
+				return
+			}
+			c.Unlock()
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// writeDatagram and flush must be called with the client locked.
+func (c *Client) writeDatagram(datagram Datagram) error {
+	dg := NewDatagram()
+	dg.AddUint16(uint16(datagram.Len()))
+	dg.Write(datagram.Bytes())
+
+	_, err := c.tr.WriteDatagram(dg)
+	return err
+}
+
+func (c *Client) flush() error {
 	writeTimer := time.NewTimer(c.timeout)
 
 	select {
@@ -176,20 +312,20 @@ func (c *Client) SendDatagram(datagram Datagram) {
 		if !writeTimer.Stop() {
 			<-writeTimer.C
 		}
-		if err != nil {
-			c.disconnect(err, false)
-			return
-		}
+		return err
 	case <-writeTimer.C:
-		c.disconnect(errors.New("write timeout"), false)
-		return
+		return errors.New("write timeout")
 	}
 }
 
 // Close closes the client's transport if it isn't already closed.
 // needsLock indicates whether this function should try and acquire the client mutex; if the caller already has the mutex, set this to false.
 func (c *Client) Close(needsLock bool) {
-	if !c.disconnecting.CompareAndSwap(false, true) || !c.Connected() {
+	if !c.disconnecting.CompareAndSwap(false, true) {
+		return
+	}
+	close(c.done)
+	if !c.Connected() {
 		return
 	}
 
@@ -220,20 +356,23 @@ func (c *Client) ConnectedAndIsNotDisconnecting() bool {
 	return c.Connected() && !c.disconnecting.Load()
 }
 
+// RemoteIP and LocalIP return the address itself for clients which aren't on a TCP connection,
+// in which case RemotePort and LocalPort return 0.
+
 func (c *Client) RemoteIP() string {
-	return c.remote.IP.String()
+	return addrIP(c.remote)
 }
 
 func (c *Client) RemotePort() uint16 {
-	return uint16(c.remote.Port)
+	return addrPort(c.remote)
 }
 
 func (c *Client) LocalIP() string {
-	return c.local.IP.String()
+	return addrIP(c.local)
 }
 
 func (c *Client) LocalPort() uint16 {
-	return uint16(c.local.Port)
+	return addrPort(c.local)
 }
 
 func (c *Client) Tlvs() []byte {
@@ -89,6 +89,65 @@ func TestClient_Defragment(t *testing.T) {
 	}
 }
 
+type sizeLimitedFake struct {
+	MDParticipantFake
+	received  chan Datagram
+	oversized chan []byte
+}
+
+func (h *sizeLimitedFake) ReceiveDatagram(datagram Datagram) {
+	h.received <- datagram
+}
+
+func (h *sizeLimitedFake) MaxDatagramSize() int {
+	return 8
+}
+
+func (h *sizeLimitedFake) OversizedDatagram(size int, header []byte) {
+	if size == 100 {
+		h.oversized <- header
+	}
+}
+
+func TestClient_OversizedDatagram(t *testing.T) {
+	for _, test := range []struct {
+		chunks [][]byte
+		header string
+	}{
+		{[][]byte{{100, 0, 'h', 'e', 'a', 'd'}}, "head"},
+		{[][]byte{{100}, {0, 'h', 'e'}, {'a', 'd'}}, "he"},
+		{[][]byte{{100, 0}}, ""},
+	} {
+		server, client := net.Pipe()
+		defer server.Close()
+		handler := &sizeLimitedFake{received: make(chan Datagram, 1), oversized: make(chan []byte, 1)}
+		NewClient(NewSocketTransport(client, 0, socketBuffSize), handler, time.Second)
+
+		// Datagrams within the limit are let through
+		_, err := server.Write([]byte{2, 0, 'o', 'k'})
+		require.NoError(t, err)
+		select {
+		case dg := <-handler.received:
+			require.Equal(t, []byte("ok"), dg.Bytes())
+		case <-time.After(time.Second):
+			t.Fatal("Datagram was not received")
+		}
+
+		// The handler is given as much of an oversized datagram as had been read with its length.
+		// Nothing is read after it, so later chunks are left unwritten.
+		for _, chunk := range test.chunks {
+			server.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+			server.Write(chunk)
+		}
+		select {
+		case header := <-handler.oversized:
+			require.Equal(t, test.header, string(header))
+		case <-time.After(time.Second):
+			t.Fatal("Oversized datagram was not rejected")
+		}
+	}
+}
+
 func init() {
 	sserver, sclient = net.Pipe()
 	ssocket = &socketTransport{
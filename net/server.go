@@ -3,6 +3,7 @@
 package net
 
 import (
+	"crypto/tls"
 	"net"
 	"os"
 	"os/signal"
@@ -24,6 +25,12 @@ type Server interface {
 // NetworkServer is a base class which provides methods that accept connections.
 type NetworkServer struct {
 	Handler Server
+	// If TLSConfig is set, accepted connections are encrypted with it.
+	TLSConfig *tls.Config
+	// If WebSocket is set, connections are accepted through WebSocket handshakes on the listener.
+	WebSocket *core.ClientWebSocket
+	// X-Forwarded-For is only taken from WebSocket connections made by these proxies.
+	TrustedProxies TrustedProxies
 
 	keepAlive time.Duration
 	ln        net.Listener
@@ -46,7 +53,13 @@ func (s *NetworkServer) Shutdown() error {
 }
 
 func (s *NetworkServer) listenConn(address string, errChan chan error, useProxyProto bool) error {
-	ln, err := net.Listen("tcp", address)
+	network, addr := SplitAddress(address)
+	if network == "unix" && staleSocket(addr) {
+		// Remove a socket left behind by a daemon which didn't shut down cleanly. Anything else at
+		// the path is left alone, so listening fails instead.
+		os.Remove(addr)
+	}
+	ln, err := net.Listen(network, addr)
 	if err != nil {
 		return err
 	}
@@ -59,10 +72,16 @@ func (s *NetworkServer) listenConn(address string, errChan chan error, useProxyP
 	} else {
 		s.ln = ln
 	}
+	if s.TLSConfig != nil {
+		s.ln = tls.NewListener(s.ln, s.TLSConfig)
+	}
 
 	errChan <- nil
 	s.handleInterrupts()
 	atomic.StoreUint32(&s.listening, 1)
+	if s.WebSocket != nil {
+		return s.serveWebSocket()
+	}
 	for atomic.LoadUint32(&s.listening) == 1 {
 		conn, err := s.ln.Accept()
 		if err == nil {
@@ -5,6 +5,8 @@ import (
 	"github.com/stretchr/testify/require"
 	"io/ioutil"
 	"net"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -28,18 +30,18 @@ func TestNetworkServer_Start(t *testing.T) {
 	defer serv.Shutdown()
 
 	errChan := make(chan error)
-	go serv.Start("0:0", errChan)
+	go serv.Start("0:0", errChan, false)
 	require.NotNil(t, <-errChan)
 	serv.Shutdown()
 
-	go serv.Start("127.0.0.1:7198", errChan)
+	go serv.Start("127.0.0.1:7198", errChan, false)
 	require.Nil(t, <-errChan)
 }
 
 func TestNetworkServer_Listen(t *testing.T) {
 	msgChan = make(chan string)
 	errChan := make(chan error)
-	go serv.Start(":7198", errChan)
+	go serv.Start(":7198", errChan, false)
 	<-errChan
 
 	go func() {
@@ -57,6 +59,31 @@ func TestNetworkServer_Listen(t *testing.T) {
 	require.EqualValues(t, <-msgChan, "test123")
 }
 
+func TestNetworkServer_UnixStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "md.sock")
+
+	// A socket nothing is listening on is replaced
+	ln, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	ln.Close()
+
+	server := &NetworkServer{Handler: FakeServer{}}
+	errChan := make(chan error)
+	go server.Start("unix:"+path, errChan, false)
+	require.NoError(t, <-errChan)
+	server.Shutdown()
+
+	// Anything else is left alone
+	file := filepath.Join(t.TempDir(), "md.sock")
+	require.NoError(t, os.WriteFile(file, []byte("data"), 0600))
+	go server.Start("unix:"+file, errChan, false)
+	require.Error(t, <-errChan)
+	data, err := os.ReadFile(file)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(data))
+}
+
 func init() {
 	serv.Handler = FakeServer{}
 }
@@ -0,0 +1,156 @@
+package net
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"otpgo/core"
+	"path/filepath"
+	"time"
+)
+
+const defaultMaxVerifyDepth = 6
+
+// NewTLSConfig builds a TLS configuration from PEM files for either end of a connection. When caFile
+// is set, the other end must present a certificate signed by it; servers require one from every client.
+func NewTLSConfig(certFile string, keyFile string, caFile string, server bool) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	} else if server {
+		return nil, errors.New("a certificate is required to accept TLS connections")
+	}
+
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+
+		if server {
+			config.ClientCAs = pool
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		} else {
+			config.RootCAs = pool
+		}
+	}
+
+	return config, nil
+}
+
+// Handshake completes the TLS handshake of a connection accepted by a TLS listener, giving up once
+// timeout has passed. Connections which aren't encrypted are left alone.
+func Handshake(conn net.Conn, timeout time.Duration) error {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+
+	if err := tlsConn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	return tlsConn.SetDeadline(time.Time{})
+}
+
+// NewClientAgentTLSConfig builds the TLS configuration of a ClientAgent listener. Clients have to
+// present a certificate if a certificate authority is configured.
+func NewClientAgentTLSConfig(options core.ClientTLS) (*tls.Config, error) {
+	if options.Certificate == "" || options.Key_File == "" {
+		return nil, errors.New("both a certificate and a key_file are required")
+	}
+	if options.Sslv2 || options.Sslv3 {
+		return nil, errors.New("SSLv2 and SSLv3 are not supported")
+	}
+
+	cert, err := tls.LoadX509KeyPair(options.Certificate, options.Key_File)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load certificate: %v", err)
+	}
+	if options.Chain_File != "" {
+		chain, err := os.ReadFile(options.Chain_File)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read certificate chain: %v", err)
+		}
+		for block, rest := pem.Decode(chain); block != nil; block, rest = pem.Decode(rest) {
+			if block.Type == "CERTIFICATE" {
+				cert.Certificate = append(cert.Certificate, block.Bytes)
+			}
+		}
+	}
+
+	// Older clients may only speak TLSv1, so it stays enabled unless turned off.
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS10}
+	if options.Tlsv1 != nil && !*options.Tlsv1 {
+		config.MinVersion = tls.VersionTLS11
+	}
+
+	if options.Cert_Authority != "" {
+		pool, err := loadCertPool(options.Cert_Authority)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+
+		depth := options.Max_Verify_Depth
+		if depth == 0 {
+			depth = defaultMaxVerifyDepth
+		}
+		config.VerifyPeerCertificate = func(_ [][]byte, chains [][]*x509.Certificate) error {
+			// The depth counts the certificates above the client's own.
+			for _, chain := range chains {
+				if len(chain)-1 <= depth {
+					return nil
+				}
+			}
+			return fmt.Errorf("client certificate chain is deeper than %d", depth)
+		}
+	}
+
+	return config, nil
+}
+
+// loadCertPool loads the certificates in a PEM file, or in every PEM file of a directory.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	files := []string{path}
+	if info, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("unable to read certificate authority: %v", err)
+	} else if info.IsDir() {
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read certificate authority: %v", err)
+		}
+		files = files[:0]
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+
+	pool := x509.NewCertPool()
+	found := false
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read certificate authority: %v", err)
+		}
+		found = pool.AppendCertsFromPEM(data) || found
+	}
+	if !found {
+		return nil, fmt.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
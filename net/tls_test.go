@@ -0,0 +1,285 @@
+package net
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"github.com/stretchr/testify/require"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"otpgo/core"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert issues a certificate for localhost, signed by parent or by itself if parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return &testCert{cert, key, der}
+}
+
+// write saves the certificate and its key as PEM files in dir, returning their paths.
+func (c *testCert) write(t *testing.T, dir string, name string) (string, string) {
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600))
+
+	keyDer, err := x509.MarshalECPrivateKey(c.key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+// tlsConnect handshakes a client with the given configuration against a server with the other.
+func tlsConnect(t *testing.T, serverConfig *tls.Config, clientConfig *tls.Config) (error, error) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverConfig)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		defer conn.Close()
+		serverErr <- Handshake(conn, time.Second)
+	}()
+
+	conn, clientErr := tls.Dial("tcp", ln.Addr().String(), clientConfig)
+	if clientErr == nil {
+		// The server only rejects a client certificate after the client's side of the handshake is
+		// done, with an alert in place of the EOF of an accepted connection.
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		if _, clientErr = conn.Read(make([]byte, 1)); errors.Is(clientErr, io.EOF) {
+			clientErr = nil
+		}
+		conn.Close()
+	}
+	return <-serverErr, clientErr
+}
+
+func TestNewTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil, true)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "md", ca, false).write(t, dir, "md")
+
+	config, err := NewTLSConfig(certFile, keyFile, caFile, true)
+	require.NoError(t, err)
+	require.Len(t, config.Certificates, 1)
+	require.NotNil(t, config.ClientCAs)
+	require.Equal(t, tls.RequireAndVerifyClientCert, config.ClientAuth)
+
+	config, err = NewTLSConfig("", "", caFile, false)
+	require.NoError(t, err)
+	require.Empty(t, config.Certificates)
+	require.NotNil(t, config.RootCAs)
+
+	// The CA may also be a directory of PEM files
+	caDir := filepath.Join(dir, "cas")
+	require.NoError(t, os.Mkdir(caDir, 0700))
+	ca.write(t, caDir, "ca")
+	_, err = NewTLSConfig(certFile, keyFile, caDir, true)
+	require.NoError(t, err)
+
+	_, err = NewTLSConfig("", "", "", true)
+	require.Error(t, err, "a server needs a certificate")
+	_, err = NewTLSConfig(certFile, caFile, "", true)
+	require.Error(t, err, "the key doesn't match the certificate")
+	_, err = NewTLSConfig(certFile, keyFile, filepath.Join(dir, "missing.crt"), true)
+	require.Error(t, err)
+	_, err = NewTLSConfig(certFile, keyFile, keyFile, true)
+	require.Error(t, err, "a key is not a certificate authority")
+}
+
+func TestTLS_MutualAuthentication(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil, true)
+	caFile, _ := ca.write(t, dir, "ca")
+	serverCert, serverKey := newTestCert(t, "server", ca, false).write(t, dir, "server")
+	clientCert, clientKey := newTestCert(t, "client", ca, false).write(t, dir, "client")
+	rogueCert, rogueKey := newTestCert(t, "rogue", nil, false).write(t, dir, "rogue")
+
+	serverConfig, err := NewTLSConfig(serverCert, serverKey, caFile, true)
+	require.NoError(t, err)
+
+	clientConfig, err := NewTLSConfig(clientCert, clientKey, caFile, false)
+	require.NoError(t, err)
+	serverErr, clientErr := tlsConnect(t, serverConfig, clientConfig)
+	require.NoError(t, serverErr)
+	require.NoError(t, clientErr)
+
+	// Clients without a certificate, or with one the CA didn't sign, are turned away
+	clientConfig, err = NewTLSConfig("", "", caFile, false)
+	require.NoError(t, err)
+	serverErr, _ = tlsConnect(t, serverConfig, clientConfig)
+	require.Error(t, serverErr)
+
+	clientConfig, err = NewTLSConfig(rogueCert, rogueKey, caFile, false)
+	require.NoError(t, err)
+	serverErr, _ = tlsConnect(t, serverConfig, clientConfig)
+	require.Error(t, serverErr)
+
+	// Servers must be signed by the CA as well
+	rogueServer, err := NewTLSConfig(rogueCert, rogueKey, caFile, true)
+	require.NoError(t, err)
+	clientConfig, err = NewTLSConfig(clientCert, clientKey, caFile, false)
+	require.NoError(t, err)
+	_, clientErr = tlsConnect(t, rogueServer, clientConfig)
+	require.Error(t, clientErr)
+}
+
+func TestHandshake_Timeout(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := newTestCert(t, "server", nil, false).write(t, dir, "server")
+	config, err := NewTLSConfig(certFile, keyFile, "", true)
+	require.NoError(t, err)
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	// The peer connects but never starts its handshake
+	idle, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	start := time.Now()
+	require.Error(t, Handshake(conn, 100*time.Millisecond))
+	require.Less(t, time.Since(start), time.Second)
+
+	// Plain connections don't have a handshake
+	plain, _ := net.Pipe()
+	defer plain.Close()
+	require.NoError(t, Handshake(plain, time.Millisecond))
+}
+
+func TestNewClientAgentTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil, true)
+	caFile, _ := ca.write(t, dir, "ca")
+	intermediate := newTestCert(t, "intermediate", ca, true)
+	chainFile, _ := intermediate.write(t, dir, "intermediate")
+	certFile, keyFile := newTestCert(t, "clientagent", intermediate, false).write(t, dir, "clientagent")
+
+	_, err := NewClientAgentTLSConfig(core.ClientTLS{Certificate: certFile})
+	require.Error(t, err, "a key is required")
+	_, err = NewClientAgentTLSConfig(core.ClientTLS{Certificate: certFile, Key_File: keyFile, Sslv3: true})
+	require.Error(t, err, "SSLv3 is not supported")
+	_, err = NewClientAgentTLSConfig(core.ClientTLS{Certificate: certFile, Key_File: caFile})
+	require.Error(t, err)
+
+	// TLSv1 stays enabled unless turned off
+	config, err := NewClientAgentTLSConfig(core.ClientTLS{Certificate: certFile, Key_File: keyFile})
+	require.NoError(t, err)
+	require.EqualValues(t, tls.VersionTLS10, config.MinVersion)
+	require.Equal(t, tls.NoClientCert, config.ClientAuth)
+	require.Len(t, config.Certificates[0].Certificate, 1)
+
+	tlsv1 := false
+	config, err = NewClientAgentTLSConfig(core.ClientTLS{Certificate: certFile, Key_File: keyFile, Tlsv1: &tlsv1})
+	require.NoError(t, err)
+	require.EqualValues(t, tls.VersionTLS11, config.MinVersion)
+
+	// The chain is sent along with the certificate
+	config, err = NewClientAgentTLSConfig(core.ClientTLS{Certificate: certFile, Key_File: keyFile, Chain_File: chainFile})
+	require.NoError(t, err)
+	require.Len(t, config.Certificates[0].Certificate, 2)
+	require.Equal(t, intermediate.der, config.Certificates[0].Certificate[1])
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	_, clientErr := tlsConnect(t, config, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	require.NoError(t, clientErr)
+}
+
+func TestNewClientAgentTLSConfig_ClientCertificates(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, "ca", nil, true)
+	caFile, _ := ca.write(t, dir, "ca")
+	certFile, keyFile := newTestCert(t, "clientagent", ca, false).write(t, dir, "clientagent")
+
+	// The client's certificate is one below an intermediate, two below the CA
+	intermediate := newTestCert(t, "intermediate", ca, true)
+	client := newTestCert(t, "client", intermediate, false)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientConfig := &tls.Config{
+		RootCAs:    roots,
+		ServerName: "localhost",
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{client.der, intermediate.der},
+			PrivateKey:  client.key,
+		}},
+	}
+
+	config, err := NewClientAgentTLSConfig(core.ClientTLS{Certificate: certFile, Key_File: keyFile, Cert_Authority: caFile})
+	require.NoError(t, err)
+	require.Equal(t, tls.RequireAndVerifyClientCert, config.ClientAuth)
+	serverErr, clientErr := tlsConnect(t, config, clientConfig)
+	require.NoError(t, serverErr)
+	require.NoError(t, clientErr)
+
+	// Clients without a certificate are turned away
+	serverErr, _ = tlsConnect(t, config, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+	require.Error(t, serverErr)
+
+	// As are chains deeper than allowed
+	config, err = NewClientAgentTLSConfig(core.ClientTLS{
+		Certificate: certFile, Key_File: keyFile, Cert_Authority: caFile, Max_Verify_Depth: 1,
+	})
+	require.NoError(t, err)
+	serverErr, _ = tlsConnect(t, config, clientConfig)
+	require.ErrorContains(t, serverErr, "deeper than 1")
+
+	config, err = NewClientAgentTLSConfig(core.ClientTLS{
+		Certificate: certFile, Key_File: keyFile, Cert_Authority: caFile, Max_Verify_Depth: 2,
+	})
+	require.NoError(t, err)
+	serverErr, _ = tlsConnect(t, config, clientConfig)
+	require.NoError(t, serverErr)
+}
@@ -0,0 +1,272 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"net/netip"
+	"otpgo/util"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// binaryMessage sends and receives whole binary WebSocket messages.
+var binaryMessage = websocket.Codec{
+	Marshal: func(v any) ([]byte, byte, error) {
+		return v.([]byte), websocket.BinaryFrame, nil
+	},
+	Unmarshal: func(data []byte, payloadType byte, v any) error {
+		if payloadType != websocket.BinaryFrame {
+			return errors.New("received a non-binary websocket message")
+		}
+		*v.(*[]byte) = data
+		return nil
+	},
+}
+
+// WebSocketConn is a WebSocket connection accepted by a NetworkServer. Its addresses are those of
+// the client and the server rather than the WebSocket URLs.
+type WebSocketConn struct {
+	*websocket.Conn
+	remote net.Addr
+	local  net.Addr
+
+	// done is closed once the connection is closed; the HTTP handler has to outlive it.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *WebSocketConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *WebSocketConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *WebSocketConn) Close() error {
+	err := c.Conn.Close()
+	c.closeOnce.Do(func() { close(c.done) })
+	return err
+}
+
+func (s *NetworkServer) serveWebSocket() error {
+	path := s.WebSocket.Path
+	if path == "" {
+		path = "/"
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, websocket.Server{Handshake: s.checkOrigin, Handler: s.handleWebSocket})
+	err := (&http.Server{Handler: mux}).Serve(s.ln)
+	if atomic.LoadUint32(&s.listening) == 0 {
+		// The listener was closed by Shutdown.
+		return nil
+	}
+	return err
+}
+
+func (s *NetworkServer) checkOrigin(config *websocket.Config, req *http.Request) error {
+	if len(s.WebSocket.Origins) == 0 {
+		return nil
+	}
+	if origin := req.Header.Get("Origin"); !slices.Contains(s.WebSocket.Origins, origin) {
+		return fmt.Errorf("origin \"%s\" is not allowed", origin)
+	}
+	return nil
+}
+
+func (s *NetworkServer) handleWebSocket(ws *websocket.Conn) {
+	ws.PayloadType = websocket.BinaryFrame
+	ws.MaxPayloadBytes = math.MaxUint16
+
+	req := ws.Request()
+	conn := &WebSocketConn{
+		Conn:   ws,
+		remote: parseAddr(req.RemoteAddr),
+		done:   make(chan struct{}),
+	}
+	if local, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		conn.local = local
+	}
+	forwarded := req.Header.Get("X-Forwarded-For")
+	if s.WebSocket.Forwarded_For && forwarded != "" && s.TrustedProxies.Trusts(conn.remote) {
+		// The last address is the one added by the proxy in front of us; earlier ones may be forged.
+		hops := strings.Split(forwarded, ",")
+		if ip, err := netip.ParseAddr(strings.TrimSpace(hops[len(hops)-1])); err == nil {
+			conn.remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(ip, 0))
+		}
+	}
+
+	s.Handler.HandleConnect(conn)
+	<-conn.done
+}
+
+// TrustedProxies are the proxies whose X-Forwarded-For header is believed.
+type TrustedProxies struct {
+	prefixes []netip.Prefix
+	unix     bool
+}
+
+// ParseTrustedProxies parses a list of IPs and CIDRs, in which "unix" stands for every proxy
+// connecting through a unix socket.
+func ParseTrustedProxies(addresses []string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, address := range addresses {
+		if address == "unix" {
+			proxies.unix = true
+			continue
+		}
+
+		var prefix netip.Prefix
+		if strings.Contains(address, "/") {
+			var err error
+			if prefix, err = netip.ParsePrefix(address); err != nil {
+				return TrustedProxies{}, fmt.Errorf("invalid trusted proxy \"%s\": %w", address, err)
+			}
+			prefix = prefix.Masked()
+		} else {
+			ip, err := netip.ParseAddr(address)
+			if err != nil {
+				return TrustedProxies{}, fmt.Errorf("invalid trusted proxy \"%s\": %w", address, err)
+			}
+			prefix = netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen())
+		}
+		proxies.prefixes = append(proxies.prefixes, prefix)
+	}
+	return proxies, nil
+}
+
+// Trusts checks whether a connection from addr comes from one of the proxies.
+func (p TrustedProxies) Trusts(addr net.Addr) bool {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip, ok := netip.AddrFromSlice(addr.IP)
+		if !ok {
+			return false
+		}
+		ip = ip.Unmap()
+		return slices.ContainsFunc(p.prefixes, func(prefix netip.Prefix) bool {
+			return prefix.Contains(ip)
+		})
+	case *net.UnixAddr:
+		return p.unix
+	}
+	return false
+}
+
+// parseAddr parses the remote address of an HTTP request, which is only an IP and port on TCP.
+func parseAddr(addr string) net.Addr {
+	if addrPort, err := netip.ParseAddrPort(addr); err == nil {
+		return net.TCPAddrFromAddrPort(addrPort)
+	}
+	return &net.UnixAddr{Name: addr, Net: "unix"}
+}
+
+// webSocketTransport carries one datagram in every binary WebSocket message. Reads hand out each
+// message with a length prefix, so that clients see the same stream as on a socket.
+type webSocketTransport struct {
+	conn      *WebSocketConn
+	keepAlive time.Duration
+	closed    atomic.Bool
+
+	// pending is what is left of the last message received.
+	pending []byte
+
+	// messages are written out on Flush.
+	sync.Mutex
+	messages [][]byte
+}
+
+// NewWebSocketTransport creates a message based transport for a WebSocket connection.
+func NewWebSocketTransport(conn *WebSocketConn, keepAlive time.Duration) Transport {
+	return &webSocketTransport{conn: conn, keepAlive: keepAlive}
+}
+
+func (w *webSocketTransport) Read(p []byte) (n int, err error) {
+	if len(w.pending) == 0 {
+		if w.keepAlive > 0 {
+			w.conn.SetReadDeadline(time.Now().Add(w.keepAlive))
+		}
+
+		var message []byte
+		if err := binaryMessage.Receive(w.conn.Conn, &message); err != nil {
+			return 0, err
+		}
+		dg := util.NewDatagram()
+		dg.AddUint16(uint16(len(message)))
+		dg.Write(message)
+		w.pending = dg.Bytes()
+	}
+
+	n = copy(p, w.pending)
+	w.pending = w.pending[n:]
+	return n, nil
+}
+
+// Write sends p as a single message.
+func (w *webSocketTransport) Write(p []byte) (n int, err error) {
+	w.Lock()
+	defer w.Unlock()
+	w.messages = append(w.messages, slices.Clone(p))
+	return len(p), nil
+}
+
+// WriteDatagram expects a datagram prefixed with its length, as written by Client.
+func (w *webSocketTransport) WriteDatagram(datagram util.Datagram) (n int, err error) {
+	data := datagram.Bytes()
+	if len(data) < util.Blobsize {
+		return 0, errors.New("datagram is missing its length")
+	}
+	return w.Write(data[util.Blobsize:])
+}
+
+func (w *webSocketTransport) Close() error {
+	if !w.closed.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	return w.conn.Close()
+}
+
+func (w *webSocketTransport) Closed() bool {
+	return w.closed.Load()
+}
+
+func (w *webSocketTransport) Conn() net.Conn {
+	return w.conn
+}
+
+// Flush sends every message written since the last flush.
+func (w *webSocketTransport) Flush() chan error {
+	errChan := make(chan error)
+	go func() {
+		w.Lock()
+		defer w.Unlock()
+
+		var err error
+		for _, message := range w.messages {
+			if err = binaryMessage.Send(w.conn.Conn, message); err != nil {
+				break
+			}
+		}
+		w.messages = w.messages[:0]
+		errChan <- err
+	}()
+	return errChan
+}
+
+// NewTransport creates the transport matching a connection accepted by a NetworkServer.
+func NewTransport(conn net.Conn, keepAlive time.Duration, buffSize int) Transport {
+	if ws, ok := conn.(*WebSocketConn); ok {
+		return NewWebSocketTransport(ws, keepAlive)
+	}
+	return NewSocketTransport(conn, keepAlive, buffSize)
+}
@@ -0,0 +1,190 @@
+package net
+
+import (
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+	"net"
+	"otpgo/core"
+	"otpgo/util"
+	"testing"
+	"time"
+)
+
+type webSocketHandler struct {
+	conns chan net.Conn
+}
+
+func (h *webSocketHandler) HandleConnect(conn net.Conn) {
+	h.conns <- conn
+}
+
+// startWebSocketServer starts a WebSocket listener, returning the URL to connect to and the
+// connections it accepts.
+func startWebSocketServer(t *testing.T, options core.ClientWebSocket) (string, chan net.Conn) {
+	proxies, err := ParseTrustedProxies(options.Trusted_Proxies)
+	require.NoError(t, err)
+	handler := &webSocketHandler{conns: make(chan net.Conn, 1)}
+	server := &NetworkServer{Handler: handler, WebSocket: &options, TrustedProxies: proxies}
+	errChan := make(chan error)
+	go server.Start("127.0.0.1:0", errChan, false)
+	require.NoError(t, <-errChan)
+	t.Cleanup(func() { server.Shutdown() })
+
+	return "ws://" + server.ln.Addr().String() + options.Path, handler.conns
+}
+
+func dialWebSocket(t *testing.T, url string, origin string, forwardedFor string) (*websocket.Conn, error) {
+	config, err := websocket.NewConfig(url, origin)
+	require.NoError(t, err)
+	if forwardedFor != "" {
+		config.Header.Set("X-Forwarded-For", forwardedFor)
+	}
+	return websocket.DialConfig(config)
+}
+
+func acceptWebSocket(t *testing.T, conns chan net.Conn) net.Conn {
+	select {
+	case conn := <-conns:
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	case <-time.After(time.Second):
+		t.Fatal("WebSocket connection was not accepted")
+		return nil
+	}
+}
+
+func TestWebSocketTransport_Read(t *testing.T) {
+	url, conns := startWebSocketServer(t, core.ClientWebSocket{Path: "/game"})
+	ws, err := dialWebSocket(t, url, "http://localhost/", "")
+	require.NoError(t, err)
+	defer ws.Close()
+
+	transport := NewTransport(acceptWebSocket(t, conns), time.Second, 4096)
+
+	// Each message reads as a datagram with its length prefixed, however little is read at once
+	require.NoError(t, websocket.Message.Send(ws, []byte("hello")))
+	require.NoError(t, websocket.Message.Send(ws, []byte("world!")))
+
+	expected := util.NewDatagram()
+	expected.AddUint16(5)
+	expected.WriteString("hello")
+	expected.AddUint16(6)
+	expected.WriteString("world!")
+
+	var read []byte
+	buf := make([]byte, 3)
+	for len(read) < expected.Len() {
+		n, err := transport.Read(buf)
+		require.NoError(t, err)
+		require.LessOrEqual(t, n, len(buf))
+		read = append(read, buf[:n]...)
+	}
+	require.Equal(t, expected.Bytes(), read)
+
+	// Text messages aren't datagrams
+	require.NoError(t, websocket.Message.Send(ws, "hello"))
+	_, err = transport.Read(buf)
+	require.Error(t, err)
+}
+
+func TestWebSocketTransport_Write(t *testing.T) {
+	url, conns := startWebSocketServer(t, core.ClientWebSocket{})
+	ws, err := dialWebSocket(t, url, "http://localhost/", "")
+	require.NoError(t, err)
+	defer ws.Close()
+
+	transport := NewTransport(acceptWebSocket(t, conns), time.Second, 4096)
+
+	// Every datagram goes out in a message of its own, without its length
+	for _, payload := range []string{"first", "second"} {
+		dg := util.NewDatagram()
+		dg.AddString(payload)
+		_, err := transport.WriteDatagram(dg)
+		require.NoError(t, err)
+	}
+	require.NoError(t, <-transport.Flush())
+
+	for _, payload := range []string{"first", "second"} {
+		var message []byte
+		ws.SetReadDeadline(time.Now().Add(time.Second))
+		require.NoError(t, websocket.Message.Receive(ws, &message))
+		require.Equal(t, payload, string(message))
+	}
+
+	_, err = transport.WriteDatagram(util.NewDatagram())
+	require.Error(t, err, "a datagram without its length can't be written")
+}
+
+func TestWebSocket_Origins(t *testing.T) {
+	url, conns := startWebSocketServer(t, core.ClientWebSocket{Origins: []string{"https://game.example"}})
+
+	_, err := dialWebSocket(t, url, "https://evil.example", "")
+	require.Error(t, err)
+
+	ws, err := dialWebSocket(t, url, "https://game.example", "")
+	require.NoError(t, err)
+	defer ws.Close()
+	acceptWebSocket(t, conns)
+}
+
+func TestWebSocket_ForwardedFor(t *testing.T) {
+	// The header is ignored unless a proxy is expected to set it
+	url, conns := startWebSocketServer(t, core.ClientWebSocket{})
+	ws, err := dialWebSocket(t, url, "http://localhost/", "10.0.0.1")
+	require.NoError(t, err)
+	defer ws.Close()
+	addr := acceptWebSocket(t, conns).RemoteAddr().(*net.TCPAddr)
+	require.Equal(t, "127.0.0.1", addr.IP.String())
+	require.NotZero(t, addr.Port)
+
+	// Nor is it believed from anyone but a trusted proxy
+	url, conns = startWebSocketServer(t, core.ClientWebSocket{Forwarded_For: true, Trusted_Proxies: []string{"10.0.0.0/8", "unix"}})
+	ws, err = dialWebSocket(t, url, "http://localhost/", "10.0.0.1")
+	require.NoError(t, err)
+	defer ws.Close()
+	addr = acceptWebSocket(t, conns).RemoteAddr().(*net.TCPAddr)
+	require.Equal(t, "127.0.0.1", addr.IP.String())
+
+	// Only the address added by the proxy is trusted, not those the client sent it
+	url, conns = startWebSocketServer(t, core.ClientWebSocket{Forwarded_For: true, Trusted_Proxies: []string{"127.0.0.1"}})
+	ws, err = dialWebSocket(t, url, "http://localhost/", "10.0.0.1, 192.0.2.7")
+	require.NoError(t, err)
+	defer ws.Close()
+	addr = acceptWebSocket(t, conns).RemoteAddr().(*net.TCPAddr)
+	require.Equal(t, "192.0.2.7", addr.IP.String())
+
+	ws, err = dialWebSocket(t, url, "http://localhost/", "not an address")
+	require.NoError(t, err)
+	defer ws.Close()
+	addr = acceptWebSocket(t, conns).RemoteAddr().(*net.TCPAddr)
+	require.Equal(t, "127.0.0.1", addr.IP.String())
+}
+
+func TestTrustedProxies(t *testing.T) {
+	proxies, err := ParseTrustedProxies([]string{"10.1.0.0/16", "192.0.2.7", "2001:db8::/32"})
+	require.NoError(t, err)
+
+	tcp := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}
+	}
+	require.True(t, proxies.Trusts(tcp("10.1.2.3")))
+	require.True(t, proxies.Trusts(tcp("::ffff:10.1.2.3")))
+	require.False(t, proxies.Trusts(tcp("10.2.0.1")))
+	require.True(t, proxies.Trusts(tcp("192.0.2.7")))
+	require.False(t, proxies.Trusts(tcp("192.0.2.8")))
+	require.True(t, proxies.Trusts(tcp("2001:db8::1")))
+	require.False(t, proxies.Trusts(&net.UnixAddr{Name: "@", Net: "unix"}))
+
+	proxies, err = ParseTrustedProxies([]string{"unix"})
+	require.NoError(t, err)
+	require.True(t, proxies.Trusts(&net.UnixAddr{Name: "@", Net: "unix"}))
+	require.False(t, proxies.Trusts(tcp("127.0.0.1")))
+
+	// Nobody is trusted unless listed
+	require.False(t, TrustedProxies{}.Trusts(tcp("127.0.0.1")))
+
+	_, err = ParseTrustedProxies([]string{"10.0.0.0/33"})
+	require.Error(t, err)
+	_, err = ParseTrustedProxies([]string{"proxy.example.com"})
+	require.Error(t, err)
+}
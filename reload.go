@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"otpgo/core"
+	"otpgo/util"
+
+	"github.com/spf13/pflag"
+)
+
+// reload asks a running daemon to reload its Lua scripts through its MD.
+func reload(args []string) {
+	flags := pflag.NewFlagSet("reload", pflag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf(
+			`Usage:    otpgo reload [options]... [CONFIG_FILE]
+
+      Asks a running OtpGo to reload the Lua scripts of its ClientAgents
+      and Lua roles, by sending CONTROL_RELOAD_LUA to its MD.  The MD is
+      connected to as configured in the configuration file, including
+      its TLS settings and secret, and its ACL has to grant it admin.
+      New events are handled by the new scripts, and a script which
+      fails to load is left as it was.
+
+      Only the roles of the OtpGo hosting that MD are reloaded; those
+      of other processes, even if they are connected to it, are not.
+      Each process has to be sent its own reload through an MD it binds.
+
+      -a, --address   Connect to the MD at this address instead of
+                        messagedirector.bind.
+      -h, --help      Print this help dialog.
+`)
+		os.Exit(1)
+	}
+
+	address := flags.StringP("address", "a", "", "Connect to the MD at this address.")
+	help := flags.BoolP("help", "h", false, "Show the reload usage.")
+
+	flags.Parse(args)
+	if *help {
+		flags.Usage()
+	}
+
+	loadConfig(flags.Args())
+	if *address == "" {
+		*address = core.Config.MessageDirector.Bind
+	}
+
+	dg := util.NewDatagram()
+	dg.AddControlHeader(util.CONTROL_RELOAD_LUA)
+	sendControlMessage(*address, dg)
+	mainLog.Infof("Asked the MD at %s to reload Lua scripts", *address)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"otpgo/core"
+	"otpgo/messagedirector"
+	"otpgo/util"
+	"slices"
+
+	"github.com/spf13/pflag"
+)
+
+// replay runs the daemon and feeds an MD recording back into it.
+func replay(args []string) {
+	flags := pflag.NewFlagSet("replay", pflag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Printf(
+			`Usage:    otpgo replay [options]... RECORDING [CONFIG_FILE]
+
+      Starts OtpGo as usual and routes every datagram of an MD recording
+      through its MD.  Recordings are written by the MD if
+      messagedirector.record is set in the configuration file; the
+      replay itself is never recorded.
+
+      Replayed datagrams would be relayed to the upstream MD like any
+      other, so OtpGo refuses to replay if messagedirector.connect is
+      set, unless --allow-upstream is given.
+
+      -c, --channel   Only replay datagrams addressed to this channel;
+                        may be given more than once.
+      -t, --msgtype   Only replay datagrams with this message type;
+                        may be given more than once.
+      -s, --speed     Replay this many times faster than recorded;
+                        0 replays as fast as possible.  Defaults to 1.
+      -x, --exit      Exit once the recording has been replayed.
+      -u, --allow-upstream
+                      Replay even though the MD is connected upstream.
+      -h, --help      Print this help dialog.
+`)
+		os.Exit(1)
+	}
+
+	channels := flags.UintSliceP("channel", "c", nil, "Only replay datagrams addressed to this channel.")
+	msgTypes := flags.UintSliceP("msgtype", "t", nil, "Only replay datagrams with this message type.")
+	speed := flags.Float64P("speed", "s", 1, "Replay this many times faster than recorded.")
+	exit := flags.BoolP("exit", "x", false, "Exit once the recording has been replayed.")
+	allowUpstream := flags.BoolP("allow-upstream", "u", false, "Replay even though the MD is connected upstream.")
+	help := flags.BoolP("help", "h", false, "Show the replay usage.")
+
+	flags.Parse(args)
+	if *help || flags.NArg() == 0 {
+		flags.Usage()
+	}
+
+	reader, err := messagedirector.OpenRecording(flags.Arg(0))
+	if err != nil {
+		mainLog.Fatal(err.Error())
+	}
+	defer reader.Close()
+
+	loadConfig(flags.Args()[1:])
+	if core.Config.MessageDirector.Connect != "" && !*allowUpstream {
+		mainLog.Fatalf("Refusing to replay into an MD connected to %s; pass --allow-upstream to do so anyway",
+			core.Config.MessageDirector.Connect)
+	}
+	// Recording the replay would only duplicate the recording.
+	core.Config.MessageDirector.Record = ""
+	runDaemon()
+
+	filter := func(rec *messagedirector.RecordedDatagram) bool {
+		if len(*channels) > 0 && !slices.ContainsFunc(rec.Recipients(), func(ch util.Channel_t) bool {
+			return slices.Contains(*channels, uint(ch))
+		}) {
+			return false
+		}
+		if len(*msgTypes) > 0 && !slices.Contains(*msgTypes, uint(rec.MsgType())) {
+			return false
+		}
+		return true
+	}
+
+	mainLog.Infof("Replaying %s...", flags.Arg(0))
+	replayed, err := messagedirector.Replay(reader, filter, *speed)
+	if err != nil {
+		mainLog.Errorf("Replay stopped after %d datagrams: %s", replayed, err)
+	} else {
+		mainLog.Infof("Replayed %d datagrams", replayed)
+	}
+
+	if !*exit {
+		waitForInterrupt()
+	}
+}
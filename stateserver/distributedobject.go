@@ -45,6 +45,9 @@ func NewDistributedObjectWithData(ss *StateServer, doid Doid_t, parent Doid_t,
 	do := ss.doStore.createDO(ss, doid, dclass, requiredFields, ramFields)
 
 	do.Init(do)
+	// Objects read and change the state server's object map, so their datagrams are handled in turn
+	// with the state server's.
+	do.DeliverWith(ss)
 	do.SetName(fmt.Sprintf("%s (%d)", dclass.GetName(), doid))
 
 	do.log.Debug("Object instantiated ...")
@@ -116,6 +119,7 @@ func NewDistributedObject(ss *StateServer, doid Doid_t, parent Doid_t,
 	}
 
 	do.Init(do)
+	do.DeliverWith(ss)
 	do.SetName(fmt.Sprintf("%s (%d)", dclass.GetName(), doid))
 
 	do.log.Debug("Object instantiated ...")
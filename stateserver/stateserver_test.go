@@ -69,15 +69,10 @@ func TestMain(m *testing.M) {
 	// SETUP
 	log.SetLevel(log.DebugLevel)
 
-	StartDaemon(
-		core.ServerConfig{MessageDirector: struct {
-			Bind    string
-			Connect string
-		}{Bind: "127.0.0.1:57123"},
-			General: struct {
-				Eventlogger string
-				DC_Files    []string
-			}{Eventlogger: "", DC_Files: []string{"../test/test.dc"}}})
+	config := core.ServerConfig{}
+	config.MessageDirector.Bind = "127.0.0.1:57123"
+	config.General.DC_Files = []string{"../test/test.dc"}
+	StartDaemon(config)
 	if err := core.LoadDC(); err != nil {
 		os.Exit(1)
 	}
@@ -1170,6 +1165,56 @@ func TestStateServer_DeleteAiObjects(t *testing.T) {
 	conn.Close()
 }
 
+func TestStateServer_ConcurrentCreateDelete(t *testing.T) {
+	creator, deleter := connect(0x70), connect(0x71)
+	first, count := Doid_t(0x7000), 50
+
+	for n := 0; n < count; n++ {
+		instantiateObject(deleter, 0x71, first+Doid_t(n), 30000, 0, 0x1337)
+	}
+
+	// Generate new objects from one connection while deleting the earlier ones from another; the
+	// state server and its objects are routed on different shards, but share the object map.
+	done := make(chan bool)
+	go func() {
+		for n := count; n < 2*count; n++ {
+			dg := (&TestDatagram{}).Create([]Channel_t{100100}, 0x70, STATESERVER_OBJECT_GENERATE_WITH_REQUIRED)
+			appendMetaDoidLast(dg, first+Doid_t(n), 30000, 0, DistributedTestObject1)
+			dg.AddUint32(0x1337)
+			creator.SendDatagram(*dg)
+		}
+		done <- true
+	}()
+	for n := 0; n < count; n++ {
+		deleteObject(deleter, 0x71, first+Doid_t(n))
+	}
+	<-done
+	time.Sleep(100 * time.Millisecond)
+	creator.Flush()
+
+	// Only the objects generated meanwhile should be left
+	for n := 0; n < 2*count; n++ {
+		dg := (&TestDatagram{}).Create([]Channel_t{Channel_t(first + Doid_t(n))}, 0x70, STATESERVER_OBJECT_LOCATE)
+		dg.AddUint32(uint32(n))
+		creator.SendDatagram(*dg)
+	}
+	for n := count; n < 2*count; n++ {
+		dg := (&TestDatagram{}).Create([]Channel_t{0x70}, Channel_t(first+Doid_t(n)), STATESERVER_OBJECT_LOCATE_RESP)
+		dg.AddUint32(uint32(n))
+		appendMeta(dg, first+Doid_t(n), 30000, 0, 6969)
+		creator.Expect(t, *dg, false)
+	}
+	creator.ExpectNone(t)
+
+	// Cleanup
+	for n := count; n < 2*count; n++ {
+		deleteObject(creator, 0x70, first+Doid_t(n))
+	}
+	time.Sleep(10 * time.Millisecond)
+	creator.Close()
+	deleter.Close()
+}
+
 func TestStateServer_Get(t *testing.T) {
 	conn := connect(0x69)
 	do := Channel_t(0x500)
@@ -1536,6 +1581,78 @@ func TestStateServer_SetOwner(t *testing.T) {
 	conn.Close()
 }
 
+func TestStateServer_ChangeOwner(t *testing.T) {
+	own1Chan, own2Chan, do := Channel_t(1235), Channel_t(5679), Channel_t(0xB3)
+	conn, own1, own2 := connect(5), connect(own1Chan), connect(own2Chan)
+
+	instantiateObject(conn, 5, Doid_t(do), 2, 1, 0)
+
+	dg := (&TestDatagram{}).Create([]Channel_t{do}, 5, STATESERVER_OBJECT_SET_OWNER_RECV)
+	dg.AddChannel(own1Chan)
+	conn.SendDatagram(*dg)
+
+	dg = (&TestDatagram{}).Create([]Channel_t{own1Chan}, do, STATESERVER_OBJECT_ENTER_OWNER_RECV)
+	appendMeta(dg, Doid_t(do), 2, 1, DistributedTestObject1)
+	dg.AddUint32(0)
+	dg.AddUint16(0) // 0 optional fields
+	own1.Expect(t, *dg, false)
+
+	// Setting the same owner again shouldn't tell anyone anything
+	dg = (&TestDatagram{}).Create([]Channel_t{do}, 5, STATESERVER_OBJECT_SET_OWNER_RECV)
+	dg.AddChannel(own1Chan)
+	conn.SendDatagram(*dg)
+	own1.ExpectNone(t)
+
+	// Clearing the owner should only tell the old owner, which has to drop the object
+	dg = (&TestDatagram{}).Create([]Channel_t{do}, 5, STATESERVER_OBJECT_SET_OWNER_RECV)
+	dg.AddChannel(INVALID_CHANNEL)
+	conn.SendDatagram(*dg)
+
+	dg = (&TestDatagram{}).Create([]Channel_t{own1Chan}, 5, STATESERVER_OBJECT_CHANGE_OWNER_RECV)
+	dg.AddDoid(Doid_t(do))
+	dg.AddChannel(INVALID_CHANNEL) // New owner
+	dg.AddChannel(own1Chan)        // Old owner
+	own1.Expect(t, *dg, false)
+	own1.ExpectNone(t)
+	own2.ExpectNone(t)
+
+	// An object without an owner is simply entered into the new one
+	dg = (&TestDatagram{}).Create([]Channel_t{do}, 5, STATESERVER_OBJECT_SET_OWNER_RECV)
+	dg.AddChannel(own2Chan)
+	conn.SendDatagram(*dg)
+
+	dg = (&TestDatagram{}).Create([]Channel_t{own2Chan}, do, STATESERVER_OBJECT_ENTER_OWNER_RECV)
+	appendMeta(dg, Doid_t(do), 2, 1, DistributedTestObject1)
+	dg.AddUint32(0)
+	dg.AddUint16(0) // 0 optional fields
+	own2.Expect(t, *dg, false)
+	own1.ExpectNone(t)
+
+	// Handing it back should tell the current owner before entering the previous one again
+	dg = (&TestDatagram{}).Create([]Channel_t{do}, 5, STATESERVER_OBJECT_SET_OWNER_RECV)
+	dg.AddChannel(own1Chan)
+	conn.SendDatagram(*dg)
+
+	dg = (&TestDatagram{}).Create([]Channel_t{own2Chan}, 5, STATESERVER_OBJECT_CHANGE_OWNER_RECV)
+	dg.AddDoid(Doid_t(do))
+	dg.AddChannel(own1Chan) // New owner
+	dg.AddChannel(own2Chan) // Old owner
+	own2.Expect(t, *dg, false)
+
+	dg = (&TestDatagram{}).Create([]Channel_t{own1Chan}, do, STATESERVER_OBJECT_ENTER_OWNER_RECV)
+	appendMeta(dg, Doid_t(do), 2, 1, DistributedTestObject1)
+	dg.AddUint32(0)
+	dg.AddUint16(0) // 0 optional fields
+	own1.Expect(t, *dg, false)
+
+	// Cleanup
+	deleteObject(conn, 5, Doid_t(do))
+	time.Sleep(10 * time.Millisecond)
+	own1.Close()
+	own2.Close()
+	conn.Close()
+}
+
 func TestStateServer_Molecular(t *testing.T) {
 	do, locationChan := Channel_t(0xB00B), LocationAsChannel(2500, 5000)
 	conn, location := connect(1337), connect(locationChan)
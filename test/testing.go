@@ -108,16 +108,27 @@ const (
 )
 
 type UpstreamHandler struct {
-	Server *gonet.Conn
+	conns chan gonet.Conn
 }
 
 func (u *UpstreamHandler) HandleConnect(conn gonet.Conn) {
-	u.Server = &conn
+	u.conns <- conn
+}
+
+// Accept waits for the next connection made to the upstream, returning nil if there is none
+// within the timeout.
+func (u *UpstreamHandler) Accept(timeout time.Duration) gonet.Conn {
+	select {
+	case conn := <-u.conns:
+		return conn
+	case <-time.After(timeout):
+		return nil
+	}
 }
 
 func StartDaemon(config core.ServerConfig) {
 	core.Config = &config
-	eventlogger.StartEventLogger()
+	eventlogger.StartEventLogger(core.Role{Bind: "127.0.0.1:9090"})
 
 }
 
@@ -132,7 +143,7 @@ func ReloadConfig(config core.ServerConfig) {
 
 func StartUpstream(bindAddr string) *UpstreamHandler {
 	server := &net.NetworkServer{}
-	handler := &UpstreamHandler{}
+	handler := &UpstreamHandler{conns: make(chan gonet.Conn, 8)}
 	server.Handler = handler
 	errChan := make(chan error)
 	go func() {
@@ -143,7 +154,7 @@ func StartUpstream(bindAddr string) *UpstreamHandler {
 			panic(fmt.Sprintf("Failed to open upstream: %s", err.Error()))
 		}
 	}()
-	go server.Start(bindAddr, errChan)
+	go server.Start(bindAddr, errChan, false)
 	return handler
 }
 
@@ -339,6 +350,14 @@ func (d *TestDatagram) CreateSetConUrl(name string) *Datagram {
 	return d.Dg
 }
 
+func (d *TestDatagram) CreateAuthenticate(secret string) *Datagram {
+	dg := NewDatagram()
+	dg.AddControlHeader(CONTROL_AUTHENTICATE)
+	dg.AddString(secret)
+	d.DatagramIterator = NewDatagramIterator(&dg)
+	return d.Dg
+}
+
 // Utility class for managing MD connections in a test environment
 type TestMDConnection struct {
 	*net.Client
@@ -360,9 +379,9 @@ func (c *TestMDConnection) Connect(addr string, name string) *TestMDConnection {
 	c.Timeout = 201
 	c.messages = make(chan Datagram, 200)
 	c.name = name
-	conn, err := gonet.Dial("tcp", addr)
+	conn, err := net.Dial(addr)
 	if err != nil {
-		panic(fmt.Sprintf("Testing client failed to connect to %d: %s", addr, err))
+		panic(fmt.Sprintf("Testing client failed to connect to %s: %s", addr, err))
 	}
 
 	socket := net.NewSocketTransport(conn, 60*time.Second, 4096)
@@ -35,6 +35,14 @@ const (
 	CONTROL_CLEAR_POST_REMOVES = 2011
 	CONTROL_LOG_MESSAGE        = 2012
 
+	CONTROL_QUERY_PARTICIPANTS      = 2013
+	CONTROL_QUERY_PARTICIPANTS_RESP = 2014
+	CONTROL_AUTHENTICATE            = 2015
+	CONTROL_RELOAD_LUA              = 2016
+	CONTROL_DRAIN_CLIENTS           = 2017
+	CONTROL_BAN_ADDRESS             = 2018
+	CONTROL_UNBAN_ADDRESS           = 2019
+
 	// ClientAgent messages
 	CLIENTAGENT_SET_STATE                = 3000
 	CLIENTAGENT_SET_CLIENT_ID            = 3001
@@ -49,6 +57,7 @@ const (
 	CLIENTAGENT_REMOVE_SESSION_OBJECT    = 3013
 	CLIENTAGENT_GET_TLVS                 = 3014
 	CLIENTAGENT_GET_TLVS_RESP            = 3015
+	CLIENTAGENT_START_CAPTURE            = 3020
 	CLIENTAGENT_OPEN_CHANNEL             = 3100
 	CLIENTAGENT_CLOSE_CHANNEL            = 3101
 	CLIENTAGENT_ADD_POST_REMOVE          = 3110